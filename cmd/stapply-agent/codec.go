@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/queue"
+	"github.com/drax2gma/stapply/internal/security"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+// codec encodes and decodes agent messages: protocol envelope plus optional
+// encryption. Replies mirror the request's protocol version so controllers
+// that predate the envelope keep working, and are encrypted with the key the
+// request was encrypted with. Enveloped messages are signed with the agent's
+// identity key so controllers can tell them apart from impostors.
+type codec struct {
+	agentID  string
+	keys     *security.Keyring // empty = encryption disabled
+	replay   *security.ReplayGuard
+	trusted  map[string]bool // Controller public keys allowed to sign requests (empty = unsigned accepted)
+	identity nkeys.KeyPair
+
+	allowLegacy bool // Accept unversioned requests in legacy ciphertexts (allow_legacy_crypto)
+
+	maxPayload int // Largest message the server accepts (0 = unchecked)
+}
+
+// envelope is a decoded request and the key it was encrypted with.
+type envelope struct {
+	*protocol.Envelope
+	key security.Key
+}
+
+// decode decrypts (if needed) and unwraps a request of type msgType into v.
+func (c *codec) decode(msg *nats.Msg, msgType protocol.RequestType, v interface{}) (*envelope, error) {
+	return c.open(msg.Subject, msgType, msg.Data, v, c.replay.Check)
+}
+
+// decodeQueued is decode for requests taken from the agent's work queue,
+// which may have waited up to queue.MaxAge. Their message ID must match the
+// JetStream one: the stream refuses IDs it has seen for as long, so a
+// captured request cannot be queued again and the agent need not remember
+// the IDs itself.
+func (c *codec) decodeQueued(msg jetstream.Msg, v interface{}) (*envelope, error) {
+	env, err := c.open(msg.Subject(), protocol.RequestTypeQueue, msg.Data(), v, func(id string, ts time.Time) error {
+		return security.CheckFresh(id, ts, queue.MaxAge)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if env.Version == 0 || msg.Headers().Get(jetstream.MsgIDHeader) != env.MessageID {
+		return nil, fmt.Errorf("rejected message on %s: message id does not match its envelope", msg.Subject())
+	}
+	return env, nil
+}
+
+// open decrypts and unwraps a request received on subject, checking its
+// message ID and timestamp with replay. Envelopes must be of msgType, the
+// type the subject is for: their signature covers the type but not the
+// subject, so a request captured on one subject could otherwise be replayed
+// as another type whose payload happens to decode.
+func (c *codec) open(subject string, msgType protocol.RequestType, data []byte, v interface{}, replay func(id string, ts time.Time) error) (*envelope, error) {
+	var key security.Key
+	if !c.keys.Empty() {
+		var err error
+		data, key, err = c.keys.Decrypt(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	env, err := protocol.Unmarshal(data, v)
+	if err != nil {
+		return nil, err
+	}
+	if env.Version > 0 && env.Type != msgType {
+		return nil, fmt.Errorf("rejected message on %s: %s request on the %s subject", subject, env.Type, msgType)
+	}
+	if err := c.checkReplay(env, key, replay); err != nil {
+		return nil, fmt.Errorf("rejected message on %s: %w", subject, err)
+	}
+	if env.Version > protocol.ProtocolVersion {
+		log.Printf("⚠️  Request from %s uses protocol v%d, agent speaks v%d",
+			env.SenderID, env.Version, protocol.ProtocolVersion)
+	}
+	return &envelope{Envelope: env, key: key}, nil
+}
+
+// checkReplay rejects stale and duplicate envelopes. With encryption on,
+// bare pre-envelope messages are refused since they carry no message ID,
+// unless allow_legacy_crypto admits them from the controllers that send
+// them, which also use the legacy ciphertext format.
+func (c *codec) checkReplay(env *protocol.Envelope, key security.Key, replay func(id string, ts time.Time) error) error {
+	if env.Version == 0 {
+		if c.keys.Empty() {
+			return nil
+		}
+		if !c.allowLegacy || !key.Legacy() {
+			return fmt.Errorf("unversioned message has no replay protection")
+		}
+		log.Printf("⚠️  Accepting unversioned request without replay protection (allow_legacy_crypto)")
+		return nil
+	}
+	return replay(env.MessageID, env.Timestamp)
+}
+
+// authorize checks that a request was signed by a trusted controller. With
+// no trusted controllers configured every request is accepted.
+func (c *codec) authorize(req *envelope) error {
+	if len(c.trusted) == 0 {
+		return nil
+	}
+	if req.Version == 0 || req.Signer == "" {
+		return fmt.Errorf("request is not signed")
+	}
+	if !c.trusted[req.Signer] {
+		return fmt.Errorf("signer %s is not a trusted controller", req.Signer)
+	}
+	return req.Verify()
+}
+
+// encode wraps and encrypts (if needed) an outgoing message. Messages sent in
+// reply to a request follow its protocol version and key, and are compressed
+// if the request accepts it; others (inReplyTo nil) use the current protocol
+// and the primary key.
+func (c *codec) encode(msgType protocol.RequestType, v interface{}, inReplyTo *envelope) ([]byte, error) {
+	var data []byte
+	var err error
+	if inReplyTo != nil && inReplyTo.Version == 0 {
+		data, err = json.Marshal(v)
+	} else {
+		opts := protocol.MarshalOptions{Signer: c.identity}
+		if inReplyTo != nil && inReplyTo.Accept == protocol.CompressionZstd {
+			opts.Compression = protocol.CompressionZstd
+		}
+		data, err = protocol.MarshalWith(msgType, c.agentID, v, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.keys.Empty() {
+		return data, nil
+	}
+	key, _ := c.keys.Primary()
+	if inReplyTo != nil {
+		key = inReplyTo.key
+	}
+	return key.Encrypt(data)
+}
+
+// encodeReply is encode for a reply to req, cutting down the output it
+// carries until the encoded message fits in maxPayload. JSON escaping,
+// compression and encryption make the encoded size hard to predict, so it is
+// measured rather than estimated.
+func (c *codec) encodeReply(msgType protocol.RequestType, v interface{}, req *envelope) ([]byte, error) {
+	for {
+		data, err := c.encode(msgType, v, req)
+		if err != nil || c.maxPayload <= 0 || len(data) <= c.maxPayload {
+			return data, err
+		}
+		smaller := shrinkReply(v)
+		if smaller == nil {
+			return nil, fmt.Errorf("%d byte message exceeds the server's %d byte limit", len(data), c.maxPayload)
+		}
+		v = smaller
+	}
+}
+
+// shrinkReply returns a copy of reply v carrying less output, or nil if v
+// has no output left to cut.
+func shrinkReply(v interface{}) interface{} {
+	switch r := v.(type) {
+	case *protocol.RunResponse:
+		if out := shrinkRun(r); out != nil {
+			return out
+		}
+	case *protocol.QueuedResult:
+		if res := shrinkRun(r.Result); res != nil {
+			out := *r
+			out.Result = res
+			return &out
+		}
+	case *protocol.JobResponse:
+		out := *r
+		out.Jobs = make([]protocol.JobInfo, len(r.Jobs))
+		shrunk := false
+		for i, ji := range r.Jobs {
+			if res := shrinkRun(ji.Result); res != nil {
+				ji.Result = res
+				shrunk = true
+			}
+			out.Jobs[i] = ji
+		}
+		if shrunk {
+			return &out
+		}
+	case *protocol.OutputResponse:
+		// The controller asks for the rest from Offset+len(Data)
+		if len(r.Data) > 0 {
+			out := *r
+			out.Data = r.Data[:len(r.Data)/2]
+			return &out
+		}
+	}
+	return nil
+}
+
+// minShrinkOutput is the output limit below which shrinkRun drops the
+// output altogether rather than truncating it further.
+const minShrinkOutput = 256
+
+// shrinkRun returns r with its output streams cut to half the longer one's
+// size, or nil if r has no output.
+func shrinkRun(r *protocol.RunResponse) *protocol.RunResponse {
+	if r == nil || r.Stdout == "" && r.Stderr == "" {
+		return nil
+	}
+	limit := max(len(r.Stdout), len(r.Stderr)) / 2
+	if limit >= minShrinkOutput {
+		return r.WithOutputLimit(limit)
+	}
+	out := r.WithOutputLimit(0)
+	out.Stdout, out.Stderr, out.Truncated = "", "", true
+	return out
+}
+
+// reply sends v as the response to a request decoded with decode.
+func (c *codec) reply(msg *nats.Msg, req *envelope, v interface{}) {
+	data, err := c.encodeReply(req.Type.Reply(), v, req)
+	if err != nil {
+		log.Printf("Failed to encode %s response: %v", req.Type, err)
+		return
+	}
+
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Failed to send %s response: %v", req.Type, err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/security"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestEncodeReplyFitsMaxPayload(t *testing.T) {
+	enc := &codec{agentID: "web1", keys: security.NewKeyring(), maxPayload: 4096}
+	req := &envelope{Envelope: &protocol.Envelope{Version: protocol.ProtocolVersion, Type: protocol.RequestTypeRun}}
+
+	// Control characters take six bytes each once JSON-escaped
+	noisy := strings.Repeat("\x01", 4000)
+	resp := protocol.NewRunResponse("r1", true, 0, noisy, noisy, 1)
+
+	data, err := enc.encodeReply(protocol.RequestTypeRun.Reply(), resp, req)
+	if err != nil {
+		t.Fatalf("encodeReply() error = %v", err)
+	}
+	if len(data) > enc.maxPayload {
+		t.Fatalf("encodeReply() = %d bytes, over the %d byte limit", len(data), enc.maxPayload)
+	}
+	var got protocol.RunResponse
+	if _, err := protocol.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Truncated || got.StdoutBytes != 4000 || got.StderrBytes != 4000 {
+		t.Errorf("reply = truncated %v, %d/%d bytes, want truncated with full sizes", got.Truncated, got.StdoutBytes, got.StderrBytes)
+	}
+	if resp.Truncated || len(resp.Stdout) != 4000 {
+		t.Error("encodeReply() modified the response it was given")
+	}
+
+	// Nothing to cut: an error rather than a message the server refuses
+	enc.maxPayload = 64
+	if _, err := enc.encodeReply(protocol.RequestTypeRun.Reply(), protocol.NewRunResponse("r2", false, 0, "", "", 1), req); err == nil {
+		t.Error("encodeReply() succeeded for a reply that cannot fit")
+	}
+}
+
+func TestDecodeLegacyPing(t *testing.T) {
+	const secret = "legacy passphrase"
+	keys := security.NewKeyring(security.Key{Secret: secret})
+	keys.SetAllowLegacy(true)
+
+	// What a controller from before the envelope and KDF header sends
+	bare, err := json.Marshal(&protocol.PingRequest{RequestID: "p1", Type: protocol.RequestTypePing, ControllerVersion: "0.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := security.Encrypt(bare, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &nats.Msg{Subject: protocol.RequestTypePing.Subject("web1"), Data: data}
+
+	enc := &codec{agentID: "web1", keys: keys, replay: security.NewReplayGuard(time.Minute)}
+	var req protocol.PingRequest
+	if _, err := enc.decode(msg, protocol.RequestTypePing, &req); err == nil {
+		t.Error("decode() accepted an unversioned request without allow_legacy_crypto")
+	}
+
+	enc.allowLegacy = true
+	env, err := enc.decode(msg, protocol.RequestTypePing, &req)
+	if err != nil {
+		t.Fatalf("decode() error = %v", err)
+	}
+	if req.RequestID != "p1" || req.ControllerVersion != "0.1.0" {
+		t.Errorf("request = %+v", req)
+	}
+
+	// The reply is bare JSON in the legacy format the controller reads
+	reply, err := enc.encodeReply(protocol.RequestTypePing.Reply(), protocol.NewPingResponse("p1", "web1", "0.2.0", 1, 0, 0), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := security.Decrypt(reply, secret)
+	if err != nil {
+		t.Fatalf("reply is not in the legacy format: %v", err)
+	}
+	var resp protocol.PingResponse
+	if err := json.Unmarshal(plain, &resp); err != nil || resp.RequestID != "p1" || resp.AgentID != "web1" {
+		t.Errorf("reply = %s (%v)", plain, err)
+	}
+
+	// A current controller never sends unversioned requests
+	current := security.Key{Secret: secret}
+	if data, err = current.Encrypt(bare); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.decode(&nats.Msg{Subject: msg.Subject, Data: data}, protocol.RequestTypePing, &req); err == nil {
+		t.Error("decode() accepted an unversioned request in the current ciphertext format")
+	}
+}
+
+func TestDecodeRejectsOtherType(t *testing.T) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := kp.PublicKey()
+	enc := &codec{agentID: "web1", keys: security.NewKeyring(), replay: security.NewReplayGuard(time.Minute), trusted: map[string]bool{pub: true}}
+
+	// A signed job result request decodes as a job status request too
+	data, err := protocol.MarshalWith(protocol.RequestTypeJobResult, "ctl@test", &protocol.JobRequest{RequestID: "r1", JobID: "j1"}, protocol.MarshalOptions{Signer: kp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req protocol.JobRequest
+	if _, err := enc.decode(&nats.Msg{Subject: protocol.RequestTypeJobStatus.Subject("web1"), Data: data}, protocol.RequestTypeJobStatus, &req); err == nil {
+		t.Error("decode() accepted a job result request on the job status subject")
+	}
+
+	env, err := enc.decode(&nats.Msg{Subject: protocol.RequestTypeJobResult.Subject("web1"), Data: data}, protocol.RequestTypeJobResult, &req)
+	if err != nil {
+		t.Fatalf("decode() error = %v", err)
+	}
+	if err := enc.authorize(env); err != nil || req.JobID != "j1" {
+		t.Errorf("authorize() = %v, request = %+v", err, req)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// heartbeatLoop publishes a presence heartbeat right away and then every interval.
+func heartbeatLoop(nc *nats.Conn, enc *codec, interval time.Duration) {
+	subject := protocol.RequestTypeHeartbeat.Subject(enc.agentID)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cpu, mem := currentLoad()
+		data, err := enc.encode(protocol.RequestTypeHeartbeat, &protocol.Heartbeat{
+			AgentID:       enc.agentID,
+			Version:       Version,
+			UptimeSeconds: int64(time.Since(startTime).Seconds()),
+			CPUUsage:      cpu,
+			MemoryUsage:   mem,
+			IntervalMs:    interval.Milliseconds(),
+			SentAt:        time.Now().UTC(),
+		}, nil)
+		if err != nil {
+			log.Printf("Failed to encode heartbeat: %v", err)
+		} else if err := nc.Publish(subject, data); err != nil && !nc.IsClosed() {
+			log.Printf("Failed to publish heartbeat: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// job tracks one run request executed by this agent.
+type job struct {
+	id          string
+	action      string
+	outputLimit int // Bytes of stdout/stderr each included in replies
+	startedAt   time.Time
+	finishedAt  time.Time
+	done        chan struct{} // closed when result is set
+	result      *protocol.RunResponse
+	cancel      context.CancelFunc // kills the running action, nil until execution starts
+	cancelled   bool               // cancel requested before execution started
+}
+
+// info returns a protocol snapshot of the job. Callers must hold the store lock.
+func (j *job) info() protocol.JobInfo {
+	ji := protocol.JobInfo{
+		JobID:     j.id,
+		Action:    j.action,
+		State:     protocol.JobRunning,
+		StartedAt: j.startedAt,
+	}
+	if j.result != nil {
+		finished := j.finishedAt
+		ji.State = protocol.JobDone
+		ji.FinishedAt = &finished
+		ji.Result = j.result.WithOutputLimit(j.outputLimit)
+	}
+	return ji
+}
+
+// jobStore is an in-memory table of running and recently finished jobs.
+// Finished jobs are dropped once they are older than the retention period.
+// Results keep the full output; replies carry at most maxOutput bytes of
+// stdout and stderr each so they fit in a NATS message.
+type jobStore struct {
+	mu        sync.Mutex
+	jobs      map[string]*job
+	retention time.Duration
+	maxOutput int
+}
+
+func newJobStore(retention time.Duration, maxOutput int) *jobStore {
+	return &jobStore{
+		jobs:      make(map[string]*job),
+		retention: retention,
+		maxOutput: maxOutput,
+	}
+}
+
+// outputLimit returns the reply output limit for a requested one.
+func (s *jobStore) outputLimit(requested int) int {
+	if requested <= 0 {
+		requested = protocol.DefaultOutputLimit
+	}
+	return min(requested, s.maxOutput)
+}
+
+// start registers a new running job whose replies carry at most outputLimit
+// bytes of each output stream. It returns false if the ID is already known.
+func (s *jobStore) start(id, action string, outputLimit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.jobs[id]; exists {
+		return false
+	}
+	s.jobs[id] = &job{
+		id:          id,
+		action:      action,
+		outputLimit: s.outputLimit(outputLimit),
+		startedAt:   time.Now(),
+		done:        make(chan struct{}),
+	}
+	return true
+}
+
+// finish records the result of a job and wakes up any waiters.
+func (s *jobStore) finish(id string, resp *protocol.RunResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || j.result != nil {
+		return
+	}
+	j.result = resp
+	j.finishedAt = time.Now()
+	close(j.done)
+}
+
+// setCancel attaches the function that interrupts a running job.
+func (s *jobStore) setCancel(id string, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[id]; ok {
+		j.cancel = cancel
+		if j.cancelled {
+			cancel()
+		}
+	}
+}
+
+// cancel interrupts a running job, or one that has not started executing
+// yet as soon as it does. It returns false if the job is unknown or already
+// finished.
+func (s *jobStore) cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || j.result != nil {
+		return false
+	}
+	j.cancelled = true
+	if j.cancel != nil {
+		j.cancel()
+	}
+	return true
+}
+
+// get returns a snapshot of a job.
+func (s *jobStore) get(id string) (protocol.JobInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return protocol.JobInfo{}, false
+	}
+	return j.info(), true
+}
+
+// wait blocks until the job finishes or the timeout expires, then returns its snapshot.
+func (s *jobStore) wait(id string, timeout time.Duration) (protocol.JobInfo, bool) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		return protocol.JobInfo{}, false
+	}
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-j.done:
+		case <-timer.C:
+		}
+	}
+	return s.get(id)
+}
+
+// output returns up to length bytes of a finished job's full stream output
+// starting at offset, and the stream's total size.
+func (s *jobStore) output(id, stream string, offset int64, length int) ([]byte, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown job: %s", id)
+	}
+	if j.result == nil {
+		return nil, 0, fmt.Errorf("job %s is still running", id)
+	}
+
+	var data string
+	switch stream {
+	case protocol.OutputStdout:
+		data = j.result.Stdout
+	case protocol.OutputStderr:
+		data = j.result.Stderr
+	default:
+		return nil, 0, fmt.Errorf("unknown output stream %q", stream)
+	}
+
+	total := int64(len(data))
+	if offset < 0 || offset > total {
+		return nil, total, fmt.Errorf("offset %d out of range (size %d)", offset, total)
+	}
+	if length <= 0 || length > s.maxOutput {
+		length = s.maxOutput
+	}
+	end := min(offset+int64(length), total)
+	return []byte(data[offset:end]), total, nil
+}
+
+// list returns snapshots of all known jobs, oldest first, without their output.
+func (s *jobStore) list() []protocol.JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]protocol.JobInfo, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		ji := j.info()
+		// Listings carry no output so any number of jobs fits in one reply
+		if r := ji.Result; r != nil && r.Stdout+r.Stderr != "" {
+			r.Stdout, r.Stderr, r.Truncated = "", "", true
+		}
+		result = append(result, ji)
+	}
+	sort.Slice(result, func(i, k int) bool {
+		return result[i].StartedAt.Before(result[k].StartedAt)
+	})
+	return result
+}
+
+// reapLoop periodically removes finished jobs older than the retention period.
+func (s *jobStore) reapLoop() {
+	interval := s.retention / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for {
+		time.Sleep(interval)
+
+		s.mu.Lock()
+		for id, j := range s.jobs {
+			if j.result != nil && time.Since(j.finishedAt) > s.retention {
+				delete(s.jobs, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func handleJobStatus(msg *nats.Msg, enc *codec, jobs *jobStore) {
+	var req protocol.JobRequest
+	env, err := enc.decode(msg, protocol.RequestTypeJobStatus, &req)
+	if err != nil {
+		log.Printf("Invalid job status request: %v", err)
+		return
+	}
+
+	resp := &protocol.JobResponse{RequestID: req.RequestID}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected job status request on %s: %v", msg.Subject, err)
+		resp.Error = "unauthorized: " + err.Error()
+		enc.reply(msg, env, resp)
+		return
+	}
+	if req.JobID == "" {
+		resp.Jobs = jobs.list()
+	} else if ji, ok := jobs.get(req.JobID); ok {
+		resp.Jobs = []protocol.JobInfo{ji}
+	} else {
+		resp.Error = "unknown job: " + req.JobID
+	}
+	enc.reply(msg, env, resp)
+}
+
+func handleJobResult(msg *nats.Msg, enc *codec, jobs *jobStore) {
+	var req protocol.JobRequest
+	env, err := enc.decode(msg, protocol.RequestTypeJobResult, &req)
+	if err != nil {
+		log.Printf("Invalid job result request: %v", err)
+		return
+	}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected job result request on %s: %v", msg.Subject, err)
+		enc.reply(msg, env, &protocol.JobResponse{RequestID: req.RequestID, Error: "unauthorized: " + err.Error()})
+		return
+	}
+
+	// Wait in the background so one long-poll doesn't block other queries
+	go func() {
+		resp := &protocol.JobResponse{RequestID: req.RequestID}
+		wait := time.Duration(req.WaitMs) * time.Millisecond
+		if ji, ok := jobs.wait(req.JobID, wait); ok {
+			resp.Jobs = []protocol.JobInfo{ji}
+		} else {
+			resp.Error = "unknown job: " + req.JobID
+		}
+		enc.reply(msg, env, resp)
+	}()
+}
+
+func handleJobOutput(msg *nats.Msg, enc *codec, jobs *jobStore) {
+	var req protocol.OutputRequest
+	env, err := enc.decode(msg, protocol.RequestTypeJobOutput, &req)
+	if err != nil {
+		log.Printf("Invalid job output request: %v", err)
+		return
+	}
+
+	resp := &protocol.OutputResponse{RequestID: req.RequestID, Offset: req.Offset}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected job output request on %s: %v", msg.Subject, err)
+		resp.Error = "unauthorized: " + err.Error()
+		enc.reply(msg, env, resp)
+		return
+	}
+	data, total, err := jobs.output(req.JobID, req.Stream, req.Offset, req.Length)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	resp.Data = data
+	resp.Total = total
+	enc.reply(msg, env, resp)
+}
+
+func handleCancel(msg *nats.Msg, enc *codec, jobs *jobStore) {
+	var req protocol.CancelRequest
+	env, err := enc.decode(msg, protocol.RequestTypeCancel, &req)
+	if err != nil {
+		log.Printf("Invalid cancel request: %v", err)
+		return
+	}
+
+	resp := &protocol.CancelResponse{RequestID: req.RequestID}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected cancel request on %s: %v", msg.Subject, err)
+		resp.Error = "unauthorized: " + err.Error()
+		enc.reply(msg, env, resp)
+		return
+	}
+	if jobs.cancel(req.TargetID) {
+		log.Printf("Cancelled request %s", req.TargetID)
+		resp.Cancelled = true
+	} else {
+		resp.Error = "not running: " + req.TargetID
+	}
+	enc.reply(msg, env, resp)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+func TestCancelBeforeExecution(t *testing.T) {
+	jobs := newJobStore(time.Hour, 1<<20)
+	if !jobs.start("job1", "cmd", 0) {
+		t.Fatal("start() = false for a new job")
+	}
+
+	// A cancel between start and setCancel must not be lost
+	if !jobs.cancel("job1") {
+		t.Fatal("cancel() = false for a job that has not started executing")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs.setCancel("job1", cancel)
+	if ctx.Err() == nil {
+		t.Error("job was not cancelled once its cancel func was registered")
+	}
+
+	if jobs.cancel("unknown") {
+		t.Error("cancel() = true for an unknown job")
+	}
+}
+
+func TestJobListTruncated(t *testing.T) {
+	jobs := newJobStore(time.Hour, 1<<20)
+	for _, id := range []string{"quiet", "noisy"} {
+		jobs.start(id, "cmd", 0)
+	}
+	jobs.finish("quiet", protocol.NewRunResponse("quiet", false, 0, "", "", 1))
+	jobs.finish("noisy", protocol.NewRunResponse("noisy", false, 0, "hello", "", 1))
+
+	for _, ji := range jobs.list() {
+		r := ji.Result
+		if r.Stdout != "" || r.Stderr != "" {
+			t.Errorf("list() job %s carries output", ji.JobID)
+		}
+		if want := ji.JobID == "noisy"; r.Truncated != want {
+			t.Errorf("list() job %s Truncated = %v, want %v", ji.JobID, r.Truncated, want)
+		}
+	}
+}
+
+func TestRepeatedReply(t *testing.T) {
+	jobs := newJobStore(time.Hour, 1<<20)
+	jobs.start("done", "cmd", 0)
+	result := protocol.NewRunResponse("done", true, 0, "out", "", 5)
+	jobs.finish("done", result)
+	jobs.start("running", "cmd", 0)
+
+	errorOf := func(reply interface{}) string {
+		if resp, ok := reply.(*protocol.RunResponse); ok && resp.Status == protocol.StatusError {
+			return resp.Error
+		}
+		return ""
+	}
+
+	if got, ok := repeatedReply(jobs, "web1", &protocol.RunRequest{RequestID: "done", Action: "cmd"}).(*protocol.RunResponse); !ok || !got.Changed || got.Stdout != result.Stdout {
+		t.Errorf("finished job: reply = %+v, want its recorded result", got)
+	}
+	if got := errorOf(repeatedReply(jobs, "web1", &protocol.RunRequest{RequestID: "done", Action: "systemd"})); !strings.Contains(got, "already used for action cmd") {
+		t.Errorf("mismatched action: error = %q", got)
+	}
+	if got := errorOf(repeatedReply(jobs, "web1", &protocol.RunRequest{RequestID: "reaped", Action: "cmd"})); !strings.Contains(got, "unknown job") {
+		t.Errorf("unknown job: error = %q", got)
+	}
+
+	ack, ok := repeatedReply(jobs, "web1", &protocol.RunRequest{RequestID: "running", Action: "cmd", Async: true}).(*protocol.JobAck)
+	if !ok || ack.JobID != "running" || ack.State != protocol.JobRunning {
+		t.Errorf("async while running: reply = %+v, want a running job ack", ack)
+	}
+
+	// A synchronous repeat waits up to its timeout, then points at the job
+	start := time.Now()
+	got := errorOf(repeatedReply(jobs, "web1", &protocol.RunRequest{RequestID: "running", Action: "cmd", TimeoutMs: 50}))
+	if !strings.Contains(got, "still running as job running") {
+		t.Errorf("sync while running: error = %q", got)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("sync while running: did not wait for the job")
+	}
+
+	// ... and gets the result if the job finishes meanwhile
+	late := protocol.NewRunResponse("running", false, 0, "", "", 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		jobs.finish("running", late)
+	}()
+	resp, ok := repeatedReply(jobs, "web1", &protocol.RunRequest{RequestID: "running", Action: "cmd", TimeoutMs: 5000}).(*protocol.RunResponse)
+	if !ok || resp.Status != protocol.StatusOK || resp.DurationMs != late.DurationMs {
+		t.Errorf("sync finishing meanwhile: reply = %+v, want the job's result", resp)
+	}
+}
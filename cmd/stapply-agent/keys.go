@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/security"
+	"github.com/nats-io/nats.go"
+)
+
+// loadKeyring reads the agent's keyring file. Until the file exists (it is
+// written on the first key change), STAPPLY_SHARED_KEY is the only key.
+func loadKeyring(path string) (*security.Keyring, error) {
+	keys, err := security.LoadKeyring(path)
+	switch {
+	case err == nil:
+		if keys.Empty() {
+			log.Printf("⚠️  Keyring %s has no keys, encryption disabled", path)
+		} else {
+			log.Printf("Encryption enabled (keys %s from %s)", strings.Join(keys.IDs(), ", "), path)
+		}
+		return keys, nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	keys = security.NewKeyring()
+	if v := os.Getenv("STAPPLY_SHARED_KEY"); v != "" {
+		keys.Add(security.ParseKey(v))
+		log.Printf("Encryption enabled (key provided via STAPPLY_SHARED_KEY)")
+	}
+	return keys, nil
+}
+
+func handleKey(msg *nats.Msg, enc *codec, keyringFile string) {
+	var req protocol.KeyRequest
+	env, err := enc.decode(msg, protocol.RequestTypeKey, &req)
+	if err != nil {
+		log.Printf("Invalid key request: %v", err)
+		return
+	}
+
+	resp := &protocol.KeyResponse{RequestID: req.RequestID}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected key request on %s: %v", msg.Subject, err)
+		resp.Error = "unauthorized: " + err.Error()
+		enc.reply(msg, env, resp)
+		return
+	}
+	if err := applyKeyOp(enc.keys, env.key, &req, keyringFile); err != nil {
+		log.Printf("❌ Key %s %q failed: %v", req.Op, req.KeyID, err)
+		resp.Error = err.Error()
+	}
+	resp.KeyIDs = enc.keys.IDs()
+	enc.reply(msg, env, resp)
+}
+
+// applyKeyOp changes the keyring and persists it. used is the key the
+// request was encrypted with.
+func applyKeyOp(keys *security.Keyring, used security.Key, req *protocol.KeyRequest, keyringFile string) error {
+	if keys.Empty() {
+		// Unencrypted agents must not let anyone on the bus switch on encryption
+		return fmt.Errorf("encryption is not enabled on this agent")
+	}
+
+	switch req.Op {
+	case protocol.KeyOpList:
+		return nil
+
+	case protocol.KeyOpAdd:
+		if req.KeyID == "" || req.Secret == "" {
+			return fmt.Errorf("key id and secret are required")
+		}
+		if _, exists := keys.Get(req.KeyID); exists {
+			return fmt.Errorf("key %s already exists", req.KeyID)
+		}
+		keys.Add(security.Key{ID: req.KeyID, Secret: req.Secret})
+		if err := keys.Save(keyringFile); err != nil {
+			keys.Remove(req.KeyID)
+			return fmt.Errorf("save keyring: %w", err)
+		}
+		log.Printf("🔑 Added key %s", req.KeyID)
+
+	case protocol.KeyOpRetire:
+		if req.KeyID == used.ID {
+			return fmt.Errorf("cannot retire the key used for this request")
+		}
+		old, ok := keys.Get(req.KeyID)
+		if !ok {
+			return fmt.Errorf("unknown key %q", req.KeyID)
+		}
+		keys.Remove(req.KeyID)
+		if err := keys.Save(keyringFile); err != nil {
+			keys.Add(old)
+			return fmt.Errorf("save keyring: %w", err)
+		}
+		log.Printf("🔑 Retired key %s", old.Name())
+
+	default:
+		return fmt.Errorf("unknown key operation %q", req.Op)
+	}
+	return nil
+}
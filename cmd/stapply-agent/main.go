@@ -3,9 +3,9 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -22,6 +22,7 @@ import (
 	"github.com/drax2gma/stapply/internal/security"
 	"github.com/drax2gma/stapply/internal/sysinfo"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 var Version = "0.1.0-dev"
@@ -91,6 +92,15 @@ func main() {
 		opts = append(opts, nats.UserCredentials(cfg.NatsCreds))
 	}
 
+	tlsOpts, err := cfg.TLS.Options()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	if cfg.TLS.Enabled() {
+		log.Printf("🔒 TLS enabled (client certificate: %v)", cfg.TLS.CertFile != "")
+	}
+	opts = append(opts, tlsOpts...)
+
 	nc, err := nats.Connect(natsURL, opts...)
 	if err != nil {
 		log.Fatalf("Failed to connect to NATS: %v", err)
@@ -101,37 +111,163 @@ func main() {
 
 	// Initialize action registry
 	registry := actions.NewRegistry()
+	if cfg.Policy != nil {
+		registry.SetPolicy(cfg.Policy)
+		log.Printf("🛡️  Action policy enabled")
+	}
+
+	// Partial artifact transfers are staged on disk so they survive restarts
+	artifacts := &actions.DeployArtifactAction{Dir: cfg.ArtifactDir}
+	registry.Register("deploy_artifact", artifacts)
+	if cfg.PartialMaxAge > 0 || cfg.CacheMaxAge > 0 {
+		go reapArtifactsLoop(artifacts, cfg.PartialMaxAge, cfg.CacheMaxAge)
+	}
+
+	// Artifacts fanned out by the controller are pulled from the JetStream object store
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Fatalf("Failed to set up JetStream: %v", err)
+	}
+	registry.Register("fetch_artifact", &actions.FetchArtifactAction{
+		Artifacts: artifacts,
+		Open: func(ctx context.Context, bucket, name string) (io.ReadCloser, error) {
+			store, err := js.ObjectStore(ctx, bucket)
+			if err != nil {
+				return nil, err
+			}
+			return store.Get(ctx, name)
+		},
+	})
+
+	// Load accepted encryption keys
+	keys, err := loadKeyring(cfg.KeyringFile)
+	if err != nil {
+		log.Fatalf("Failed to load keyring: %v", err)
+	}
+	if cfg.AllowLegacyCrypto && !keys.Empty() {
+		keys.SetAllowLegacy(true)
+		log.Printf("⚠️  allow_legacy_crypto is set: accepting the legacy ciphertext format")
+	}
+	// Load (or create on first start) the key responses are signed with
+	identity, created, err := security.LoadOrCreateIdentity(cfg.IdentityFile)
+	if err != nil {
+		log.Fatalf("Failed to load identity key: %v", err)
+	}
+	identityPub, _ := identity.PublicKey()
+	if created {
+		log.Printf("🪪 Generated agent identity %s", cfg.IdentityFile)
+	}
+	log.Printf("🪪 Agent identity fingerprint: %s", security.Fingerprint(identityPub))
+
+	enc := &codec{
+		agentID:  cfg.AgentID,
+		keys:     keys,
+		replay:   security.NewReplayGuard(cfg.ClockSkew),
+		trusted:  make(map[string]bool),
+		identity: identity,
 
-	// Get secret key from environment
-	secretKey := os.Getenv("STAPPLY_SHARED_KEY")
-	if secretKey != "" {
-		log.Printf("Encryption enabled (key provided via STAPPLY_SHARED_KEY)")
+		allowLegacy: cfg.AllowLegacyCrypto,
+		maxPayload:  int(nc.MaxPayload()),
+	}
+	for _, pub := range cfg.TrustedControllers {
+		enc.trusted[pub] = true
+	}
+	if len(enc.trusted) == 0 {
+		log.Printf("⚠️  No trusted_controllers configured: unsigned requests are accepted")
+	} else {
+		log.Printf("🔏 Accepting requests signed by %d trusted controller(s)", len(enc.trusted))
+	}
+
+	if err := protocol.SetSubjectPrefix(cfg.SubjectPrefix); err != nil {
+		log.Fatalf("Invalid subject_prefix: %v", err)
 	}
 
 	// Subscribe to ping requests
-	pingSubject := "stapply.ping." + cfg.AgentID
+	pingSubject := protocol.RequestTypePing.Subject(cfg.AgentID)
 	_, err = nc.Subscribe(pingSubject, func(msg *nats.Msg) {
-		handlePing(msg, cfg.AgentID, secretKey)
+		handlePing(msg, enc, registry, cfg.WorkQueue)
 	})
 	if err != nil {
 		log.Fatalf("Failed to subscribe to %s: %v", pingSubject, err)
 	}
 	log.Printf("Subscribed to %s", pingSubject)
 
+	// Track run requests so results can be polled after the fact. Replies
+	// carry two output streams, so each starts out with at most a quarter of
+	// the server's max payload; the codec cuts them further if escaping makes
+	// the encoded reply too large anyway
+	jobs := newJobStore(cfg.JobRetention, int(nc.MaxPayload()/4))
+	go jobs.reapLoop()
+
 	// Subscribe to run requests
-	runSubject := "stapply.run." + cfg.AgentID
+	runSubject := protocol.RequestTypeRun.Subject(cfg.AgentID)
 	_, err = nc.Subscribe(runSubject, func(msg *nats.Msg) {
-		handleRun(msg, registry, secretKey)
+		handleRun(msg, nc, enc, registry, jobs)
 	})
 	if err != nil {
 		log.Fatalf("Failed to subscribe to %s: %v", runSubject, err)
 	}
 	log.Printf("Subscribed to %s", runSubject)
 
+	// Run requests queued in JetStream, e.g. while the agent was offline
+	if cfg.WorkQueue {
+		go consumeQueue(js, nc, enc, registry, jobs)
+	} else {
+		log.Printf("Work queue disabled (set work_queue=true to run queued requests)")
+	}
+
+	// Subscribe to job queries
+	jobStatusSubject := protocol.RequestTypeJobStatus.Subject(cfg.AgentID)
+	_, err = nc.Subscribe(jobStatusSubject, func(msg *nats.Msg) {
+		handleJobStatus(msg, enc, jobs)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", jobStatusSubject, err)
+	}
+	log.Printf("Subscribed to %s", jobStatusSubject)
+
+	jobResultSubject := protocol.RequestTypeJobResult.Subject(cfg.AgentID)
+	_, err = nc.Subscribe(jobResultSubject, func(msg *nats.Msg) {
+		handleJobResult(msg, enc, jobs)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", jobResultSubject, err)
+	}
+	log.Printf("Subscribed to %s", jobResultSubject)
+
+	jobOutputSubject := protocol.RequestTypeJobOutput.Subject(cfg.AgentID)
+	_, err = nc.Subscribe(jobOutputSubject, func(msg *nats.Msg) {
+		handleJobOutput(msg, enc, jobs)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", jobOutputSubject, err)
+	}
+	log.Printf("Subscribed to %s", jobOutputSubject)
+
+	// Subscribe to cancel requests
+	cancelSubject := protocol.RequestTypeCancel.Subject(cfg.AgentID)
+	_, err = nc.Subscribe(cancelSubject, func(msg *nats.Msg) {
+		handleCancel(msg, enc, jobs)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", cancelSubject, err)
+	}
+	log.Printf("Subscribed to %s", cancelSubject)
+
+	// Subscribe to keyring requests
+	keySubject := protocol.RequestTypeKey.Subject(cfg.AgentID)
+	_, err = nc.Subscribe(keySubject, func(msg *nats.Msg) {
+		handleKey(msg, enc, cfg.KeyringFile)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", keySubject, err)
+	}
+	log.Printf("Subscribed to %s", keySubject)
+
 	// Subscribe to update requests
-	updateSubject := "stapply.update." + cfg.AgentID
+	updateSubject := protocol.RequestTypeUpdate.Subject(cfg.AgentID)
 	_, err = nc.Subscribe(updateSubject, func(msg *nats.Msg) {
-		handleUpdate(msg, cfg.AgentID, nc, secretKey)
+		handleUpdate(msg, enc, nc)
 	})
 	if err != nil {
 		log.Fatalf("Failed to subscribe to %s: %v", updateSubject, err)
@@ -139,9 +275,9 @@ func main() {
 	log.Printf("Subscribed to %s", updateSubject)
 
 	// Subscribe to discovery requests
-	discoverSubject := "stapply.discover." + cfg.AgentID
+	discoverSubject := protocol.RequestTypeDiscover.Subject(cfg.AgentID)
 	_, err = nc.Subscribe(discoverSubject, func(msg *nats.Msg) {
-		handleDiscover(msg, cfg.AgentID, secretKey)
+		handleDiscover(msg, enc)
 	})
 	if err != nil {
 		log.Fatalf("Failed to subscribe to %s: %v", discoverSubject, err)
@@ -151,6 +287,13 @@ func main() {
 
 	log.Printf("Subscribed to %s", discoverSubject)
 
+	// Announce presence periodically
+	if cfg.HeartbeatInterval > 0 {
+		go heartbeatLoop(nc, enc, cfg.HeartbeatInterval)
+		log.Printf("Publishing heartbeats on %s every %s",
+			protocol.RequestTypeHeartbeat.Subject(cfg.AgentID), cfg.HeartbeatInterval)
+	}
+
 	// Wait for shutdown signal
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -172,19 +315,10 @@ func main() {
 	log.Println("Agent stopped")
 }
 
-func handlePing(msg *nats.Msg, agentID, secretKey string) {
-	data := msg.Data
-	if secretKey != "" {
-		var err error
-		data, err = security.Decrypt(msg.Data, secretKey)
-		if err != nil {
-			log.Printf("Failed to decrypt ping request: %v", err)
-			return
-		}
-	}
-
+func handlePing(msg *nats.Msg, enc *codec, registry *actions.Registry, workQueue bool) {
 	var req protocol.PingRequest
-	if err := json.Unmarshal(data, &req); err != nil {
+	env, err := enc.decode(msg, protocol.RequestTypePing, &req)
+	if err != nil {
 		log.Printf("Invalid ping request: %v", err)
 		return
 	}
@@ -193,130 +327,215 @@ func handlePing(msg *nats.Msg, agentID, secretKey string) {
 	if req.ControllerVersion != "" && req.ControllerVersion != Version {
 		log.Printf("⚠️  Version mismatch: agent=%s, controller=%s", Version, req.ControllerVersion)
 		if req.ControllerVersion > Version {
-			log.Printf("⚠️  Agent is outdated. Run 'stapply-ctl update %s' to update.", agentID)
+			log.Printf("⚠️  Agent is outdated. Run 'stapply-ctl update %s' to update.", enc.agentID)
 		}
 	}
 
-	cpuMutex.Lock()
-	cpu := cpuUsage
-	cpuMutex.Unlock()
-
-	mem := getMemoryUsagePercentage()
+	cpu, mem := currentLoad()
 
 	resp := protocol.NewPingResponse(
 		req.RequestID,
-		agentID,
+		enc.agentID,
 		Version,
 		int64(time.Since(startTime).Seconds()),
 		cpu,
 		mem,
 	)
+	resp.Capabilities = agentCapabilities(registry, workQueue)
 
-	respData, err := json.Marshal(resp)
+	enc.reply(msg, env, resp)
+}
+
+// agentCapabilities describes what this agent build supports. The work
+// queue is only announced when the agent consumes it.
+func agentCapabilities(registry *actions.Registry, workQueue bool) *protocol.Capabilities {
+	caps := &protocol.Capabilities{
+		Actions:   registry.Names(),
+		Encodings: []string{protocol.EncodingJSON},
+		Features: []string{
+			protocol.FeatureStream,
+			protocol.FeatureJobs,
+			protocol.FeatureCancel,
+			protocol.FeatureKeys,
+			protocol.FeatureOutput,
+			protocol.FeatureArtifactOffsets,
+			protocol.FeatureArtifactResume,
+			protocol.FeatureArtifactCache,
+			protocol.FeatureArtifactReleases,
+			protocol.FeatureArtifactOwner,
+			protocol.FeatureIdempotent,
+		},
+		Compression: []string{protocol.CompressionZstd},
+	}
+	if workQueue {
+		caps.Features = append(caps.Features, protocol.FeatureQueue)
+	}
+	return caps
+}
+
+func handleRun(msg *nats.Msg, nc *nats.Conn, enc *codec, registry *actions.Registry, jobs *jobStore) {
+	var req protocol.RunRequest
+	env, err := enc.decode(msg, protocol.RequestTypeRun, &req)
 	if err != nil {
-		log.Printf("Failed to marshal ping response: %v", err)
+		log.Printf("Invalid run request: %v", err)
+		return
+	}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected run request on %s: %v", msg.Subject, err)
+		enc.reply(msg, env, protocol.NewErrorResponse(req.RequestID, fmt.Errorf("unauthorized: %w", err), 0))
 		return
 	}
 
-	if secretKey != "" {
-		respData, err = security.Encrypt(respData, secretKey)
-		if err != nil {
-			log.Printf("Failed to encrypt ping response: %v", err)
-			return
-		}
+	if !jobs.start(req.RequestID, req.Action, req.OutputLimit) {
+		// A controller retrying after a lost reply: answer, don't run again
+		go replyRepeated(msg, enc, jobs, env, &req)
+		return
 	}
 
-	if err := msg.Respond(respData); err != nil {
-		log.Printf("Failed to send ping response: %v", err)
+	if req.Async {
+		// Acknowledge right away and let the controller poll for the result
+		log.Printf("Accepted job: %s (job_id=%s)", req.Action, req.RequestID)
+		enc.reply(msg, env, &protocol.JobAck{
+			RequestID: req.RequestID,
+			JobID:     req.RequestID,
+			AgentID:   enc.agentID,
+			State:     protocol.JobRunning,
+		})
+		go executeRun(nc, enc, registry, jobs, env, &req)
+		return
 	}
+
+	resp := executeRun(nc, enc, registry, jobs, env, &req)
+	enc.reply(msg, env, resp.WithOutputLimit(jobs.outputLimit(req.OutputLimit)))
 }
 
-func handleRun(msg *nats.Msg, registry *actions.Registry, secretKey string) {
-	data := msg.Data
-	if secretKey != "" {
-		var err error
-		data, err = security.Decrypt(msg.Data, secretKey)
-		if err != nil {
-			log.Printf("Failed to decrypt run request: %v", err)
-			return
-		}
-	}
+// replyRepeated answers a run request whose ID is already in the job store
+// with the outcome recorded for it, so a request the controller sends again
+// because the reply got lost runs only once.
+func replyRepeated(msg *nats.Msg, enc *codec, jobs *jobStore, env *envelope, req *protocol.RunRequest) {
+	enc.reply(msg, env, repeatedReply(jobs, enc.agentID, req))
+}
 
-	var req protocol.RunRequest
-	if err := json.Unmarshal(data, &req); err != nil {
-		log.Printf("Invalid run request: %v", err)
-		return
+// repeatedReply returns the reply to a repeated run request. A synchronous
+// request still running is waited for up to its own timeout.
+func repeatedReply(jobs *jobStore, agentID string, req *protocol.RunRequest) interface{} {
+	ji, ok := jobs.get(req.RequestID)
+	if ok && ji.Action != req.Action {
+		log.Printf("⚠️  Run request for %s reuses request_id %s of a %s job", req.Action, req.RequestID, ji.Action)
+		return protocol.NewErrorResponse(req.RequestID,
+			fmt.Errorf("request_id %s was already used for action %s", req.RequestID, ji.Action), 0)
+	}
+	if ok && ji.Result == nil && !req.Async {
+		ji, ok = jobs.wait(req.RequestID, time.Duration(req.TimeoutMs)*time.Millisecond)
+	}
+	if !ok {
+		// Reaped since it was started
+		return protocol.NewErrorResponse(req.RequestID, fmt.Errorf("unknown job: %s", req.RequestID), 0)
+	}
+	log.Printf("Answering repeated run request (request_id=%s) with its recorded result", req.RequestID)
+
+	switch {
+	case req.Async:
+		return &protocol.JobAck{
+			RequestID: req.RequestID,
+			JobID:     req.RequestID,
+			AgentID:   agentID,
+			State:     ji.State,
+		}
+	case ji.Result == nil:
+		return protocol.NewErrorResponse(req.RequestID,
+			fmt.Errorf("still running as job %s; see 'stapply-ctl job wait %s %s'", ji.JobID, agentID, ji.JobID), 0)
+	default:
+		return ji.Result
 	}
+}
 
+// executeRun runs a request's action and records the result in the job store.
+func executeRun(nc *nats.Conn, enc *codec, registry *actions.Registry, jobs *jobStore, env *envelope, req *protocol.RunRequest) *protocol.RunResponse {
 	log.Printf("Executing action: %s (request_id=%s)", req.Action, req.RequestID)
 
-	resp := registry.Execute(req.RequestID, req.Action, req.Args, req.DryRun)
-
-	respData, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("Failed to marshal run response: %v", err)
-		return
+	// Bound execution by the controller's deadline so a hung command
+	// cannot block the handler forever, and allow remote cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if req.TimeoutMs > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutMs)*time.Millisecond)
+		defer cancel()
 	}
+	jobs.setCancel(req.RequestID, cancel)
 
-	if secretKey != "" {
-		respData, err = security.Encrypt(respData, secretKey)
-		if err != nil {
-			log.Printf("Failed to encrypt run response: %v", err)
-			return
-		}
+	// Publish output live if the controller is listening for it
+	if req.Stream {
+		ctx = actions.WithOutput(ctx, newStreamPublisher(nc, enc, env, req.RequestID))
 	}
 
-	if err := msg.Respond(respData); err != nil {
-		log.Printf("Failed to send run response: %v", err)
+	resp := registry.Execute(ctx, req.RequestID, req.Action, req.Args, req.DryRun)
+	jobs.finish(req.RequestID, resp)
+	if resp.Status == protocol.StatusDenied {
+		log.Printf("⛔ Request %s refused: %s", req.RequestID, resp.Error)
 	}
 
 	log.Printf("Action %s completed: status=%s changed=%v duration=%dms",
 		req.Action, resp.Status, resp.Changed, resp.DurationMs)
+	return resp
 }
 
-func handleDiscover(msg *nats.Msg, agentID, secretKey string) {
-	data := msg.Data
-	if secretKey != "" {
-		var err error
-		data, err = security.Decrypt(msg.Data, secretKey)
-		if err != nil {
-			log.Printf("Failed to decrypt discover request: %v", err)
-			return
+// reapArtifactsLoop periodically removes artifact transfers idle for
+// partialMaxAge and cached artifacts older than cacheMaxAge (0 = keep).
+func reapArtifactsLoop(artifacts *actions.DeployArtifactAction, partialMaxAge, cacheMaxAge time.Duration) {
+	shortest := partialMaxAge
+	if shortest == 0 || (cacheMaxAge > 0 && cacheMaxAge < shortest) {
+		shortest = cacheMaxAge
+	}
+	interval := min(max(shortest/10, time.Minute), time.Hour)
+	for {
+		if partialMaxAge > 0 {
+			n, err := artifacts.RemoveStale(partialMaxAge)
+			if err != nil {
+				log.Printf("Failed to remove stale artifact transfers: %v", err)
+			} else if n > 0 {
+				log.Printf("Removed %d stale partial artifact transfer(s) from %s", n, artifacts.Dir)
+			}
 		}
+		if cacheMaxAge > 0 {
+			n, err := artifacts.PruneCache(cacheMaxAge)
+			if err != nil {
+				log.Printf("Failed to prune artifact cache: %v", err)
+			} else if n > 0 {
+				log.Printf("Removed %d expired artifact(s) from the cache", n)
+			}
+		}
+		time.Sleep(interval)
 	}
+}
 
+func handleDiscover(msg *nats.Msg, enc *codec) {
 	var req protocol.DiscoverRequest
-	if err := json.Unmarshal(data, &req); err != nil {
+	env, err := enc.decode(msg, protocol.RequestTypeDiscover, &req)
+	if err != nil {
 		log.Printf("Invalid discover request: %v", err)
 		return
 	}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected discover request on %s: %v", msg.Subject, err)
+		enc.reply(msg, env, &protocol.DiscoverResponse{
+			RequestID: req.RequestID,
+			AgentID:   enc.agentID,
+			Error:     "unauthorized: " + err.Error(),
+		})
+		return
+	}
 
 	log.Printf("Discovery request received (request_id=%s)", req.RequestID)
 
-	resp, err := sysinfo.GatherFacts(agentID)
+	resp, err := sysinfo.GatherFacts(enc.agentID)
 	if err != nil {
 		log.Printf("Failed to gather system facts: %v", err)
 		return
 	}
 	resp.RequestID = req.RequestID
 
-	respData, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("Failed to marshal discover response: %v", err)
-		return
-	}
-
-	if secretKey != "" {
-		respData, err = security.Encrypt(respData, secretKey)
-		if err != nil {
-			log.Printf("Failed to encrypt discover response: %v", err)
-			return
-		}
-	}
-
-	if err := msg.Respond(respData); err != nil {
-		log.Printf("Failed to send discover response: %v", err)
-	}
+	enc.reply(msg, env, resp)
 }
 
 func monitorCPU() {
@@ -342,6 +561,15 @@ func monitorCPU() {
 	}
 }
 
+// currentLoad returns the latest CPU and memory usage percentages.
+func currentLoad() (cpu, mem float64) {
+	cpuMutex.Lock()
+	cpu = cpuUsage
+	cpuMutex.Unlock()
+
+	return cpu, getMemoryUsagePercentage()
+}
+
 func getCPUSample() (idle, total uint64) {
 	contents, err := os.ReadFile("/proc/stat")
 	if err != nil {
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/actions"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/queue"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// queueRetry is how long the agent waits before attaching to its work queue
+// again after a failure, e.g. while NATS is unreachable.
+const queueRetry = 30 * time.Second
+
+// consumeQueue runs the requests queued for this agent in JetStream (see
+// 'stapply-ctl run -queued'), one at a time and in order, and publishes
+// their results. Requests queued while the agent was offline are picked up
+// once it connects. Failures are retried forever and logged when they change.
+func consumeQueue(js jetstream.JetStream, nc *nats.Conn, enc *codec, registry *actions.Registry, jobs *jobStore) {
+	lastErr := ""
+	for {
+		attached, err := readQueue(js, nc, enc, registry, jobs)
+		if attached {
+			lastErr = ""
+		}
+		if msg := err.Error(); msg != lastErr {
+			log.Printf("Work queue unavailable (retrying every %s): %v", queueRetry, err)
+			lastErr = msg
+		}
+		time.Sleep(queueRetry)
+	}
+}
+
+// readQueue attaches to the agent's durable consumer and handles queued
+// requests until an error occurs. It reports whether it got attached. The
+// streams and the consumer are created by the controller when it first
+// queues a run for the agent (see queue.Ensure); until then this fails.
+func readQueue(js jetstream.JetStream, nc *nats.Conn, enc *codec, registry *actions.Registry, jobs *jobStore) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cons, err := js.Consumer(ctx, queue.WorkStream(), queue.ConsumerName(enc.agentID))
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Consuming work queue %s", protocol.RequestTypeQueue.Subject(enc.agentID))
+
+	for {
+		batch, err := cons.Fetch(1, jetstream.FetchMaxWait(30*time.Second))
+		if err != nil {
+			return true, err
+		}
+		for msg := range batch.Messages() {
+			handleQueued(msg, js, nc, enc, registry, jobs)
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return true, err
+		}
+	}
+}
+
+// handleQueued runs one queued request, publishes its result and only then
+// acknowledges it, so a request is never lost; one interrupted by a restart
+// of the agent runs again.
+func handleQueued(msg jetstream.Msg, js jetstream.JetStream, nc *nats.Conn, enc *codec, registry *actions.Registry, jobs *jobStore) {
+	var qr protocol.QueuedRequest
+	env, err := enc.decodeQueued(msg, &qr)
+	if err == nil && qr.Run == nil {
+		err = fmt.Errorf("queued request carries no run request")
+	}
+	if err == nil {
+		err = protocol.CheckRunID(qr.RunID)
+	}
+	if err != nil {
+		// It will never decode, so don't let it block the queue
+		log.Printf("Dropping invalid queued request: %v", err)
+		msg.Term()
+		return
+	}
+
+	result := &protocol.QueuedResult{
+		RunID:   qr.RunID,
+		Host:    qr.Host,
+		AgentID: enc.agentID,
+		App:     qr.App,
+		Step:    qr.Step,
+		Steps:   qr.Steps,
+		Action:  qr.Run.Action,
+	}
+	req := qr.Run
+	req.Stream, req.Async = false, false
+
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected queued request on %s: %v", msg.Subject(), err)
+		result.Result = protocol.NewErrorResponse(req.RequestID, fmt.Errorf("unauthorized: %w", err), 0)
+	} else if !jobs.start(req.RequestID, req.Action, req.OutputLimit) {
+		log.Printf("Ignoring duplicate queued request (request_id=%s)", req.RequestID)
+		msg.Ack()
+		return
+	} else {
+		log.Printf("Running queued step %d/%d of run %s", qr.Step, qr.Steps, qr.RunID)
+		stop := keepInProgress(msg)
+		resp := executeRun(nc, enc, registry, jobs, env, req)
+		stop()
+		result.Result = resp.WithOutputLimit(jobs.outputLimit(req.OutputLimit))
+	}
+
+	publishResult(js, enc, env, result)
+	if err := msg.Ack(); err != nil {
+		log.Printf("Failed to acknowledge queued request %s: %v", req.RequestID, err)
+	}
+}
+
+// keepInProgress stops JetStream from redelivering msg while it is being
+// handled, until the returned function is called.
+func keepInProgress(msg jetstream.Msg) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(queue.AckWait / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.InProgress()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// publishResult stores the result of a queued request in the result stream,
+// retrying until JetStream confirms it. Retries reuse the request's message
+// ID, so a result whose confirmation was lost is not stored twice.
+func publishResult(js jetstream.JetStream, enc *codec, req *envelope, result *protocol.QueuedResult) {
+	data, err := enc.encodeReply(protocol.RequestTypeQueue.Reply(), result, req)
+	if err != nil {
+		log.Printf("Failed to encode result of run %s: %v", result.RunID, err)
+		return
+	}
+	subject := protocol.ResultSubject(result.RunID, enc.agentID)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := js.Publish(ctx, subject, data, jetstream.WithMsgID(req.MessageID))
+		cancel()
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to publish result of run %s (retrying): %v", result.RunID, err)
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/drax2gma/stapply/internal/actions"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// newStreamPublisher returns an OutputFunc that publishes each output line
+// of a run request to its stream subject with increasing sequence numbers.
+// Lines are encoded like replies to env.
+func newStreamPublisher(nc *nats.Conn, enc *codec, env *envelope, requestID string) actions.OutputFunc {
+	var mu sync.Mutex
+	var seq uint64
+	subject := protocol.StreamSubject(requestID)
+
+	return func(stream, line string) {
+		// Serialize so sequence numbers match publish order
+		mu.Lock()
+		defer mu.Unlock()
+
+		seq++
+		data, err := enc.encode(protocol.RequestTypeStream, &protocol.StreamMessage{
+			RequestID: requestID,
+			Seq:       seq,
+			Stream:    stream,
+			Line:      line,
+		}, env)
+		if err != nil {
+			log.Printf("Failed to encode stream message: %v", err)
+			return
+		}
+
+		if err := nc.Publish(subject, data); err != nil {
+			log.Printf("Failed to publish stream message: %v", err)
+		}
+	}
+}
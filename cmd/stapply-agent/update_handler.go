@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -11,26 +10,25 @@ import (
 	"syscall"
 
 	"github.com/drax2gma/stapply/internal/protocol"
-	"github.com/drax2gma/stapply/internal/security"
 	"github.com/nats-io/nats.go"
 )
 
-func handleUpdate(msg *nats.Msg, agentID string, nc *nats.Conn, secretKey string) {
-	data := msg.Data
-	if secretKey != "" {
-		var err error
-		data, err = security.Decrypt(msg.Data, secretKey)
-		if err != nil {
-			log.Printf("Failed to decrypt update request: %v", err)
-			return
-		}
-	}
-
+func handleUpdate(msg *nats.Msg, enc *codec, nc *nats.Conn) {
 	var req protocol.UpdateRequest
-	if err := json.Unmarshal(data, &req); err != nil {
+	env, err := enc.decode(msg, protocol.RequestTypeUpdate, &req)
+	if err != nil {
 		log.Printf("Invalid update request: %v", err)
 		return
 	}
+	if err := enc.authorize(env); err != nil {
+		log.Printf("⛔ Rejected update request on %s: %v", msg.Subject, err)
+		enc.reply(msg, env, &protocol.UpdateResponse{
+			RequestID: req.RequestID,
+			Success:   false,
+			Error:     "unauthorized: " + err.Error(),
+		})
+		return
+	}
 
 	log.Printf("🔄 Update requested: %s -> %s", Version, req.TargetVersion)
 
@@ -41,7 +39,7 @@ func handleUpdate(msg *nats.Msg, agentID string, nc *nats.Conn, secretKey string
 			Success:   true,
 			Message:   "Agent already at target version",
 		}
-		sendUpdateResponse(msg, resp, secretKey)
+		enc.reply(msg, env, resp)
 		return
 	}
 
@@ -67,7 +65,7 @@ func handleUpdate(msg *nats.Msg, agentID string, nc *nats.Conn, secretKey string
 			Success:   false,
 			Error:     fmt.Sprintf("download failed: %v", err),
 		}
-		sendUpdateResponse(msg, resp, secretKey)
+		enc.reply(msg, env, resp)
 		return
 	}
 
@@ -80,7 +78,7 @@ func handleUpdate(msg *nats.Msg, agentID string, nc *nats.Conn, secretKey string
 			Success:   false,
 			Error:     fmt.Sprintf("chmod failed: %v", err),
 		}
-		sendUpdateResponse(msg, resp, secretKey)
+		enc.reply(msg, env, resp)
 		return
 	}
 
@@ -93,7 +91,7 @@ func handleUpdate(msg *nats.Msg, agentID string, nc *nats.Conn, secretKey string
 			Success:   false,
 			Error:     fmt.Sprintf("replace failed: %v", err),
 		}
-		sendUpdateResponse(msg, resp, secretKey)
+		enc.reply(msg, env, resp)
 		return
 	}
 
@@ -103,7 +101,7 @@ func handleUpdate(msg *nats.Msg, agentID string, nc *nats.Conn, secretKey string
 		Success:   true,
 		Message:   fmt.Sprintf("Updated to %s, restarting...", req.TargetVersion),
 	}
-	sendUpdateResponse(msg, resp, secretKey)
+	enc.reply(msg, env, resp)
 
 	log.Printf("✅ Binary replaced")
 
@@ -132,26 +130,6 @@ func handleUpdate(msg *nats.Msg, agentID string, nc *nats.Conn, secretKey string
 	}
 }
 
-func sendUpdateResponse(msg *nats.Msg, resp *protocol.UpdateResponse, secretKey string) {
-	data, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("Failed to marshal update response: %v", err)
-		return
-	}
-
-	if secretKey != "" {
-		data, err = security.Encrypt(data, secretKey)
-		if err != nil {
-			log.Printf("Failed to encrypt update response: %v", err)
-			return
-		}
-	}
-
-	if err := msg.Respond(data); err != nil {
-		log.Printf("Failed to send update response: %v", err)
-	}
-}
-
 func downloadBinary(url, destPath string) error {
 	out, err := os.Create(destPath)
 	if err != nil {
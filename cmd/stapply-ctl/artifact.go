@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+// artifactWindow is how many artifact chunks are in flight at once. Agents
+// handle requests one at a time, so the window only hides the round trips
+// between chunks; it does not make the agent write several at once.
+const artifactWindow = 4
+
+// artifactOverhead is reserved in every chunk request for the run request,
+// envelope, signature and encryption header wrapped around the chunk data.
+const artifactOverhead = 8 * 1024
+
+// artifactChunkSize returns the largest chunk, in whole KiB, whose request
+// still fits the server's max_payload once base64-encoded and wrapped.
+func artifactChunkSize(maxPayload int64) int {
+	size := (maxPayload - artifactOverhead) / 4 * 3
+	return int(max(size, 4*1024)) &^ (1024 - 1)
+}
+
+// artifactDefaultMode is the mode artifacts are installed with unless the
+// step sets one; they are usually binaries.
+const artifactDefaultMode = "0755"
+
+// artifactSpec is a deploy_artifact step.
+type artifactSpec struct {
+	src      string
+	dest     string
+	mode     string // Octal file mode
+	owner    string // "user:group", empty to leave ownership alone
+	releases int    // Keep this many releases under dest with a current link (0 = plain file)
+}
+
+// parseArtifactSpec reads a step's "src=... dest=... [mode=0755]
+// [owner=user:group] [releases=N]" arguments.
+func parseArtifactSpec(args map[string]string) (*artifactSpec, error) {
+	spec := &artifactSpec{src: args["src"], dest: args["dest"], mode: args["mode"], owner: args["owner"]}
+	if spec.src == "" || spec.dest == "" {
+		return nil, fmt.Errorf("src and dest are required")
+	}
+	if spec.mode == "" {
+		spec.mode = artifactDefaultMode
+	} else if m, err := strconv.ParseUint(spec.mode, 8, 32); err != nil || m > 07777 {
+		return nil, fmt.Errorf("invalid mode %q", spec.mode)
+	}
+	if spec.owner != "" && !strings.Contains(spec.owner, ":") {
+		return nil, fmt.Errorf("invalid owner %q (expected user:group)", spec.owner)
+	}
+	if v := args["releases"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid releases %q", v)
+		}
+		spec.releases = n
+	}
+	return spec, nil
+}
+
+// artifactStepPrefix marks a cmd step that is really a deploy_artifact, the
+// way artifacts were deployed before the step existed.
+const artifactStepPrefix = "STAPPLY_ACTION: deploy_artifact"
+
+// artifactStepArgs returns the deploy_artifact arguments of a step and
+// whether it is one, either a deploy_artifact step or a cmd step starting
+// with artifactStepPrefix.
+func artifactStepArgs(action string, args map[string]string) (map[string]string, bool) {
+	switch {
+	case action == "deploy_artifact":
+		return args, true
+	case action == "cmd" && strings.HasPrefix(args["command"], artifactStepPrefix):
+		return parseKVString(strings.TrimPrefix(args["command"], artifactStepPrefix)), true
+	}
+	return nil, false
+}
+
+// checkArtifactSrc verifies that src is a readable regular file.
+func checkArtifactSrc(src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("src: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("src: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("src %s is not a regular file", src)
+	}
+	return nil
+}
+
+// runDeployArtifact copies spec.src to spec.dest on the agent in chunks sized to the
+// server's max_payload, keeping up to artifactWindow chunks in flight. An
+// empty file is sent as one empty chunk.
+// Agents without FeatureArtifactOffsets get one chunk at a time, in order;
+// agents with FeatureArtifactResume are only sent the chunks they lack, and
+// chunks are compressed for agents that support it. Agents with
+// FeatureArtifactCache are asked first whether they already have the
+// content, in which case nothing is sent. Each request is retried as retry
+// allows. It reports whether dest changed.
+func runDeployArtifact(client *agentClient, spec *artifactSpec, timeout time.Duration, retry retryPolicy) (bool, error) {
+	// 1. Open local file
+	f, err := os.Open(spec.src)
+	if err != nil {
+		return false, fmt.Errorf("open src: %v", err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat src: %v", err)
+	}
+	totalSize := stat.Size()
+
+	// 2. Calculate Checksum
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, fmt.Errorf("calc checksum: %v", err)
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+
+	if _, err := client.negotiate(timeout); err != nil {
+		return false, err
+	}
+	if spec.releases > 0 && !client.supports(protocol.FeatureArtifactReleases) {
+		return false, fmt.Errorf("agent %s does not support releases; run 'stapply-ctl update %s'", client.agentID, client.agentID)
+	}
+	if spec.owner != "" && !client.supports(protocol.FeatureArtifactOwner) {
+		return false, fmt.Errorf("agent %s does not support owner; run 'stapply-ctl update %s'", client.agentID, client.agentID)
+	}
+	window := 1
+	if client.supports(protocol.FeatureArtifactOffsets) {
+		window = artifactWindow
+	}
+	compression := client.compression()
+
+	// 3. Send chunks, reading each at its offset
+	chunkSize := int64(artifactChunkSize(client.nc.MaxPayload()))
+	totalChunks := chunkCount(totalSize, chunkSize)
+	baseArgs := map[string]string{
+		"dest":         spec.dest,
+		"total_chunks": fmt.Sprintf("%d", totalChunks),
+		"total_size":   fmt.Sprintf("%d", totalSize),
+		"chunk_size":   fmt.Sprintf("%d", chunkSize),
+		"checksum":     checksum,
+		"mode":         spec.mode,
+	}
+	if spec.owner != "" {
+		baseArgs["owner"] = spec.owner
+	}
+	if spec.releases > 0 {
+		baseArgs["releases"] = strconv.Itoa(spec.releases)
+	}
+
+	// Skip the upload if the agent already has the content
+	if client.supports(protocol.FeatureArtifactCache) {
+		answer, changed, err := artifactPresent(client, baseArgs, timeout, retry)
+		if err != nil {
+			return false, fmt.Errorf("check destination: %v", err)
+		}
+		switch answer {
+		case protocol.ArtifactPresent:
+			fmt.Printf("            Already present on the agent (sha256 %s), nothing sent\n", checksum[:12])
+			return changed, nil
+		case protocol.ArtifactRestored:
+			fmt.Printf("            Restored from an earlier release or the agent's cache (sha256 %s), nothing sent\n", checksum[:12])
+			return true, nil
+		}
+	}
+
+	pending := make([]int, totalChunks)
+	for i := range pending {
+		pending[i] = i
+	}
+	if client.supports(protocol.FeatureArtifactResume) {
+		missing, err := missingChunks(client, baseArgs, timeout, retry)
+		if err != nil {
+			return false, fmt.Errorf("query missing chunks: %v", err)
+		}
+		if len(missing) < totalChunks {
+			fmt.Printf("            Resuming: %d/%d chunks already on the agent\n", totalChunks-len(missing), totalChunks)
+		}
+		// With every chunk in place, resending the last one completes the transfer
+		if len(missing) == 0 {
+			missing = []int{totalChunks - 1}
+		}
+		pending = missing
+	}
+	var pendingSize int64
+	for _, i := range pending {
+		pendingSize += min(chunkSize, totalSize-int64(i)*chunkSize)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		sendErr   error
+		sent      int
+		sentBytes int64
+		wireBytes int64 // Chunk bytes after compression
+	)
+	slots := make(chan struct{}, window)
+	started := time.Now()
+
+	for _, i := range pending {
+		slots <- struct{}{}
+		mu.Lock()
+		failed := sendErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		offset := int64(i) * chunkSize
+		data := make([]byte, min(chunkSize, totalSize-offset))
+		if n, err := f.ReadAt(data, offset); n < len(data) {
+			mu.Lock()
+			sendErr = fmt.Errorf("read chunk %d: %v", i, err)
+			mu.Unlock()
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, offset int64, data []byte) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			args := map[string]string{
+				"chunk_index": fmt.Sprintf("%d", i),
+				"offset":      fmt.Sprintf("%d", offset),
+			}
+			payload := data
+			if compression != "" {
+				// Incompressible chunks are sent as they are
+				if packed, err := protocol.Compress(compression, data); err == nil && len(packed) < len(data) {
+					args["chunk_encoding"] = compression
+					payload = packed
+				}
+			}
+			args["chunk_data"] = base64.StdEncoding.EncodeToString(payload)
+			for k, v := range baseArgs {
+				args[k] = v
+			}
+
+			req := protocol.NewRunRequest("deploy_artifact", args, int(timeout/time.Millisecond), false)
+			var resp protocol.RunResponse
+			err := client.callRun(req, &resp, timeout+replyGrace, retry, "            ")
+			if err == nil && resp.Status != protocol.StatusOK {
+				err = fmt.Errorf("%s (stderr: %s)", resp.Error, resp.Stderr)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if sendErr == nil {
+					sendErr = fmt.Errorf("chunk %d: %v", i, err)
+				}
+				return
+			}
+			sent++
+			sentBytes += int64(len(data))
+			wireBytes += int64(len(payload))
+			fmt.Printf("            Sent chunk %d/%d (%d%%, %.1f MB/s)   \r",
+				sent, len(pending), sentBytes*100/max(pendingSize, 1), throughput(sentBytes, time.Since(started)))
+		}(i, offset, data)
+	}
+	wg.Wait()
+	fmt.Println() // Newline after progress
+
+	if sendErr != nil {
+		return false, sendErr
+	}
+	elapsed := time.Since(started)
+	fmt.Printf("            Sent %s in %s (%.1f MB/s, %d chunks of up to %s)\n",
+		formatBytes(pendingSize), elapsed.Round(time.Millisecond), throughput(pendingSize, elapsed),
+		len(pending), formatBytes(chunkSize))
+	if wireBytes < pendingSize {
+		fmt.Printf("            Compressed with %s to %s (%d%%)\n", compression, formatBytes(wireBytes), wireBytes*100/max(pendingSize, 1))
+	}
+	return true, nil
+}
+
+// chunkCount returns how many chunks of chunkSize carry size bytes. An empty
+// file still takes one chunk, since the agent installs the file on the last.
+func chunkCount(size, chunkSize int64) int {
+	return max(1, int((size+chunkSize-1)/chunkSize))
+}
+
+// artifactPresent asks the agent whether dest already has the content
+// described by args. It returns the agent's answer (protocol.ArtifactPresent,
+// ArtifactRestored or ArtifactAbsent) and whether dest was changed.
+func artifactPresent(client *agentClient, args map[string]string, timeout time.Duration, retry retryPolicy) (string, bool, error) {
+	query := map[string]string{"query": protocol.ArtifactQueryPresent}
+	for k, v := range args {
+		query[k] = v
+	}
+	req := protocol.NewRunRequest("deploy_artifact", query, int(timeout/time.Millisecond), false)
+	var resp protocol.RunResponse
+	if err := client.callRun(req, &resp, timeout+replyGrace, retry, "            "); err != nil {
+		return "", false, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return "", false, fmt.Errorf("%s", resp.Error)
+	}
+	return resp.Stdout, resp.Changed, nil
+}
+
+// missingChunks asks the agent which chunks of the transfer described by
+// args it still needs.
+func missingChunks(client *agentClient, args map[string]string, timeout time.Duration, retry retryPolicy) ([]int, error) {
+	query := map[string]string{"query": protocol.ArtifactQueryMissing}
+	for k, v := range args {
+		query[k] = v
+	}
+	req := protocol.NewRunRequest("deploy_artifact", query, int(timeout/time.Millisecond), false)
+	var resp protocol.RunResponse
+	if err := client.callRun(req, &resp, timeout+replyGrace, retry, "            "); err != nil {
+		return nil, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	if resp.MissingChunks != "" {
+		return protocol.ParseChunkList(resp.MissingChunks)
+	}
+	// Older agents only list them in Stdout
+	if resp.Truncated {
+		return nil, fmt.Errorf("agent %s truncated the list of missing chunks; run 'stapply-ctl update %s'", client.agentID, client.agentID)
+	}
+	return protocol.ParseChunkList(resp.Stdout)
+}
+
+// throughput returns n bytes over d in MB/s.
+func throughput(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / (1 << 20) / d.Seconds()
+}
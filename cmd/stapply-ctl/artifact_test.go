@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestChunkCount(t *testing.T) {
+	tests := []struct {
+		size, chunkSize int64
+		want            int
+	}{
+		{0, 100, 1}, // Empty files still send one chunk
+		{1, 100, 1},
+		{100, 100, 1},
+		{101, 100, 2},
+		{250, 100, 3},
+	}
+	for _, tt := range tests {
+		if got := chunkCount(tt.size, tt.chunkSize); got != tt.want {
+			t.Errorf("chunkCount(%d, %d) = %d, want %d", tt.size, tt.chunkSize, got, tt.want)
+		}
+	}
+}
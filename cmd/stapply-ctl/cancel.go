@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+// cancelTimeout bounds how long we wait for an agent to confirm a cancel.
+const cancelTimeout = 3 * time.Second
+
+// inflightRequest is a run request dispatched to an agent and not yet answered.
+type inflightRequest struct {
+	hostID string
+	client *agentClient
+}
+
+// canceller tracks in-flight run requests and, on the first SIGINT, asks
+// every agent to kill what it is still running. A second SIGINT exits at once.
+type canceller struct {
+	mu       sync.Mutex
+	inflight map[string]inflightRequest // request_id -> target
+	stopping atomic.Bool
+	sigCh    chan os.Signal
+}
+
+func newCanceller() *canceller {
+	c := &canceller{
+		inflight: make(map[string]inflightRequest),
+		sigCh:    make(chan os.Signal, 2),
+	}
+	signal.Notify(c.sigCh, syscall.SIGINT)
+	go c.watch()
+	return c
+}
+
+// track registers a dispatched request. The returned function must be
+// called once its response has arrived.
+func (c *canceller) track(requestID, hostID string, client *agentClient) func() {
+	c.mu.Lock()
+	c.inflight[requestID] = inflightRequest{hostID: hostID, client: client}
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		delete(c.inflight, requestID)
+		c.mu.Unlock()
+	}
+}
+
+// interrupted reports whether the user pressed Ctrl-C; callers should stop
+// dispatching new work.
+func (c *canceller) interrupted() bool {
+	return c.stopping.Load()
+}
+
+// stop restores default SIGINT handling.
+func (c *canceller) stop() {
+	signal.Stop(c.sigCh)
+}
+
+func (c *canceller) watch() {
+	for range c.sigCh {
+		if c.stopping.Swap(true) {
+			fmt.Fprintln(os.Stderr, "\n⛔ Interrupted again, exiting without waiting for agents")
+			os.Exit(130)
+		}
+
+		c.mu.Lock()
+		targets := make(map[string]inflightRequest, len(c.inflight))
+		for id, r := range c.inflight {
+			targets[id] = r
+		}
+		c.mu.Unlock()
+
+		fmt.Printf("\n⚠️  Interrupted: cancelling %d in-flight request(s) (Ctrl-C again to force exit)\n", len(targets))
+
+		var wg sync.WaitGroup
+		for id, r := range targets {
+			wg.Add(1)
+			go func(id string, r inflightRequest) {
+				defer wg.Done()
+				if !r.client.supports(protocol.FeatureCancel) {
+					fmt.Printf("   ⚠️  [%s] Agent does not support cancellation, request %s keeps running\n", r.hostID, id)
+					return
+				}
+
+				var resp protocol.CancelResponse
+				err := r.client.call(protocol.RequestTypeCancel, protocol.NewCancelRequest(id), &resp, cancelTimeout)
+				switch {
+				case err != nil:
+					fmt.Printf("   ❌ [%s] Cancel failed: %v\n", r.hostID, err)
+				case resp.Cancelled:
+					fmt.Printf("   🛑 [%s] Cancelled request %s\n", r.hostID, id)
+				default:
+					fmt.Printf("   ⚠️  [%s] %s\n", r.hostID, resp.Error)
+				}
+			}(id, r)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/config"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/security"
+	"github.com/nats-io/nats.go"
+)
+
+// agentSighting is the latest heartbeat received from an agent.
+type agentSighting struct {
+	hb       protocol.Heartbeat
+	lastSeen time.Time // When the agent sent hb, by its signed envelope (zero = none accepted)
+	impostor bool      // A heartbeat was signed by a key other than the one pinned in known_agents
+}
+
+// recordHeartbeat adds a decoded heartbeat to seen. It only counts as a
+// sighting if it is signed by the agent's pinned key (any key, for agents
+// never pinned), and its signed timestamp is within the clock skew of now
+// and newer than the agent's last heartbeat, so a replayed heartbeat cannot
+// keep a dead agent listed as alive. One signed by another key marks the
+// agent as an impostor instead.
+func recordHeartbeat(seen map[string]*agentSighting, env *protocol.Envelope, hb *protocol.Heartbeat, pinned func(agentID string) (string, bool), now time.Time) error {
+	// A heartbeat must come from the agent it describes, or an agent could
+	// pass itself off as another one
+	if hb.AgentID == "" || env.SenderID != hb.AgentID {
+		return fmt.Errorf("heartbeat on behalf of %q sent by %q", hb.AgentID, env.SenderID)
+	}
+	if env.Signer != "" {
+		if err := env.Verify(); err != nil {
+			return err
+		}
+	}
+
+	s := seen[hb.AgentID]
+	if s == nil {
+		s = &agentSighting{}
+	}
+	if key, ok := pinned(hb.AgentID); ok && key != env.Signer {
+		s.impostor = true
+		seen[hb.AgentID] = s
+		return nil
+	}
+
+	if env.Timestamp.IsZero() {
+		return fmt.Errorf("heartbeat of %s carries no timestamp", hb.AgentID)
+	}
+	if d := now.Sub(env.Timestamp); d > config.DefaultClockSkew || d < -config.DefaultClockSkew {
+		return fmt.Errorf("heartbeat of %s sent at %s, outside ±%s of local clock", hb.AgentID, env.Timestamp.Format(time.RFC3339), config.DefaultClockSkew)
+	}
+	if !env.Timestamp.After(s.lastSeen) {
+		return fmt.Errorf("heartbeat of %s is not newer than the last one", hb.AgentID)
+	}
+	s.hb, s.lastSeen = *hb, env.Timestamp
+	seen[hb.AgentID] = s
+	return nil
+}
+
+// stale reports whether the agent missed its next heartbeats: it was last
+// heard from more than twice its own heartbeat interval before now.
+func (s *agentSighting) stale(now time.Time) bool {
+	interval := time.Duration(s.hb.IntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = config.DefaultHeartbeatInterval
+	}
+	return now.Sub(s.lastSeen) > 2*interval
+}
+
+func cmdAgents(args []string) {
+	fs := flag.NewFlagSet("agents", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to configuration file (flags configured hosts that stay silent)")
+	envName := fs.String("e", "", "Only check hosts of this environment (requires -c)")
+	conn := connFlags(fs)
+	wait := fs.Duration("wait", 20*time.Second, "How long to listen for heartbeats")
+	fs.Parse(args)
+
+	// Keys heartbeats may be encrypted with
+	keys := security.NewKeyring()
+	if key := conn.key(); key != "" {
+		keys.Add(security.ParseKey(key))
+	}
+
+	// Configured hosts: agent_id -> host_id
+	expected := make(map[string]string)
+	if *configPath != "" {
+		if !strings.HasSuffix(*configPath, ".stay.ini") {
+			fmt.Fprintf(os.Stderr, "Error: config file must have .stay.ini extension: %s\n", *configPath)
+			os.Exit(1)
+		}
+		cfg, err := config.Parse(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to parse config: %v", err)
+		}
+
+		hostIDs := make([]string, 0, len(cfg.Hosts))
+		var env *config.Environment
+		if *envName != "" {
+			var ok bool
+			env, ok = cfg.Environments[*envName]
+			if !ok {
+				log.Fatalf("Environment not found: %s", *envName)
+			}
+			hostIDs = env.Hosts
+		} else {
+			for hostID := range cfg.Hosts {
+				hostIDs = append(hostIDs, hostID)
+			}
+		}
+
+		for _, hostID := range hostIDs {
+			agentID := hostID
+			if host, ok := cfg.Hosts[hostID]; ok && host.AgentID != "" {
+				agentID = host.AgentID
+			}
+			expected[agentID] = hostID
+
+			if conn.secretKey == "" {
+				if key, err := conn.hostKey(cfg, env, hostID); err == nil && key != "" {
+					keys.Add(security.ParseKey(key))
+				}
+			}
+		}
+	} else if *envName != "" {
+		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl agents [-c <config> [-e <env>]] [-wait 20s]")
+		os.Exit(1)
+	}
+
+	nc := conn.connect("nats://localhost:4222")
+	defer nc.Close()
+	keys.SetAllowLegacy(legacyCrypto)
+
+	known := knownAgents()
+	var mu sync.Mutex
+	seen := make(map[string]*agentSighting)
+	undecodable, rejected := 0, 0
+
+	sub, err := nc.Subscribe(protocol.HeartbeatSubjectWildcard(), func(msg *nats.Msg) {
+		data := msg.Data
+		if !keys.Empty() {
+			var err error
+			data, _, err = keys.Decrypt(data)
+			if err != nil {
+				mu.Lock()
+				undecodable++
+				mu.Unlock()
+				return
+			}
+		}
+
+		var hb protocol.Heartbeat
+		env, err := protocol.Unmarshal(data, &hb)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			undecodable++
+			return
+		}
+		if err := recordHeartbeat(seen, env, &hb, known.Pinned, time.Now()); err != nil {
+			rejected++
+		}
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to heartbeats: %v", err)
+	}
+
+	fmt.Printf("📡 Listening for agent heartbeats for %s...\n", *wait)
+	time.Sleep(*wait)
+	sub.Unsubscribe()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	ids := make([]string, 0, len(seen)+len(expected))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	for id := range expected {
+		if _, ok := seen[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	stale := 0
+	impostors := 0
+
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "AGENT\tHOST\tVERSION\tLAST SEEN\tUPTIME\tCPU\tMEM\tSTATE")
+	for _, id := range ids {
+		hostID := expected[id]
+		if hostID == "" {
+			hostID = "-"
+		}
+
+		s, ok := seen[id]
+		if s != nil && s.impostor {
+			impostors++
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\t-\t⛔ identity changed\n", id, hostID)
+			continue
+		}
+		if !ok {
+			stale++
+			fmt.Fprintf(tw, "%s\t%s\t-\tnever\t-\t-\t-\t⚠️  stale\n", id, hostID)
+			continue
+		}
+
+		state := "✅ alive"
+		if s.stale(now) {
+			stale++
+			state = "⚠️  stale"
+		} else if s.hb.Version != Version {
+			state = "⚠️  version mismatch"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s ago\t%s\t%.1f%%\t%.1f%%\t%s\n",
+			id, hostID, s.hb.Version,
+			now.Sub(s.lastSeen).Round(time.Second),
+			time.Duration(s.hb.UptimeSeconds)*time.Second,
+			s.hb.CPUUsage, s.hb.MemoryUsage, state)
+	}
+	tw.Flush()
+
+	fmt.Println()
+	fmt.Printf("Summary: seen=%d stale=%d\n", len(seen), stale)
+	if undecodable > 0 {
+		fmt.Printf("⚠️  Ignored %d heartbeat(s) that could not be decoded (wrong or missing -sec?)\n", undecodable)
+	}
+	if rejected > 0 {
+		fmt.Printf("⚠️  Ignored %d heartbeat(s) that were stale, replayed or badly signed\n", rejected)
+	}
+
+	if impostors > 0 {
+		fmt.Printf("⛔ %d agent(s) signed heartbeats with a key other than the one pinned in %s\n", impostors, known.Path())
+	}
+
+	if stale > 0 || impostors > 0 {
+		os.Exit(1)
+	}
+}
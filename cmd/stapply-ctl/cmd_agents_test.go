@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nkeys"
+)
+
+func TestSightingStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		intervalMs int64
+		ago        time.Duration
+		want       bool
+	}{
+		{5000, 9 * time.Second, false},
+		{5000, 11 * time.Second, true},
+		{60000, 90 * time.Second, false},
+		{0, 25 * time.Second, false}, // Agents that predate IntervalMs use the default
+		{0, 31 * time.Second, true},
+	}
+	for _, tt := range tests {
+		s := &agentSighting{hb: protocol.Heartbeat{IntervalMs: tt.intervalMs}, lastSeen: now.Add(-tt.ago)}
+		if got := s.stale(now); got != tt.want {
+			t.Errorf("stale(interval=%dms, last seen %s ago) = %v, want %v", tt.intervalMs, tt.ago, got, tt.want)
+		}
+	}
+}
+
+func TestRecordHeartbeat(t *testing.T) {
+	agent, _ := nkeys.CreateUser()
+	other, _ := nkeys.CreateUser()
+	agentPub, _ := agent.PublicKey()
+	pins := map[string]string{"web1": agentPub}
+	pinned := func(id string) (string, bool) {
+		key, ok := pins[id]
+		return key, ok
+	}
+
+	heartbeat := func(sender, agentID string, kp nkeys.KeyPair) (*protocol.Envelope, *protocol.Heartbeat) {
+		t.Helper()
+		data, err := protocol.MarshalWith(protocol.RequestTypeHeartbeat, sender, &protocol.Heartbeat{AgentID: agentID, Version: "1.0"}, protocol.MarshalOptions{Signer: kp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hb protocol.Heartbeat
+		env, err := protocol.Unmarshal(data, &hb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env, &hb
+	}
+
+	seen := make(map[string]*agentSighting)
+	env, hb := heartbeat("web1", "web1", agent)
+	if err := recordHeartbeat(seen, env, hb, pinned, time.Now()); err != nil {
+		t.Fatalf("recordHeartbeat() error = %v", err)
+	}
+	if s := seen["web1"]; s == nil || !s.lastSeen.Equal(env.Timestamp) || s.impostor {
+		t.Fatalf("sighting = %+v, want one last seen at the signed timestamp", s)
+	}
+
+	// Replayed: not newer than the last one
+	if err := recordHeartbeat(seen, env, hb, pinned, time.Now()); err == nil {
+		t.Error("recordHeartbeat() accepted a replayed heartbeat")
+	}
+	// Replayed once the agent is gone: outside the clock skew
+	delete(seen, "web1")
+	if err := recordHeartbeat(seen, env, hb, pinned, time.Now().Add(time.Hour)); err == nil || seen["web1"] != nil {
+		t.Error("recordHeartbeat() accepted an old heartbeat")
+	}
+
+	// Another agent cannot speak for web1
+	env, hb = heartbeat("web2", "web1", other)
+	if err := recordHeartbeat(seen, env, hb, pinned, time.Now()); err == nil {
+		t.Error("recordHeartbeat() accepted a heartbeat sent on behalf of another agent")
+	}
+
+	// Signed with a key other than the pinned one: flagged, not a sighting
+	env, hb = heartbeat("web1", "web1", other)
+	if err := recordHeartbeat(seen, env, hb, pinned, time.Now()); err != nil {
+		t.Fatalf("recordHeartbeat() error = %v", err)
+	}
+	if s := seen["web1"]; s == nil || !s.impostor || !s.lastSeen.IsZero() {
+		t.Errorf("sighting = %+v, want an impostor never seen", s)
+	}
+
+	// Agents never pinned may sign with any key
+	env, hb = heartbeat("web3", "web3", other)
+	if err := recordHeartbeat(seen, env, hb, pinned, time.Now()); err != nil || seen["web3"] == nil {
+		t.Errorf("recordHeartbeat() of an unpinned agent = %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/drax2gma/stapply/internal/config"
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+func cmdContext(args []string) {
+	usage := "Usage: stapply-ctl context <list|show [name]|use <name>>"
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	path := config.DefaultContextsPath()
+	contexts, err := config.LoadContexts(path)
+	if err != nil {
+		log.Fatalf("Failed to load contexts: %v", err)
+	}
+
+	switch args[0] {
+	case "list":
+		if len(contexts.Contexts) == 0 {
+			fmt.Printf("No contexts defined in %s\n", path)
+			return
+		}
+		active, err := contexts.Active("")
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		for _, name := range contexts.Names() {
+			marker := " "
+			if active != nil && active.Name == name {
+				marker = "*"
+			}
+			servers := strings.Join(contexts.Contexts[name].NatsURLs, ",")
+			if servers == "" {
+				servers = "(default)"
+			}
+			fmt.Printf("%s %-20s %s\n", marker, name, servers)
+		}
+
+	case "show":
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+		ctx, err := contexts.Active(name)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if ctx == nil {
+			fmt.Println("No context selected (flags and STAPPLY_* environment variables apply)")
+			return
+		}
+		printContext(ctx)
+
+	case "use":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "Usage: stapply-ctl context use <name>")
+			os.Exit(1)
+		}
+		name := args[1]
+		if contexts.Contexts[name] == nil {
+			log.Fatalf("Context %s not found in %s", name, path)
+		}
+		if err := config.SetCurrentContext(path, name); err != nil {
+			log.Fatalf("Failed to switch context: %v", err)
+		}
+		fmt.Printf("🔀 Switched to context %s\n", name)
+		if env := os.Getenv("STAPPLY_CONTEXT"); env != "" && env != name {
+			fmt.Printf("   ⚠️  STAPPLY_CONTEXT=%s still takes precedence in this shell\n", env)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
+
+// printContext shows a context's settings. Key material is never printed,
+// only where it comes from.
+func printContext(ctx *config.Context) {
+	orDefault := func(v, def string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	}
+
+	fmt.Printf("🧭 Context %s\n", ctx.Name)
+	fmt.Printf("   NATS:        %s\n", orDefault(strings.Join(ctx.NatsURLs, ", "), "(command default)"))
+	fmt.Printf("   Credentials: %s\n", orDefault(ctx.NatsCreds, "(none)"))
+	if ctx.TLS.Enabled() {
+		fmt.Printf("   TLS CA:      %s\n", orDefault(ctx.TLS.CAFile, "(system roots)"))
+		fmt.Printf("   TLS cert:    %s\n", orDefault(ctx.TLS.CertFile, "(none)"))
+	}
+	switch {
+	case ctx.KeyEnv != "":
+		fmt.Printf("   Key:         $%s\n", ctx.KeyEnv)
+	case ctx.KeyFile != "":
+		fmt.Printf("   Key:         %s\n", ctx.KeyFile)
+	default:
+		fmt.Printf("   Key:         $STAPPLY_SHARED_KEY\n")
+	}
+	fmt.Printf("   Subjects:    %s.*\n", orDefault(ctx.SubjectPrefix, protocol.DefaultSubjectPrefix))
+	if ctx.AllowPublic {
+		fmt.Printf("   Public IPs:  allowed\n")
+	}
+}
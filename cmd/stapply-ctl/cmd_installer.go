@@ -1,14 +1,20 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"log"
+	"os"
 	"strings"
 )
 
 func cmdInstaller(args []string) {
 	fs := flag.NewFlagSet("installer", flag.ExitOnError)
 	natsURL := fs.String("nats", "", "NATS server (FQDN)")
+	tlsCA := fs.String("tls-ca", "", "Local CA certificate to embed in the command")
+	tlsCert := fs.String("tls-cert", "", "Client certificate path on the target machine")
+	tlsKey := fs.String("tls-key", "", "Client key path on the target machine")
 	fs.Parse(args)
 
 	// Check if agent ID was provided
@@ -20,18 +26,16 @@ func cmdInstaller(args []string) {
 	// Only include --nats-server if provided
 	var natsFlag string
 	if *natsURL != "" {
-		// Clean up NATS URL to be FQDN only (strip scheme and port)
-		server := *natsURL
-		server = strings.TrimPrefix(server, "nats://")
-		server = strings.TrimPrefix(server, "tls://")
-		if idx := strings.Index(server, ":"); idx != -1 {
-			server = server[:idx]
-		}
-		natsFlag = fmt.Sprintf(" --nats-server %s", server)
+		natsFlag = fmt.Sprintf(" --nats-server %s", installerNATSServer(*natsURL))
+	}
+
+	tlsArgs, err := installerTLSFlags(*tlsCA, *tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalf("Invalid TLS options: %v", err)
 	}
 
 	// Construct arguments string
-	argsStr := natsFlag + agentIDFlag
+	argsStr := natsFlag + agentIDFlag + trustFlag() + tlsArgs
 	separator := ""
 	if argsStr != "" {
 		separator = " --"
@@ -40,3 +44,53 @@ func cmdInstaller(args []string) {
 	// Just output the one-liner
 	fmt.Printf("curl -fsSL https://raw.githubusercontent.com/drax2gma/stapply/main/install.sh | sudo bash -s%s%s\n", separator, argsStr)
 }
+
+// trustFlag makes new agents trust this controller's signing key, if it has one.
+func trustFlag() string {
+	kp := controllerSigner()
+	if kp == nil {
+		return ""
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf(" --trusted-controllers %s", pub)
+}
+
+// installerNATSServer reduces a NATS URL to the FQDN expected by install.sh,
+// keeping an explicit tls:// scheme.
+func installerNATSServer(natsURL string) string {
+	scheme := ""
+	if strings.HasPrefix(natsURL, "tls://") {
+		scheme = "tls://"
+	}
+	server := strings.TrimPrefix(natsURL, "nats://")
+	server = strings.TrimPrefix(server, "tls://")
+	if idx := strings.Index(server, ":"); idx != -1 {
+		server = server[:idx]
+	}
+	return scheme + server
+}
+
+// installerTLSFlags builds the install.sh TLS options. The CA certificate is
+// public and embedded in the command; the client key must already exist on
+// the target, so only paths are passed for the client certificate and key.
+func installerTLSFlags(caFile, certPath, keyPath string) (string, error) {
+	if (certPath == "") != (keyPath == "") {
+		return "", fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+
+	var b strings.Builder
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, " --tls-ca-data %s", base64.StdEncoding.EncodeToString(pem))
+	}
+	if certPath != "" {
+		fmt.Fprintf(&b, " --tls-cert %s --tls-key %s", certPath, keyPath)
+	}
+	return b.String(), nil
+}
@@ -24,6 +24,28 @@ func cmdInstallerCustom(args []string) {
 	natsServer, _ := reader.ReadString('\n')
 	natsServer = strings.TrimSpace(natsServer)
 
+	// Prompt for TLS material
+	fmt.Print("Enter local CA certificate file to embed (leave empty for none): ")
+	tlsCA, _ := reader.ReadString('\n')
+	tlsCA = strings.TrimSpace(tlsCA)
+
+	fmt.Print("Enter client certificate path on the target for mTLS (leave empty for none): ")
+	tlsCert, _ := reader.ReadString('\n')
+	tlsCert = strings.TrimSpace(tlsCert)
+
+	var tlsKey string
+	if tlsCert != "" {
+		fmt.Print("Enter client key path on the target: ")
+		tlsKey, _ = reader.ReadString('\n')
+		tlsKey = strings.TrimSpace(tlsKey)
+	}
+
+	tlsArgs, err := installerTLSFlags(tlsCA, tlsCert, tlsKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Build flags
 	var agentIDFlag string
 	if agentID != "" {
@@ -33,17 +55,11 @@ func cmdInstallerCustom(args []string) {
 	var natsFlag string
 	if natsServer != "" && natsServer != "localhost" {
 		// Clean up input just in case user pasted a URL
-		server := natsServer
-		server = strings.TrimPrefix(server, "nats://")
-		server = strings.TrimPrefix(server, "tls://")
-		if idx := strings.Index(server, ":"); idx != -1 {
-			server = server[:idx]
-		}
-		natsFlag = fmt.Sprintf(" --nats-server %s", server)
+		natsFlag = fmt.Sprintf(" --nats-server %s", installerNATSServer(natsServer))
 	}
 
 	// Construct arguments string
-	argsStr := natsFlag + agentIDFlag
+	argsStr := natsFlag + agentIDFlag + trustFlag() + tlsArgs
 	separator := ""
 	if argsStr != "" {
 		separator = " --"
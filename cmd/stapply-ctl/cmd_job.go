@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// maxPollFailures is how many consecutive failed polls runAsync tolerates
+// before giving up on a job.
+const maxPollFailures = 3
+
+func cmdJob(args []string) {
+	fs := flag.NewFlagSet("job", flag.ExitOnError)
+	conn := connFlags(fs)
+	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout (per poll for wait)")
+	fs.Parse(args)
+
+	usage := "Usage: stapply-ctl job <list|status|wait|output> <agent_id> [job_id] [stdout|stderr]"
+	if fs.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	sub := fs.Arg(0)
+	agentID := fs.Arg(1)
+	jobID := fs.Arg(2)
+	if sub != "list" && jobID == "" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	// NATS defaults to agent_id if not configured
+	nc := conn.connect(agentID)
+	defer nc.Close()
+
+	client := newAgentClient(nc, agentID, conn.key())
+	if _, err := client.negotiate(*timeout); err != nil {
+		log.Fatalf("Agent unreachable: %v", err)
+	}
+	if !client.supports(protocol.FeatureJobs) {
+		log.Fatalf("Agent %s does not support jobs; run 'stapply-ctl update %s'", agentID, agentID)
+	}
+
+	switch sub {
+	case "list", "status":
+		var resp protocol.JobResponse
+		req := protocol.NewJobRequest(jobID, 0)
+		if err := client.call(protocol.RequestTypeJobStatus, req, &resp, *timeout); err != nil {
+			log.Fatalf("Job status request failed: %v", err)
+		}
+		if resp.Error != "" {
+			fmt.Printf("❌ %s\n", resp.Error)
+			os.Exit(1)
+		}
+		if len(resp.Jobs) == 0 {
+			fmt.Printf("No jobs on agent %s\n", agentID)
+			return
+		}
+		for _, ji := range resp.Jobs {
+			printJobInfo(ji)
+		}
+
+	case "wait":
+		fmt.Printf("⏳ Waiting for job %s on %s...\n", jobID, agentID)
+		resp, err := waitForJob(client, jobID, *timeout)
+		if err != nil {
+			log.Fatalf("Wait failed: %v", err)
+		}
+		printJobResult(resp)
+		printTruncated("", agentID, jobID, resp)
+		if resp.Status != protocol.StatusOK {
+			os.Exit(1)
+		}
+
+	case "output":
+		stream := protocol.OutputStdout
+		if fs.NArg() > 3 {
+			stream = fs.Arg(3)
+		}
+		if !client.supports(protocol.FeatureOutput) {
+			log.Fatalf("Agent %s does not support output fetching; run 'stapply-ctl update %s'", agentID, agentID)
+		}
+		if _, err := fetchOutput(client, jobID, stream, os.Stdout, *timeout); err != nil {
+			log.Fatalf("Fetching output failed: %v", err)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown job command: %s\n", sub)
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
+
+func printJobInfo(ji protocol.JobInfo) {
+	elapsed := time.Since(ji.StartedAt)
+	if ji.FinishedAt != nil {
+		elapsed = ji.FinishedAt.Sub(ji.StartedAt)
+	}
+	status := "running"
+	if ji.Result != nil {
+		status = string(ji.Result.Status)
+	}
+	fmt.Printf("%s  %-16s %-8s %s\n", ji.JobID, ji.Action, status, elapsed.Round(time.Millisecond))
+}
+
+func printJobResult(resp *protocol.RunResponse) {
+	switch resp.Status {
+	case protocol.StatusOK:
+		fmt.Printf("✅ OK (changed=%v, %dms)\n", resp.Changed, resp.DurationMs)
+	case protocol.StatusFailed:
+		fmt.Printf("❌ Failed (exit=%d)\n", resp.ExitCode)
+	case protocol.StatusTimeout:
+		fmt.Printf("⏱️  Timeout: %s\n", resp.Error)
+	case protocol.StatusCancelled:
+		fmt.Printf("🛑 Cancelled: %s\n", resp.Error)
+	case protocol.StatusDenied:
+		fmt.Printf("⛔ Denied by agent policy: %s\n", resp.Error)
+	default:
+		fmt.Printf("❌ Error: %s\n", resp.Error)
+	}
+	if resp.Stdout != "" {
+		fmt.Println(strings.TrimRight(resp.Stdout, "\n"))
+	}
+	if resp.Stderr != "" {
+		fmt.Fprintln(os.Stderr, strings.TrimRight(resp.Stderr, "\n"))
+	}
+}
+
+// printTruncated tells the user where to get the full output of a truncated result.
+func printTruncated(indent, agentID, jobID string, resp *protocol.RunResponse) {
+	if !resp.Truncated {
+		return
+	}
+	fmt.Printf("%s✂️  Output truncated (stdout %s, stderr %s); full output:\n",
+		indent, formatBytes(resp.StdoutBytes), formatBytes(resp.StderrBytes))
+	fmt.Printf("%s   stapply-ctl job output %s %s [stderr]\n", indent, agentID, jobID)
+}
+
+// fetchOutput copies a finished job's full stream output to w in chunks
+// and returns the number of bytes written.
+func fetchOutput(client *agentClient, jobID, stream string, w io.Writer, timeout time.Duration) (int64, error) {
+	var offset int64
+	for {
+		var resp protocol.OutputResponse
+		req := protocol.NewOutputRequest(jobID, stream, offset, 0)
+		if err := client.call(protocol.RequestTypeJobOutput, req, &resp, timeout); err != nil {
+			return offset, err
+		}
+		if resp.Error != "" {
+			return offset, fmt.Errorf("%s", resp.Error)
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return offset, err
+		}
+		offset += int64(len(resp.Data))
+		if offset >= resp.Total {
+			return offset, nil
+		}
+		if len(resp.Data) == 0 {
+			return offset, fmt.Errorf("agent returned an empty chunk at offset %d of %d", offset, resp.Total)
+		}
+	}
+}
+
+// formatBytes renders a byte count for humans.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// runAsync submits req as a background job, retrying the submission as
+// retry allows, and waits for it to finish. Each poll is bounded by
+// pollTimeout, so the job itself may run far longer.
+func runAsync(client *agentClient, req *protocol.RunRequest, pollTimeout time.Duration, retry retryPolicy) (*protocol.RunResponse, error) {
+	if _, err := client.negotiate(pollTimeout); err != nil {
+		return nil, err
+	}
+	if !client.supports(protocol.FeatureJobs) {
+		return nil, fmt.Errorf("agent %s does not support jobs; run 'stapply-ctl update %s'", client.agentID, client.agentID)
+	}
+
+	req.Async = true
+
+	var ack protocol.JobAck
+	if err := client.callRun(req, &ack, pollTimeout, retry, "         "); err != nil {
+		return nil, fmt.Errorf("submit job: %w", err)
+	}
+
+	return waitForJob(client, ack.JobID, pollTimeout)
+}
+
+// waitForJob long-polls an agent until the job is done.
+func waitForJob(client *agentClient, jobID string, pollTimeout time.Duration) (*protocol.RunResponse, error) {
+	failures := 0
+
+	for {
+		var resp protocol.JobResponse
+		req := protocol.NewJobRequest(jobID, pollTimeout)
+		err := client.call(protocol.RequestTypeJobResult, req, &resp, pollTimeout+replyGrace)
+		if err != nil {
+			failures++
+			if failures >= maxPollFailures {
+				return nil, fmt.Errorf("job %s: %w (reattach with 'stapply-ctl job wait %s %s')", jobID, err, client.agentID, jobID)
+			}
+			if errors.Is(err, nats.ErrNoResponders) {
+				time.Sleep(pollTimeout / 10)
+			}
+			continue
+		}
+		failures = 0
+
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+		if len(resp.Jobs) == 1 && resp.Jobs[0].State == protocol.JobDone {
+			return resp.Jobs[0].Result, nil
+		}
+	}
+}
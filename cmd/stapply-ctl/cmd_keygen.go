@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/drax2gma/stapply/internal/security"
+)
+
+func cmdKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("o", signingKeyPath(), "Where to write the signing key seed")
+	fs.Parse(args)
+
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl keygen -o <path>")
+		os.Exit(1)
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		kp, err := security.LoadSigningKey(*out)
+		if err != nil {
+			log.Fatalf("Failed to load existing signing key: %v", err)
+		}
+		pub, _ := kp.PublicKey()
+		fmt.Printf("🔏 Signing key already exists: %s\n", *out)
+		fmt.Printf("   Public key: %s\n", pub)
+		return
+	}
+
+	pub, err := security.GenerateSigningKey(*out)
+	if err != nil {
+		log.Fatalf("Failed to generate signing key: %v", err)
+	}
+
+	fmt.Printf("🔏 Signing key written to %s\n", *out)
+	fmt.Printf("   Public key: %s\n", pub)
+	fmt.Println()
+	fmt.Println("Trust this controller on each agent (agent.ini):")
+	fmt.Printf("   trusted_controllers=%s\n", pub)
+	if *out != signingKeyPath() {
+		fmt.Println()
+		fmt.Println("Point the controller at the key:")
+		fmt.Printf("   export STAPPLY_SIGNING_KEY=%s\n", *out)
+	}
+}
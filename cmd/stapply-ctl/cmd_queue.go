@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/config"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/queue"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// queuedHost is a host whose steps were queued, or whose results are collected.
+type queuedHost struct {
+	id     string
+	client *agentClient
+}
+
+// queueHosts resolves the agent and key of every host in env. Agents are not
+// contacted, as they may well be offline.
+func queueHosts(nc *nats.Conn, cfg *config.Config, env *config.Environment, conn *connOptions) ([]queuedHost, error) {
+	var hosts []queuedHost
+	for _, hID := range env.Hosts {
+		host, ok := cfg.Hosts[hID]
+		if !ok {
+			return nil, fmt.Errorf("host not found: %s", hID)
+		}
+		agentID := host.AgentID
+		if agentID == "" {
+			agentID = hID
+		}
+		key, err := conn.hostKey(cfg, env, hID)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, queuedHost{id: hID, client: newAgentClient(nc, agentID, key)})
+	}
+	return hosts, nil
+}
+
+// runQueued queues the steps of env in each agent's JetStream work queue
+// instead of sending them, and returns without waiting. Agents run them in
+// order as soon as they are connected; 'stapply-ctl results' collects the
+// outcome. Artifacts always go through the object store (see artifactFanout),
+// since the agent cannot be sent chunks while it is away.
+func runQueued(nc *nats.Conn, cfg *config.Config, env *config.Environment, configPath, envName string, conn *connOptions, jobTimeout time.Duration, outputLimit int) {
+	hosts, err := queueHosts(nc, cfg, env, conn)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Fatalf("JetStream unavailable: %v", err)
+	}
+	// Agents only bind to their consumer, so both are set up here
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = queue.Ensure(ctx, js)
+	for _, host := range hosts {
+		if err == nil {
+			err = queue.EnsureConsumer(ctx, js, host.client.agentID)
+		}
+	}
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to set up work queue streams: %v", err)
+	}
+
+	secret, err := conn.hostKey(cfg, env, "")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	runID := protocol.NewRunID()
+	fan := newArtifactFanout(nc, jobTimeout, secret)
+	timeoutMs := int(jobTimeout / time.Millisecond)
+
+	fmt.Printf("📬 Queueing environment: %s (run %s)\n", envName, runID)
+	fmt.Printf("   Hosts: %v\n", env.Hosts)
+	fmt.Printf("   Apps: %v\n", env.Apps)
+	fmt.Println()
+
+	queued := 0
+	for _, host := range hosts {
+		fmt.Printf("📦 Host: %s (agent_id=%s)\n", host.id, host.client.agentID)
+
+		// Build all requests first so a host gets all its steps or none
+		var steps []*protocol.QueuedRequest
+		for _, appName := range env.Apps {
+			app, ok := cfg.Apps[appName]
+			if !ok {
+				log.Fatalf("App not found: %s", appName)
+			}
+			for _, step := range app.GetOrderedSteps() {
+				stepArgs := step.ArgsMap
+				if stepArgs == nil {
+					stepArgs = make(map[string]string)
+				}
+
+				var req *protocol.RunRequest
+				if artifactArgs, isArtifact := artifactStepArgs(step.Action, stepArgs); isArtifact {
+					spec, err := parseArtifactSpec(artifactArgs)
+					if err != nil {
+						log.Fatalf("Invalid deploy_artifact args in app %s: %v", appName, err)
+					}
+					if req, err = fan.fetchRequest(spec); err != nil {
+						log.Fatalf("Failed to upload artifact %s: %v", spec.src, err)
+					}
+				} else {
+					req = protocol.NewRunRequest(step.Action, stepArgs, timeoutMs, false)
+				}
+				req.OutputLimit = outputLimit
+				steps = append(steps, &protocol.QueuedRequest{RunID: runID, Host: host.id, App: appName, Run: req})
+			}
+		}
+
+		for i, qr := range steps {
+			qr.Step, qr.Steps = i+1, len(steps)
+			if err := publishQueued(js, host.client, qr); err != nil {
+				log.Fatalf("Failed to queue step %d for %s: %v", qr.Step, host.id, err)
+			}
+			fmt.Printf("   📥 Step %d/%d: %s (%s)\n", qr.Step, qr.Steps, qr.Run.Action, qr.App)
+		}
+		queued += len(steps)
+		fmt.Println()
+	}
+
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	fmt.Printf("Queued %d step(s) for %d host(s) as run %s\n", queued, len(hosts), runID)
+	fmt.Printf("Collect results with: stapply-ctl results -c %s -e %s %s\n", configPath, envName, runID)
+}
+
+// publishQueued adds qr to the agent's work queue. The envelope's message ID
+// doubles as the JetStream one, so JetStream deduplicates retried publishes
+// and the agent can tell a replayed request from the original (see
+// QueuedRequest). Agents consuming the queue all read zstd.
+func publishQueued(js jetstream.JetStream, client *agentClient, qr *protocol.QueuedRequest) error {
+	msgID := uuid.NewString()
+	data, err := marshalRequest(protocol.RequestTypeQueue, qr, protocol.MarshalOptions{
+		MessageID:   msgID,
+		Compression: protocol.CompressionZstd,
+		Accept:      protocol.CompressionZstd,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	if data, err = client.encrypt(data); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = js.Publish(ctx, protocol.RequestTypeQueue.Subject(client.agentID), data, jetstream.WithMsgID(msgID))
+	return err
+}
+
+func cmdResults(args []string) {
+	fs := flag.NewFlagSet("results", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to configuration file")
+	envName := fs.String("e", "", "Environment name")
+	conn := connFlags(fs)
+	wait := fs.Duration("wait", 0, "Keep collecting until every host finished or this long has passed")
+	fs.Parse(args)
+
+	if *configPath == "" || *envName == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl results -c <config> -e <env> [-wait <duration>] <run_id>")
+		os.Exit(1)
+	}
+	runID := fs.Arg(0)
+	if err := protocol.CheckRunID(runID); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	cfg, err := config.Parse(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to parse config: %v", err)
+	}
+	env, ok := cfg.Environments[*envName]
+	if !ok {
+		log.Fatalf("Environment not found: %s", *envName)
+	}
+
+	nc := conn.connect("nats://localhost:4222")
+	defer nc.Close()
+
+	hosts, err := queueHosts(nc, cfg, env, conn)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	clients := make(map[string]*agentClient, len(hosts))
+	for _, host := range hosts {
+		clients[host.client.agentID] = host.client
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Fatalf("JetStream unavailable: %v", err)
+	}
+	ctx := context.Background()
+	cons, err := js.OrderedConsumer(ctx, queue.ResultStream(), jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{protocol.ResultSubject(runID, ">")},
+	})
+	if err != nil {
+		log.Fatalf("Failed to read results: %v", err)
+	}
+
+	fmt.Printf("📬 Results of run %s\n\n", runID)
+
+	// Latest result per agent and step: an agent restarted mid-step runs it
+	// again and reports twice
+	results := make(map[string]map[int]*protocol.QueuedResult)
+	done := func() bool {
+		for _, host := range hosts {
+			steps := results[host.client.agentID]
+			if len(steps) == 0 {
+				return false
+			}
+			for _, r := range steps {
+				if len(steps) < r.Steps {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	deadline := time.Now().Add(*wait)
+	for {
+		batch, err := cons.Fetch(100, jetstream.FetchMaxWait(time.Second))
+		if err != nil {
+			log.Fatalf("Failed to read results: %v", err)
+		}
+		n := 0
+		for msg := range batch.Messages() {
+			n++
+			r, err := decodeResult(msg, runID, clients)
+			if err != nil {
+				fmt.Printf("⚠️  Skipping result on %s: %v\n", msg.Subject(), err)
+				continue
+			}
+			if results[r.AgentID] == nil {
+				results[r.AgentID] = make(map[int]*protocol.QueuedResult)
+			}
+			results[r.AgentID][r.Step] = r
+			printQueuedResult(r)
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			log.Fatalf("Failed to read results: %v", err)
+		}
+		if n == 0 && (done() || time.Now().After(deadline)) {
+			break
+		}
+	}
+
+	var okCount, changedCount, failedCount int
+	var pending []string
+	for _, host := range hosts {
+		steps := results[host.client.agentID]
+		total := 0
+		for _, r := range steps {
+			total = r.Steps
+			switch {
+			case r.Result.Status != protocol.StatusOK:
+				failedCount++
+			case r.Result.Changed:
+				changedCount++
+			default:
+				okCount++
+			}
+		}
+		if len(steps) == 0 {
+			pending = append(pending, host.id+" (no results yet)")
+		} else if len(steps) < total {
+			pending = append(pending, fmt.Sprintf("%s (%d/%d steps)", host.id, len(steps), total))
+		}
+	}
+	sort.Strings(pending)
+
+	fmt.Println()
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	fmt.Printf("Summary: ok=%d changed=%d failed=%d pending=%d\n", okCount, changedCount, failedCount, len(pending))
+	if len(pending) > 0 {
+		fmt.Printf("Pending: %s\n", strings.Join(pending, ", "))
+	}
+
+	switch {
+	case failedCount > 0:
+		os.Exit(1)
+	case len(pending) > 0:
+		os.Exit(2)
+	}
+}
+
+// decodeResult decodes a result of runID, checking it comes from the agent
+// of one of the hosts, which signs it like any response.
+func decodeResult(msg jetstream.Msg, runID string, clients map[string]*agentClient) (*protocol.QueuedResult, error) {
+	agentID := strings.TrimPrefix(msg.Subject(), protocol.ResultSubject(runID, ""))
+	client, ok := clients[agentID]
+	if !ok {
+		return nil, fmt.Errorf("agent %s is not a host of the environment", agentID)
+	}
+	var r protocol.QueuedResult
+	if _, err := client.decode(msg.Data(), &r); err != nil {
+		return nil, err
+	}
+	if r.RunID != runID || r.AgentID != agentID || r.Result == nil {
+		return nil, fmt.Errorf("result does not belong to run %s of agent %s", runID, agentID)
+	}
+	return &r, nil
+}
+
+// printQueuedResult prints one step's outcome the way 'run' does.
+func printQueuedResult(r *protocol.QueuedResult) {
+	resp := r.Result
+	fmt.Printf("📦 %s step %d/%d: %s (%s)\n", r.Host, r.Step, r.Steps, r.Action, r.App)
+	switch resp.Status {
+	case protocol.StatusOK:
+		if resp.Changed {
+			fmt.Printf("   ✅ Changed (%dms)\n", resp.DurationMs)
+		} else {
+			fmt.Printf("   ✅ OK (%dms)\n", resp.DurationMs)
+		}
+	case protocol.StatusFailed:
+		fmt.Printf("   ❌ Failed (exit=%d): %s\n", resp.ExitCode, resp.Stderr)
+	case protocol.StatusTimeout:
+		fmt.Printf("   ⏱️  Timeout: %s\n", resp.Error)
+	case protocol.StatusCancelled:
+		fmt.Printf("   🛑 Cancelled (%dms)\n", resp.DurationMs)
+	case protocol.StatusDenied:
+		fmt.Printf("   ⛔ Denied by agent policy: %s\n", resp.Error)
+	default:
+		fmt.Printf("   ❌ Error: %s\n", resp.Error)
+	}
+	printTruncated("   ", r.AgentID, resp.RequestID, resp)
+}
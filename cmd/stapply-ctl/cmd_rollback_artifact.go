@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+// cmdRollbackArtifact switches the current link of a release directory
+// deployed with deploy_artifact releases=N back to the previous release.
+func cmdRollbackArtifact(args []string) {
+	fs := flag.NewFlagSet("rollback-artifact", flag.ExitOnError)
+	conn := connFlags(fs)
+	timeout := fs.Duration("timeout", 10*time.Second, "Request timeout")
+	dryRun := fs.Bool("dry-run", false, "Show which release would become current")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl rollback-artifact [flags] <agent_id> <dest>")
+		os.Exit(1)
+	}
+	agentID, dest := fs.Arg(0), fs.Arg(1)
+
+	// NATS defaults to agent_id if not configured
+	nc := conn.connect(agentID)
+	defer nc.Close()
+
+	client := newAgentClient(nc, agentID, conn.key())
+	if _, err := client.negotiate(*timeout); err != nil {
+		log.Fatalf("Agent unreachable: %v", err)
+	}
+	if !client.supports(protocol.FeatureArtifactReleases) {
+		log.Fatalf("Agent %s does not support releases; run 'stapply-ctl update %s'", agentID, agentID)
+	}
+
+	req := protocol.NewRunRequest("rollback_artifact", map[string]string{"dest": dest}, int(*timeout/time.Millisecond), *dryRun)
+	var resp protocol.RunResponse
+	if err := client.call(protocol.RequestTypeRun, req, &resp, *timeout+replyGrace); err != nil {
+		log.Fatalf("Rollback request failed: %v", err)
+	}
+
+	switch resp.Status {
+	case protocol.StatusOK:
+		fmt.Printf("⏪ %s:%s %s\n", agentID, dest, resp.Stdout)
+	case protocol.StatusDenied:
+		fmt.Printf("⛔ Denied by agent policy: %s\n", resp.Error)
+		os.Exit(1)
+	default:
+		fmt.Printf("❌ Rollback failed: %s\n", resp.Error)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/config"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/security"
+	"github.com/nats-io/nats.go"
+)
+
+// rotationHost is one host taking part in a key rotation.
+type rotationHost struct {
+	hostID  string
+	agentID string
+	keyEnv  string // Variable the controller reads this host's key from
+	oldKey  security.Key
+	ok      bool
+}
+
+func cmdRotateKey(args []string) {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	configPath := fs.String("c", "", "Path to configuration file")
+	envName := fs.String("e", "", "Environment name")
+	keyID := fs.String("id", "", "ID of the new key (default <env>-<timestamp>)")
+	conn := connFlags(fs)
+	timeout := fs.Duration("timeout", 5*time.Second, "Request timeout")
+	fs.Parse(args)
+
+	if *configPath == "" || *envName == "" {
+		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl rotate-key -c <config> -e <env> [-id <key_id>]")
+		os.Exit(1)
+	}
+
+	if !strings.HasSuffix(*configPath, ".stay.ini") {
+		fmt.Fprintf(os.Stderr, "Error: config file must have .stay.ini extension: %s\n", *configPath)
+		os.Exit(1)
+	}
+
+	cfg, err := config.Parse(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to parse config: %v", err)
+	}
+
+	env, ok := cfg.Environments[*envName]
+	if !ok {
+		log.Fatalf("Environment not found: %s", *envName)
+	}
+
+	if *keyID == "" {
+		*keyID = fmt.Sprintf("%s-%s", *envName, time.Now().UTC().Format("20060102150405"))
+	}
+	newKey, err := security.GenerateKey(*keyID)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// Resolve the current key of every host
+	var hosts []*rotationHost
+	for _, hostID := range env.Hosts {
+		h := &rotationHost{hostID: hostID, agentID: hostID, keyEnv: conn.keyEnv()}
+		if env.KeyEnv != "" {
+			h.keyEnv = env.KeyEnv
+		}
+		if host, ok := cfg.Hosts[hostID]; ok {
+			if host.AgentID != "" {
+				h.agentID = host.AgentID
+			}
+			if host.KeyEnv != "" {
+				h.keyEnv = host.KeyEnv
+			}
+		}
+
+		key, err := conn.hostKey(cfg, env, hostID)
+		if err != nil {
+			log.Fatalf("Host %s: %v", hostID, err)
+		}
+		if key == "" {
+			log.Fatalf("Host %s: encryption is not enabled, nothing to rotate", hostID)
+		}
+		h.oldKey = security.ParseKey(key)
+		if h.oldKey.ID == newKey.ID {
+			log.Fatalf("Host %s: already uses key %s, choose another -id", hostID, newKey.ID)
+		}
+		hosts = append(hosts, h)
+	}
+
+	nc := conn.connect("nats://localhost:4222")
+	defer nc.Close()
+
+	fmt.Printf("🔑 Rotating key for environment %s to %s\n", *envName, newKey.ID)
+	fmt.Println()
+
+	// 1. Push the new key over the old one, then prove the agent accepts it
+	fmt.Println("1. Install and verify new key")
+	fmt.Println("─────────────────────────────")
+	failed := eachHost(hosts, env.Concurrency, func(h *rotationHost) bool {
+		if err := installKey(nc, h, newKey, *timeout); err != nil {
+			fmt.Printf("   ❌ [%s] %v\n", h.hostID, err)
+			return false
+		}
+		h.ok = true
+		fmt.Printf("   ✅ [%s] %s installed and verified\n", h.hostID, newKey.ID)
+		return true
+	})
+	fmt.Println()
+
+	if failed > 0 {
+		// Retiring now would lock the failed hosts out of the old key
+		// while the rest have moved on; leave both keys active instead.
+		fmt.Printf("❌ %d host(s) failed; old keys were NOT retired.\n", failed)
+		fmt.Println("   Hosts that succeeded accept both keys. Fix the failures and re-run with the same -id.")
+		printKeyExports(hosts, newKey)
+		os.Exit(1)
+	}
+
+	// 2. Retire the old key using the new one
+	fmt.Println("2. Retire old key")
+	fmt.Println("─────────────────")
+	failed = eachHost(hosts, env.Concurrency, func(h *rotationHost) bool {
+		client := newAgentClient(nc, h.agentID, newKey.String())
+		var resp protocol.KeyResponse
+		err := client.call(protocol.RequestTypeKey,
+			protocol.NewKeyRequest(protocol.KeyOpRetire, h.oldKey.ID, ""), &resp, *timeout)
+		if err == nil && resp.Error != "" {
+			err = fmt.Errorf("%s", resp.Error)
+		}
+		if err != nil {
+			fmt.Printf("   ❌ [%s] Retire %s failed: %v\n", h.hostID, h.oldKey.Name(), err)
+			return false
+		}
+		fmt.Printf("   ✅ [%s] Retired %s (active: %s)\n", h.hostID, h.oldKey.Name(), strings.Join(resp.KeyIDs, ", "))
+		return true
+	})
+	fmt.Println()
+
+	printKeyExports(hosts, newKey)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// eachHost calls fn for every host, at most concurrency at a time as in
+// run (0 = all at once), and returns how many calls reported failure.
+func eachHost(hosts []*rotationHost, concurrency int, fn func(h *rotationHost) bool) int {
+	if concurrency <= 0 {
+		concurrency = len(hosts)
+	}
+	semaphore := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, h := range hosts {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-semaphore; wg.Done() }()
+			if !fn(h) {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// installKey adds key to the agent's keyring with the host's current key and
+// checks the agent answers a request encrypted with the new key. Re-running a
+// rotation whose add already succeeded skips straight to verification.
+func installKey(nc *nats.Conn, h *rotationHost, key security.Key, timeout time.Duration) error {
+	verify := newAgentClient(nc, h.agentID, key.String())
+	if _, err := verify.ping(timeout); err == nil {
+		return nil
+	}
+
+	client := newAgentClient(nc, h.agentID, h.oldKey.String())
+	if _, err := client.negotiate(timeout); err != nil {
+		return err
+	}
+	if !client.supports(protocol.FeatureKeys) {
+		return fmt.Errorf("agent does not support key rotation; run 'stapply-ctl update %s'", h.agentID)
+	}
+
+	var resp protocol.KeyResponse
+	req := protocol.NewKeyRequest(protocol.KeyOpAdd, key.ID, key.Secret)
+	if err := client.call(protocol.RequestTypeKey, req, &resp, timeout); err != nil {
+		return fmt.Errorf("add key: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("add key: %s", resp.Error)
+	}
+
+	if _, err := verify.ping(timeout); err != nil {
+		return fmt.Errorf("verify new key: %w", err)
+	}
+	return nil
+}
+
+// printKeyExports tells the operator where to store the new key.
+func printKeyExports(hosts []*rotationHost, key security.Key) {
+	vars := make(map[string]bool)
+	for _, h := range hosts {
+		if h.ok {
+			vars[h.keyEnv] = true
+		}
+	}
+	if len(vars) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("Store the new key where the controller reads it:")
+	for _, name := range names {
+		fmt.Printf("   export %s=%s\n", name, key.String())
+	}
+}
@@ -1,34 +1,23 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
-	"github.com/drax2gma/stapply/internal/netutil"
 	"github.com/drax2gma/stapply/internal/protocol"
-	"github.com/drax2gma/stapply/internal/security"
 	"github.com/nats-io/nats.go"
 )
 
 func cmdUpdate(args []string) {
 	fs := flag.NewFlagSet("update", flag.ExitOnError)
-	defaultNats := getDefaultNATSURL()
-	natsURL := fs.String("nats", defaultNats, "NATS server (FQDN or IP)")
-	allowPublic := fs.Bool("allow-public", false, "Allow connection to public NATS servers")
+	conn := connFlags(fs)
 	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout")
-	secretKey := fs.String("sec", "", "Shared secret key for encryption")
 	fs.Parse(args)
 
-	// Determine effective secret key
-	effectiveKey := *secretKey
-	if effectiveKey == "" {
-		effectiveKey = os.Getenv("STAPPLY_SHARED_KEY")
-	}
-
 	if fs.NArg() < 1 {
 		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl update <agent_id>")
 		os.Exit(1)
@@ -36,22 +25,8 @@ func cmdUpdate(args []string) {
 
 	agentID := fs.Arg(0)
 
-	// Default NATS URL to agent_id if not specified
-	if *natsURL == "" {
-		*natsURL = agentID
-	}
-
-	// Validate and normalize NATS URL
-	*natsURL = netutil.NormalizeNATSURL(*natsURL)
-	if err := netutil.ValidateNATSURL(*natsURL, *allowPublic); err != nil {
-		log.Fatalf("NATS URL validation failed: %v", err)
-	}
-
-	// Connect to NATS
-	nc, err := nats.Connect(*natsURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to NATS: %v", err)
-	}
+	// NATS defaults to agent_id if not configured
+	nc := conn.connect(agentID)
 	defer nc.Close()
 
 	fmt.Printf("🔄 Updating agent %s to version %s\n", agentID, Version)
@@ -61,45 +36,16 @@ func cmdUpdate(args []string) {
 
 	// Create update request
 	req := protocol.NewUpdateRequest(Version, binaryURL)
-	data, err := json.Marshal(req)
-	if err != nil {
-		log.Fatalf("Failed to marshal request: %v", err)
-	}
-
-	// Send update request
-	subject := "stapply.update." + agentID
-
-	if effectiveKey != "" {
-		var err error
-		data, err = security.Encrypt(data, effectiveKey)
-		if err != nil {
-			log.Fatalf("Failed to encrypt request: %v", err)
-		}
-	}
-
-	msg, err := nc.Request(subject, data, *timeout)
-	if err != nil {
-		if err == nats.ErrTimeout {
+	client := newAgentClient(nc, agentID, conn.key())
+	var resp protocol.UpdateResponse
+	if err := client.call(protocol.RequestTypeUpdate, req, &resp, *timeout); err != nil {
+		if errors.Is(err, nats.ErrTimeout) {
 			fmt.Printf("❌ Agent %s: timeout (no response within %s)\n", agentID, *timeout)
 			os.Exit(1)
 		}
 		log.Fatalf("Request failed: %v", err)
 	}
 
-	// Parse response
-	if effectiveKey != "" {
-		var err error
-		msg.Data, err = security.Decrypt(msg.Data, effectiveKey)
-		if err != nil {
-			log.Fatalf("Failed to decrypt response: %v", err)
-		}
-	}
-
-	var resp protocol.UpdateResponse
-	if err := json.Unmarshal(msg.Data, &resp); err != nil {
-		log.Fatalf("Failed to parse response: %v", err)
-	}
-
 	if resp.Success {
 		fmt.Printf("✅ %s\n", resp.Message)
 	} else {
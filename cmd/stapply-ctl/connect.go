@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/drax2gma/stapply/internal/config"
+	"github.com/drax2gma/stapply/internal/netutil"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// connOptions holds the connection flags shared by every subcommand that
+// talks to agents. Whatever is not given on the command line comes from the
+// active context in contexts.ini, then from the environment.
+type connOptions struct {
+	contextName string
+	natsURL     string
+	creds       string
+	allowPublic bool
+	secretKey   string
+	legacy      bool
+	tls         netutil.TLSConfig
+
+	ctx      *config.Context // Active context (nil = none), set by resolve
+	resolved bool
+}
+
+// connFlags registers the connection flags of a subcommand.
+func connFlags(fs *flag.FlagSet) *connOptions {
+	o := &connOptions{}
+	fs.StringVar(&o.contextName, "context", "", "Context from contexts.ini (default: STAPPLY_CONTEXT or current_context)")
+	fs.StringVar(&o.natsURL, "nats", "", "NATS server URL(s), comma-separated (default: context, then STAPPLY_DEFAULT_NATS)")
+	fs.StringVar(&o.creds, "creds", "", "NATS credentials file")
+	fs.BoolVar(&o.allowPublic, "allow-public", false, "Allow connection to public NATS servers")
+	fs.StringVar(&o.secretKey, "sec", "", "Shared secret key for encryption")
+	fs.BoolVar(&o.legacy, "legacy-crypto", false, "Encrypt in the legacy format, for agents that predate the KDF header (migration only)")
+	fs.StringVar(&o.tls.CAFile, "tls-ca", "", "CA certificate to verify the NATS server against (default: context, then STAPPLY_TLS_CA)")
+	fs.StringVar(&o.tls.CertFile, "tls-cert", "", "Client certificate for mTLS (default: context, then STAPPLY_TLS_CERT)")
+	fs.StringVar(&o.tls.KeyFile, "tls-key", "", "Client private key for mTLS (default: context, then STAPPLY_TLS_KEY)")
+	return o
+}
+
+// resolve loads the active context and fills in the settings the flags left
+// unset, from the context and then from the environment. It runs once, after
+// the flags are parsed.
+func (o *connOptions) resolve() {
+	if o.resolved {
+		return
+	}
+	o.resolved = true
+	legacyCrypto = o.legacy
+
+	contexts, err := config.LoadContexts(config.DefaultContextsPath())
+	if err != nil {
+		log.Fatalf("Failed to load contexts: %v", err)
+	}
+	if o.ctx, err = contexts.Active(o.contextName); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if o.ctx != nil {
+		if o.natsURL == "" {
+			o.natsURL = strings.Join(o.ctx.NatsURLs, ",")
+		}
+		if o.creds == "" {
+			o.creds = o.ctx.NatsCreds
+		}
+		if !o.tls.Enabled() {
+			o.tls = o.ctx.TLS
+		}
+		if o.ctx.AllowPublic {
+			o.allowPublic = true
+		}
+		if err := protocol.SetSubjectPrefix(o.ctx.SubjectPrefix); err != nil {
+			log.Fatalf("Context %s: %v", o.ctx.Name, err)
+		}
+	}
+
+	// TLS files are taken as a set, so a flag or context naming any of them
+	// is not mixed with files from the environment
+	if !o.tls.Enabled() {
+		o.tls = netutil.TLSConfig{
+			CAFile:   os.Getenv("STAPPLY_TLS_CA"),
+			CertFile: os.Getenv("STAPPLY_TLS_CERT"),
+			KeyFile:  os.Getenv("STAPPLY_TLS_KEY"),
+		}
+	}
+}
+
+// key returns the default encryption key: the -sec flag, then the context's
+// key source, then STAPPLY_SHARED_KEY. An empty result means encryption is off.
+func (o *connOptions) key() string {
+	o.resolve()
+	if o.secretKey != "" {
+		return o.secretKey
+	}
+	if o.ctx != nil {
+		key, err := o.ctx.Key()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if key != "" {
+			return key
+		}
+	}
+	return os.Getenv("STAPPLY_SHARED_KEY")
+}
+
+// keyEnv names the environment variable the default key is read from.
+func (o *connOptions) keyEnv() string {
+	o.resolve()
+	if o.ctx != nil && o.ctx.KeyEnv != "" {
+		return o.ctx.KeyEnv
+	}
+	return "STAPPLY_SHARED_KEY"
+}
+
+// connect connects to NATS. The servers are taken from -nats, the active
+// context or STAPPLY_DEFAULT_NATS, and fallback if none of them is set.
+// Any failure is fatal.
+func (o *connOptions) connect(fallback string) *nats.Conn {
+	o.resolve()
+
+	servers := o.natsURL
+	if servers == "" {
+		servers = getDefaultNATSURL()
+	}
+	if servers == "" {
+		servers = fallback
+	}
+
+	// Validate NATS URLs
+	var urls []string
+	for _, server := range strings.Split(servers, ",") {
+		if server = strings.TrimSpace(server); server == "" {
+			continue
+		}
+		url := netutil.NormalizeNATSURL(server)
+		if err := netutil.ValidateNATSURL(url, o.allowPublic); err != nil {
+			log.Fatalf("NATS URL validation failed: %v", err)
+		}
+		urls = append(urls, url)
+	}
+	if len(urls) == 0 {
+		log.Fatalf("No NATS server given")
+	}
+
+	opts, err := o.tls.Options()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	if o.creds != "" {
+		opts = append(opts, nats.UserCredentials(o.creds))
+	}
+
+	// Connect to NATS
+	nc, err := nats.Connect(strings.Join(urls, ","), opts...)
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	return nc
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveTLSPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contexts.ini")
+	err := os.WriteFile(path, []byte("[context:prod]\ntls_ca_file = /ctx/ca.pem\n[context:lab]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STAPPLY_CONTEXTS", path)
+	t.Setenv("STAPPLY_CONTEXT", "")
+	t.Setenv("STAPPLY_TLS_CA", "/env/ca.pem")
+	t.Setenv("STAPPLY_TLS_CERT", "")
+	t.Setenv("STAPPLY_TLS_KEY", "")
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"flag wins", []string{"-context", "prod", "-tls-ca", "/flag/ca.pem"}, "/flag/ca.pem"},
+		{"context before environment", []string{"-context", "prod"}, "/ctx/ca.pem"},
+		{"environment last", []string{"-context", "lab"}, "/env/ca.pem"},
+		{"environment without context", nil, "/env/ca.pem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			o := connFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			o.resolve()
+			if o.tls.CAFile != tt.want {
+				t.Errorf("CA file = %q, want %q", o.tls.CAFile, tt.want)
+			}
+		})
+	}
+}
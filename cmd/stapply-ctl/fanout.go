@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/queue"
+	"github.com/drax2gma/stapply/internal/security"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// artifactBucket is the JetStream object store bucket artifacts are fanned
+// out through, named by their SHA-256.
+const artifactBucket = "stapply-artifacts"
+
+// artifactBucketTTL is how long uploaded artifacts stay in the bucket, as
+// long as the queued runs that may fetch them. Objects past half of it are
+// uploaded again rather than reused.
+const artifactBucketTTL = queue.MaxAge
+
+// artifactObject is an artifact uploaded to the object store.
+type artifactObject struct {
+	name     string // checksum, then a fingerprint of key
+	checksum string // The SHA-256 of the content
+	size     int64
+	key      []byte // Content key the object is encrypted with
+}
+
+// artifactFanout deploys artifacts by uploading each to the object store
+// once and having agents pull it from there, instead of sending it to every
+// host in chunks. How many agents pull at once is bounded by the
+// environment's concurrency, like any other step.
+type artifactFanout struct {
+	nc         *nats.Conn
+	jobTimeout time.Duration // Bound on each agent's download and install
+	secret     string        // Shared secret content keys are derived from ("" = none)
+
+	mu      sync.Mutex
+	uploads map[string]func() (*artifactObject, error) // src -> its one upload
+}
+
+func newArtifactFanout(nc *nats.Conn, jobTimeout time.Duration, secret string) *artifactFanout {
+	return &artifactFanout{
+		nc:         nc,
+		jobTimeout: jobTimeout,
+		secret:     secret,
+		uploads:    make(map[string]func() (*artifactObject, error)),
+	}
+}
+
+// upload puts src in the object store the first time it is called for src
+// and returns the same object on later calls.
+func (f *artifactFanout) upload(src string) (*artifactObject, error) {
+	f.mu.Lock()
+	up, ok := f.uploads[src]
+	if !ok {
+		up = sync.OnceValues(func() (*artifactObject, error) {
+			return uploadArtifact(f.nc, src, f.secret)
+		})
+		f.uploads[src] = up
+	}
+	f.mu.Unlock()
+	return up()
+}
+
+// uploadArtifact encrypts src with its content key and stores it in
+// artifactBucket, unless a recent upload of the same content is there.
+// Objects are named by the content's SHA-256 and a fingerprint of the key,
+// so controllers with different secrets do not reuse each other's uploads.
+func uploadArtifact(nc *nats.Conn, src, secret string) (*artifactObject, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("open src: %v", err)
+	}
+	defer file.Close()
+
+	sum, keyHash := sha256.New(), security.ContentKey(secret)
+	size, err := io.Copy(io.MultiWriter(sum, keyHash), file)
+	if err != nil {
+		return nil, fmt.Errorf("calc checksum: %v", err)
+	}
+	obj := &artifactObject{checksum: hex.EncodeToString(sum.Sum(nil)), size: size, key: keyHash.Sum(nil)}
+	keyID := sha256.Sum256(obj.key)
+	obj.name = obj.checksum + "-" + hex.EncodeToString(keyID[:8])
+
+	ctx := context.Background()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	store, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      artifactBucket,
+		Description: "stapply artifacts by SHA-256",
+		TTL:         artifactBucketTTL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open object store %s: %w", artifactBucket, err)
+	}
+
+	if info, err := store.GetInfo(ctx, obj.name); err == nil && info.Size == uint64(size) && time.Since(info.ModTime) < artifactBucketTTL/2 {
+		fmt.Printf("            ☁️  %s already in object store %s (sha256 %s)\n", src, artifactBucket, obj.checksum[:12])
+		return obj, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	stream, err := security.ContentCipher(obj.key)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	meta := jetstream.ObjectMeta{Name: obj.name, Description: filepath.Base(src)}
+	if _, err := store.Put(ctx, meta, cipher.StreamReader{S: stream, R: file}); err != nil {
+		return nil, fmt.Errorf("upload to object store %s: %w", artifactBucket, err)
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("            ☁️  Uploaded %s (%s) to object store %s in %s (%.1f MB/s)\n",
+		src, formatBytes(size), artifactBucket, elapsed.Round(time.Millisecond), throughput(size, elapsed))
+	return obj, nil
+}
+
+// deploy uploads spec.src if no other host did yet and has the agent fetch
+// and install it, retrying the request as retry allows. It reports whether
+// dest changed.
+func (f *artifactFanout) deploy(client *agentClient, spec *artifactSpec, timeout time.Duration, retry retryPolicy) (bool, error) {
+	req, err := f.fetchRequest(spec)
+	if err != nil {
+		return false, err
+	}
+
+	// Downloads can take much longer than one request, so run it as a job
+	resp, err := runAsync(client, req, timeout, retry)
+	if err != nil {
+		return false, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return false, fmt.Errorf("%s", resp.Error)
+	}
+	fmt.Printf("            %s\n", resp.Stdout)
+	return resp.Changed, nil
+}
+
+// fetchRequest uploads spec.src if no other host did yet and returns the
+// fetch_artifact request that has an agent install it.
+func (f *artifactFanout) fetchRequest(spec *artifactSpec) (*protocol.RunRequest, error) {
+	obj, err := f.upload(spec.src)
+	if err != nil {
+		return nil, err
+	}
+
+	args := map[string]string{
+		"bucket":     artifactBucket,
+		"object":     obj.name,
+		"key":        hex.EncodeToString(obj.key),
+		"dest":       spec.dest,
+		"checksum":   obj.checksum,
+		"total_size": strconv.FormatInt(obj.size, 10),
+		"mode":       spec.mode,
+	}
+	if spec.owner != "" {
+		args["owner"] = spec.owner
+	}
+	if spec.releases > 0 {
+		args["releases"] = strconv.Itoa(spec.releases)
+	}
+	return protocol.NewRunRequest("fetch_artifact", args, int(f.jobTimeout/time.Millisecond), false), nil
+}
+
+// canFetch reports whether the agent can pull artifacts from the object store.
+func (f *artifactFanout) canFetch(client *agentClient) bool {
+	return f != nil && client.checkActions([]string{"fetch_artifact"}) == nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/drax2gma/stapply/internal/config"
+)
+
+// hostKey returns the encryption key for a host: the -sec flag if given, then
+// the host's key_env, then the environment's key_env, then the default key
+// (context key source or STAPPLY_SHARED_KEY). env may be nil. An empty
+// result means encryption is off.
+func (o *connOptions) hostKey(cfg *config.Config, env *config.Environment, hostID string) (string, error) {
+	if o.secretKey != "" {
+		return o.secretKey, nil
+	}
+
+	keyEnv := ""
+	if env != nil {
+		keyEnv = env.KeyEnv
+	}
+	if cfg != nil {
+		if host, ok := cfg.Hosts[hostID]; ok && host.KeyEnv != "" {
+			keyEnv = host.KeyEnv
+		}
+	}
+
+	if keyEnv == "" {
+		return o.key(), nil
+	}
+	key := os.Getenv(keyEnv)
+	if key == "" {
+		return "", fmt.Errorf("key_env %s is not set", keyEnv)
+	}
+	return key, nil
+}
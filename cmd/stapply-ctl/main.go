@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -9,14 +10,7 @@ import (
 	"strings"
 	"time"
 
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/hex"
-	"io"
-	"math"
-
 	"github.com/drax2gma/stapply/internal/config"
-	"github.com/drax2gma/stapply/internal/netutil"
 	"github.com/drax2gma/stapply/internal/protocol"
 	"github.com/drax2gma/stapply/internal/security"
 	"github.com/nats-io/nats.go"
@@ -24,6 +18,10 @@ import (
 
 var Version = "0.1.0-dev"
 
+// replyGrace is added to the request timeout when waiting for a run reply,
+// so the agent's own timeout response arrives before we give up.
+const replyGrace = 2 * time.Second
+
 func getDefaultNATSURL() string {
 	val := os.Getenv("STAPPLY_DEFAULT_NATS")
 	if val == "" {
@@ -106,6 +104,20 @@ func main() {
 		cmdInstallerCustom(os.Args[2:])
 	case "preflight":
 		cmdPreflight(os.Args[2:])
+	case "job":
+		cmdJob(os.Args[2:])
+	case "results":
+		cmdResults(os.Args[2:])
+	case "agents":
+		cmdAgents(os.Args[2:])
+	case "rotate-key":
+		cmdRotateKey(os.Args[2:])
+	case "rollback-artifact":
+		cmdRollbackArtifact(os.Args[2:])
+	case "keygen":
+		cmdKeygen(os.Args[2:])
+	case "context":
+		cmdContext(os.Args[2:])
 	case "version":
 		fmt.Printf("stapply-ctl version %s\n", Version)
 	case "help", "-h", "--help":
@@ -135,12 +147,19 @@ func printUsage() {
   %srun%s       -c <cfg> -e <env>      Execute full deployment plan
   %spreflight%s -c <cfg> -e <env>      Dry-run with system health checks
   %sadhoc%s     -e <target> <action>   Execute single ad-hoc action
-  %sping%s      <agent_id>             Check agent availability and version
+  %sping%s      <agent_id> | -c -e/-t  Check agent availability and version
   %sstatus%s    -c <cfg>               Validate and visualize configuration
 
 %sManagement Commands:%s
   %sdiscover%s  <agent_id>             Gather system facts from remote node
   %supdate%s    <agent_id>             Update agent to controller version
+  %sjob%s       <op> <agent_id> [id]   List, inspect or wait on agent jobs
+  %sresults%s   -c -e <run_id>         Collect results of a run queued with 'run -queued'
+  %sagents%s    [-c <cfg>] [-e <env>]  List live agents from their heartbeats
+  %srotate-key%s -c <cfg> -e <env>     Roll out a new encryption key
+  %srollback-artifact%s <agent_id> <dest>  Switch a release directory back one release
+  %skeygen%s    [-o <path>]            Create the controller's signing key
+  %scontext%s   <list|show|use> [name] Manage connection contexts (contexts.ini)
   %sinstaller%s                        Generate one-line installation command
   %sinstaller-custom%s                 Interactive installer generator
 
@@ -157,12 +176,19 @@ func printUsage() {
 		Cyan, Reset,
 		Cyan, Reset,
 		Cyan, Reset,
+		Cyan, Reset,
 		Bold, Reset,
 		Cyan, Reset,
 		Cyan, Reset,
 		Cyan, Reset,
 		Cyan, Reset,
 		Cyan, Reset,
+		Cyan, Reset,
+		Cyan, Reset,
+		Cyan, Reset,
+		Cyan, Reset,
+		Cyan, Reset,
+		Cyan, Reset,
 		Bold, Reset,
 		Cyan, Reset,
 		Cyan, Reset,
@@ -171,58 +197,58 @@ func printUsage() {
 
 func cmdPing(args []string) {
 	fs := flag.NewFlagSet("ping", flag.ExitOnError)
-	defaultNats := getDefaultNATSURL()
-	natsURL := fs.String("nats", defaultNats, "NATS server (FQDN or IP)")
-	allowPublic := fs.Bool("allow-public", false, "Allow connection to public NATS servers")
+	conn := connFlags(fs)
 	timeout := fs.Duration("timeout", 5*time.Second, "Request timeout")
-	secretKey := fs.String("sec", "", "Shared secret key for encryption")
+	configPath := fs.String("c", "", "Path to configuration file (ping every host of -e / -t)")
+	envName := fs.String("e", "", "Environment to ping (requires -c)")
+	tag := fs.String("t", "", "Only ping hosts with this tag (requires -c)")
+	output := fs.String("o", "text", "Output format: text or json")
 	fs.Parse(args)
 
-	if fs.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl ping <agent_id>")
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Error: unknown output format %q (expected text or json)\n", *output)
 		os.Exit(1)
 	}
 
-	agentID := fs.Arg(0)
-
-	// Default NATS URL to agent_id if not specified
-	if *natsURL == "" {
-		*natsURL = agentID
-	}
+	var agentID string
+	var targets []pingTarget
+	fallbackNats := "nats://localhost:4222"
+	if *configPath != "" {
+		if *envName == "" && *tag == "" {
+			fmt.Fprintln(os.Stderr, "Usage: stapply-ctl ping -c <config> (-e <env> | -t <tag>) [-o json]")
+			os.Exit(1)
+		}
+		targets = pingTargetsFromConfig(*configPath, *envName, *tag, conn)
+	} else {
+		if fs.NArg() < 1 {
+			fmt.Fprintln(os.Stderr, "Usage: stapply-ctl ping <agent_id>")
+			fmt.Fprintln(os.Stderr, "       stapply-ctl ping -c <config> (-e <env> | -t <tag>) [-o json]")
+			os.Exit(1)
+		}
+		agentID = fs.Arg(0)
 
-	// Validate NATS URL
-	*natsURL = netutil.NormalizeNATSURL(*natsURL)
-	if err := netutil.ValidateNATSURL(*natsURL, *allowPublic); err != nil {
-		log.Fatalf("NATS URL validation failed: %v", err)
+		// NATS defaults to agent_id if not configured
+		fallbackNats = agentID
+		if *output == "json" {
+			targets = []pingTarget{{hostID: agentID, agentID: agentID, key: conn.key()}}
+		}
 	}
 
-	// Connect to NATS
-	nc, err := nats.Connect(*natsURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to NATS: %v", err)
-	}
+	nc := conn.connect(fallbackNats)
 	defer nc.Close()
 
-	// Create ping request
-	req := protocol.NewPingRequest(Version)
-	data, err := json.Marshal(req)
-	if err != nil {
-		log.Fatalf("Failed to marshal request: %v", err)
-	}
-
-	// Send request
-	subject := "stapply.ping." + agentID
-	start := time.Now()
-
-	if *secretKey != "" {
-		var err error
-		data, err = security.Encrypt(data, *secretKey)
-		if err != nil {
-			log.Fatalf("Failed to encrypt request: %v", err)
+	if targets != nil {
+		if code := pingSweep(nc, targets, *timeout, *output); code != 0 {
+			nc.Close()
+			os.Exit(code)
 		}
+		return
 	}
 
-	msg, err := nc.Request(subject, data, *timeout)
+	// Send ping; this also negotiates the protocol version
+	client := newAgentClient(nc, agentID, conn.key())
+	start := time.Now()
+	resp, err := client.ping(*timeout)
 	rtt := time.Since(start)
 
 	if err != nil {
@@ -233,32 +259,30 @@ func cmdPing(args []string) {
 		log.Fatalf("Request failed: %v", err)
 	}
 
-	// Parse response
-	if *secretKey != "" {
-		var err error
-		msg.Data, err = security.Decrypt(msg.Data, *secretKey)
-		if err != nil {
-			log.Fatalf("Failed to decrypt response: %v", err)
-		}
-	}
-
-	var resp protocol.PingResponse
-	if err := json.Unmarshal(msg.Data, &resp); err != nil {
-		log.Fatalf("Failed to parse response: %v", err)
-	}
-
 	uptimeDur := time.Duration(resp.UptimeSeconds) * time.Second
 	fmt.Printf("✅ Agent %s: version=%s uptime=%s cpu=%.1f%% mem=%.1f%% rtt=%v\n",
 		resp.AgentID, resp.Version, uptimeDur, resp.CPUUsage, resp.MemoryUsage, rtt.Round(time.Millisecond))
+
+	if client.isLegacy() || resp.Capabilities == nil {
+		fmt.Println("   protocol:  v0 (legacy, no capability reporting)")
+		return
+	}
+	caps := resp.Capabilities
+	fmt.Printf("   protocol:  v%d\n", protocol.ProtocolVersion)
+	fmt.Printf("   actions:   %s\n", strings.Join(caps.Actions, ", "))
+	fmt.Printf("   encodings: %s\n", strings.Join(caps.Encodings, ", "))
+	if len(caps.Features) > 0 {
+		fmt.Printf("   features:  %s\n", strings.Join(caps.Features, ", "))
+	}
+	if len(caps.Compression) > 0 {
+		fmt.Printf("   compress:  %s\n", strings.Join(caps.Compression, ", "))
+	}
 }
 
 func cmdDiscover(args []string) {
 	fs := flag.NewFlagSet("discover", flag.ExitOnError)
-	defaultNats := getDefaultNATSURL()
-	natsURL := fs.String("nats", defaultNats, "NATS server (FQDN or IP)")
-	allowPublic := fs.Bool("allow-public", false, "Allow connection to public NATS servers")
+	conn := connFlags(fs)
 	timeout := fs.Duration("timeout", 5*time.Second, "Request timeout")
-	secretKey := fs.String("sec", "", "Shared secret key for encryption")
 	fs.Parse(args)
 
 	if fs.NArg() < 1 {
@@ -268,68 +292,23 @@ func cmdDiscover(args []string) {
 
 	agentID := fs.Arg(0)
 
-	// Default NATS URL to agent_id if not specified
-	if *natsURL == "" {
-		*natsURL = agentID
-	}
-
-	// Validate NATS URL
-	*natsURL = netutil.NormalizeNATSURL(*natsURL)
-	if err := netutil.ValidateNATSURL(*natsURL, *allowPublic); err != nil {
-		log.Fatalf("NATS URL validation failed: %v", err)
-	}
-
-	// Connect to NATS
-	nc, err := nats.Connect(*natsURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to NATS: %v", err)
-	}
+	// NATS defaults to agent_id if not configured
+	nc := conn.connect(agentID)
 	defer nc.Close()
 
-	// Create discover request
-	req := protocol.NewDiscoverRequest()
-	data, err := json.Marshal(req)
-	if err != nil {
-		log.Fatalf("Failed to marshal request: %v", err)
-	}
-
-	// Determine effective secret key
-	effectiveKey := *secretKey
-	if effectiveKey == "" {
-		effectiveKey = os.Getenv("STAPPLY_SHARED_KEY")
-	}
-
-	// Send request
-	if effectiveKey != "" {
-		var err error
-		data, err = security.Encrypt(data, effectiveKey)
-		if err != nil {
-			log.Fatalf("Failed to encrypt request: %v", err)
-		}
-	}
-
-	subject := "stapply.discover." + agentID
-	msg, err := nc.Request(subject, data, *timeout)
-	if err != nil {
-		if err == nats.ErrTimeout {
+	// Send discover request
+	client := newAgentClient(nc, agentID, conn.key())
+	var resp protocol.DiscoverResponse
+	if err := client.call(protocol.RequestTypeDiscover, protocol.NewDiscoverRequest(), &resp, *timeout); err != nil {
+		if errors.Is(err, nats.ErrTimeout) {
 			fmt.Printf("❌ Agent %s: timeout (no response within %s)\n", agentID, *timeout)
 			os.Exit(1)
 		}
 		log.Fatalf("Request failed: %v", err)
 	}
-
-	// Parse response
-	if effectiveKey != "" {
-		var err error
-		msg.Data, err = security.Decrypt(msg.Data, effectiveKey)
-		if err != nil {
-			log.Fatalf("Failed to decrypt response: %v", err)
-		}
-	}
-
-	var resp protocol.DiscoverResponse
-	if err := json.Unmarshal(msg.Data, &resp); err != nil {
-		log.Fatalf("Failed to parse response: %v", err)
+	if resp.Error != "" {
+		fmt.Printf("❌ Agent %s: %s\n", agentID, resp.Error)
+		os.Exit(1)
 	}
 
 	// Print facts
@@ -341,6 +320,12 @@ func cmdDiscover(args []string) {
 	fmt.Printf("Memory:      %d MB (Free: %d MB)\n", resp.MemoryTotal/1024/1024, resp.MemoryFree/1024/1024)
 	fmt.Printf("Root Disk:   %d%% Used\n", resp.DiskUsageRoot)
 	fmt.Printf("IP Addrs:    %s\n", strings.Join(resp.IPAddresses, ", "))
+	if pub := client.identityKey(); pub != "" {
+		fmt.Printf("Identity:    %s\n", security.Fingerprint(pub))
+		fmt.Printf("Public Key:  %s\n", pub)
+	} else {
+		fmt.Printf("Identity:    ⚠️  unsigned (agent predates response signing)\n")
+	}
 	fmt.Println()
 }
 
@@ -348,24 +333,13 @@ func cmdAdhoc(args []string) {
 	fs := flag.NewFlagSet("adhoc", flag.ExitOnError)
 	configPath := fs.String("c", "", "Path to configuration file")
 	envName := fs.String("e", "", "Environment name")
-
-	defaultNats := getDefaultNATSURL()
-	if defaultNats == "" {
-		defaultNats = "nats://localhost:4222"
-	}
-	natsURL := fs.String("nats", defaultNats, "NATS server URL")
-
-	allowPublic := fs.Bool("allow-public", false, "Allow connection to public NATS servers")
+	conn := connFlags(fs)
 	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout")
-	secretKey := fs.String("sec", "", "Shared secret key for encryption")
+	stream := fs.Bool("stream", true, "Print command output live as it is produced")
+	outputLimit := fs.Int("output-limit", protocol.DefaultOutputLimit, "Max bytes of stdout/stderr each returned per step (rest is fetchable with 'job output')")
+	retry := retryFlags(fs)
 	fs.Parse(args)
 
-	// Validate NATS URL
-	*natsURL = netutil.NormalizeNATSURL(*natsURL)
-	if err := netutil.ValidateNATSURL(*natsURL, *allowPublic); err != nil {
-		log.Fatalf("NATS URL validation failed: %v", err)
-	}
-
 	if *envName == "" {
 		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl adhoc [-c <config>] -e <env|agent_id> <action> <args...>")
 		os.Exit(1)
@@ -383,6 +357,8 @@ func cmdAdhoc(args []string) {
 	// Two modes: with config (multi-host environment) or without config (single agent)
 	var hosts []string
 	var cfg *config.Config
+	var adhocEnv *config.Environment
+	fallbackNats := "nats://localhost:4222"
 
 	if *configPath != "" {
 		// Config mode: load environment from config file
@@ -402,26 +378,34 @@ func cmdAdhoc(args []string) {
 			log.Fatalf("Environment not found: %s", *envName)
 		}
 		hosts = env.Hosts
-
-		// Determine effective secret key
-		if *secretKey == "" {
-			*secretKey = os.Getenv("STAPPLY_SHARED_KEY")
-		}
+		adhocEnv = env
 	} else {
 		// Direct mode: treat envName as agent_id
 		hosts = []string{*envName}
 
-		// Default NATS to agent_id if not specified
-		if *natsURL == "nats://localhost:4222" {
-			*natsURL = netutil.NormalizeNATSURL(*envName)
-		}
+		// NATS defaults to agent_id if not configured
+		fallbackNats = *envName
 	}
 
 	// Build args map based on action type
 	stepArgs := make(map[string]string)
+	var artifact *artifactSpec
 	switch action {
 	case "cmd":
 		stepArgs["command"] = actionArgs
+	case "deploy_artifact":
+		// Same syntax as the step: <dest> src=... [mode=...] [owner=...] [releases=N]
+		artifactArgs, err := config.ParseArtifactArgs(actionArgs)
+		if err == nil {
+			artifact, err = parseArtifactSpec(artifactArgs)
+		}
+		if err == nil {
+			err = checkArtifactSrc(artifact.src)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: deploy_artifact: %v\n", err)
+			os.Exit(1)
+		}
 	case "systemd":
 		parts := strings.Fields(actionArgs)
 		if len(parts) >= 1 {
@@ -434,11 +418,7 @@ func cmdAdhoc(args []string) {
 		stepArgs["args"] = actionArgs
 	}
 
-	// Connect to NATS
-	nc, err := nats.Connect(*natsURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to NATS: %v", err)
-	}
+	nc := conn.connect(fallbackNats)
 	defer nc.Close()
 
 	fmt.Printf("🚀 Ad-hoc: %s %s\n", action, actionArgs)
@@ -459,20 +439,33 @@ func cmdAdhoc(args []string) {
 	}
 
 	type result struct {
-		ok      int
-		changed int
-		failed  int
+		ok        int
+		changed   int
+		failed    int
+		cancelled int
 	}
 	resultCh := make(chan result, len(hosts))
 	semaphore := make(chan struct{}, concurrency)
 
+	// Ctrl-C cancels whatever is still running on the agents
+	cancels := newCanceller()
+	defer cancels.stop()
+	retry.interrupted = cancels.interrupted
+
 	for _, hostID := range hosts {
 		semaphore <- struct{}{}
 
+		if cancels.interrupted() {
+			// Don't dispatch to hosts that haven't started yet
+			<-semaphore
+			resultCh <- result{}
+			continue
+		}
+
 		go func(hID string) {
 			defer func() { <-semaphore }()
 
-			var ok, changed, failed int
+			var ok, changed, failed, cancelled int
 
 			// Get agent_id
 			var agentID string
@@ -494,49 +487,63 @@ func cmdAdhoc(args []string) {
 
 			fmt.Printf("📦 Host: %s (agent_id=%s)\n", hID, agentID)
 
-			req := protocol.NewRunRequest(action, stepArgs, int(*timeout/time.Millisecond), false)
-			data, err := json.Marshal(req)
+			key, err := conn.hostKey(cfg, adhocEnv, hID)
 			if err != nil {
-				fmt.Printf("   ❌ Marshal error: %v\n", err)
+				fmt.Printf("   ❌ %v\n", err)
 				resultCh <- result{failed: 1}
 				return
 			}
 
-			if *secretKey != "" {
-				var err error
-				data, err = security.Encrypt(data, *secretKey)
-				if err != nil {
-					fmt.Printf("   ❌ Encrypt error: %v\n", err)
-					resultCh <- result{failed: 1}
-					return
-				}
+			client := newAgentClient(nc, agentID, key)
+			if err := negotiateActions(client, []string{action}, *timeout); err != nil {
+				fmt.Printf("   ❌ %v\n", err)
+				resultCh <- result{failed: 1}
+				return
 			}
 
-			subject := "stapply.run." + agentID
-			msg, err := nc.Request(subject, data, *timeout)
-			if err != nil {
-				if err == nats.ErrTimeout {
-					fmt.Printf("   ❌ Timeout\n")
-				} else {
-					fmt.Printf("   ❌ Error: %v\n", err)
+			if artifact != nil {
+				artifactChanged, err := runDeployArtifact(client, artifact, *timeout, *retry)
+				switch {
+				case err != nil:
+					fmt.Printf("   ❌ Artifact deployment failed: %v\n", err)
+					failed++
+				case artifactChanged:
+					fmt.Printf("   ✅ Artifact deployed successfully\n")
+					changed++
+				default:
+					fmt.Printf("   ✅ OK (artifact unchanged)\n")
+					ok++
 				}
-				resultCh <- result{failed: 1}
+				resultCh <- result{ok: ok, changed: changed, failed: failed}
 				return
 			}
 
-			var resp protocol.RunResponse
-			if *secretKey != "" {
-				var err error
-				msg.Data, err = security.Decrypt(msg.Data, *secretKey)
+			req := protocol.NewRunRequest(action, stepArgs, int(*timeout/time.Millisecond), false)
+			req.OutputLimit = *outputLimit
+
+			// Start following live output before sending so no line is missed
+			stopStream := func() {}
+			if *stream && action == "cmd" && client.supports(protocol.FeatureStream) {
+				stop, err := followStream(client, req.RequestID, hID, "   ")
 				if err != nil {
-					fmt.Printf("   ❌ Decrypt error: %v\n", err)
-					resultCh <- result{failed: 1}
-					return
+					fmt.Printf("   ⚠️  Live output unavailable: %v\n", err)
+				} else {
+					req.Stream = true
+					stopStream = stop
 				}
 			}
 
-			if err := json.Unmarshal(msg.Data, &resp); err != nil {
-				fmt.Printf("   ❌ Response parse error: %v\n", err)
+			var resp protocol.RunResponse
+			untrack := cancels.track(req.RequestID, hID, client)
+			err = client.callRun(req, &resp, *timeout+replyGrace, *retry, "   ")
+			untrack()
+			stopStream()
+			if err != nil {
+				if errors.Is(err, nats.ErrTimeout) {
+					fmt.Printf("   ❌ Timeout\n")
+				} else {
+					fmt.Printf("   ❌ Error: %v\n", err)
+				}
 				resultCh <- result{failed: 1}
 				return
 			}
@@ -545,43 +552,62 @@ func cmdAdhoc(args []string) {
 			case protocol.StatusOK:
 				if resp.Changed {
 					fmt.Printf("   ✅ Changed (%dms)\n", resp.DurationMs)
-					if resp.Stdout != "" {
+					if resp.Stdout != "" && !req.Stream {
 						fmt.Printf("   %s\n", strings.TrimSpace(resp.Stdout))
 					}
 					changed++
 				} else {
 					fmt.Printf("   ✅ OK (%dms)\n", resp.DurationMs)
-					if resp.Stdout != "" {
+					if resp.Stdout != "" && !req.Stream {
 						fmt.Printf("   %s\n", strings.TrimSpace(resp.Stdout))
 					}
 					ok++
 				}
 			case protocol.StatusFailed:
 				fmt.Printf("   ❌ Failed (exit=%d)\n", resp.ExitCode)
-				if resp.Stderr != "" {
+				if resp.Stderr != "" && !req.Stream {
 					fmt.Printf("   %s\n", strings.TrimSpace(resp.Stderr))
 				}
 				failed++
+			case protocol.StatusTimeout:
+				fmt.Printf("   ⏱️  Timeout: %s\n", resp.Error)
+				if resp.Stderr != "" && !req.Stream {
+					fmt.Printf("   %s\n", strings.TrimSpace(resp.Stderr))
+				}
+				failed++
+			case protocol.StatusCancelled:
+				fmt.Printf("   🛑 Cancelled (%dms)\n", resp.DurationMs)
+				cancelled++
 			case protocol.StatusError:
 				fmt.Printf("   ❌ Error: %s\n", resp.Error)
 				failed++
+			case protocol.StatusDenied:
+				fmt.Printf("   ⛔ Denied by agent policy: %s\n", resp.Error)
+				failed++
 			}
+			printTruncated("   ", agentID, req.RequestID, &resp)
 
-			resultCh <- result{ok: ok, changed: changed, failed: failed}
+			resultCh <- result{ok: ok, changed: changed, failed: failed, cancelled: cancelled}
 		}(hostID)
 	}
 
 	// Wait for all hosts to complete
-	var okCount, changedCount, failedCount int
+	var okCount, changedCount, failedCount, cancelledCount int
 	for i := 0; i < len(hosts); i++ {
 		r := <-resultCh
 		okCount += r.ok
 		changedCount += r.changed
 		failedCount += r.failed
+		cancelledCount += r.cancelled
 	}
 
 	fmt.Println()
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	if cancels.interrupted() {
+		fmt.Printf("Summary (interrupted, partial): ok=%d changed=%d failed=%d cancelled=%d\n",
+			okCount, changedCount, failedCount, cancelledCount)
+		os.Exit(130)
+	}
 	fmt.Printf("Summary: ok=%d changed=%d failed=%d\n", okCount, changedCount, failedCount)
 
 	if failedCount > 0 {
@@ -593,24 +619,17 @@ func cmdRun(args []string) {
 	fs := flag.NewFlagSet("run", flag.ExitOnError)
 	configPath := fs.String("c", "", "Path to configuration file")
 	envName := fs.String("e", "", "Environment name")
-
-	defaultNats := getDefaultNATSURL()
-	if defaultNats == "" {
-		defaultNats = "nats://localhost:4222"
-	}
-	natsURL := fs.String("nats", defaultNats, "NATS server URL")
-
-	allowPublic := fs.Bool("allow-public", false, "Allow connection to public NATS servers")
+	conn := connFlags(fs)
 	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout")
-	secretKey := fs.String("sec", "", "Shared secret key for encryption")
+	stream := fs.Bool("stream", true, "Print command output live as it is produced")
+	outputLimit := fs.Int("output-limit", protocol.DefaultOutputLimit, "Max bytes of stdout/stderr each returned per step (rest is fetchable with 'job output')")
+	async := fs.Bool("async", false, "Run steps as agent-side jobs and poll for results")
+	jobTimeout := fs.Duration("job-timeout", time.Hour, "Maximum run time of a step with -async or -queued, or of an artifact download with -fanout (0 = unlimited)")
+	fanout := fs.Bool("fanout", false, "Upload artifacts once to the JetStream object store and have agents pull them")
+	queued := fs.Bool("queued", false, "Queue the steps in JetStream for agents to run when connected, and return (see 'results')")
+	retry := retryFlags(fs)
 	fs.Parse(args)
 
-	// Validate NATS URL
-	*natsURL = netutil.NormalizeNATSURL(*natsURL)
-	if err := netutil.ValidateNATSURL(*natsURL, *allowPublic); err != nil {
-		log.Fatalf("NATS URL validation failed: %v", err)
-	}
-
 	if *configPath == "" || *envName == "" {
 		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl run -c <config> -e <env>")
 		os.Exit(1)
@@ -633,13 +652,23 @@ func cmdRun(args []string) {
 		log.Fatalf("Environment not found: %s", *envName)
 	}
 
-	// Connect to NATS
-	nc, err := nats.Connect(*natsURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to NATS: %v", err)
-	}
+	nc := conn.connect("nats://localhost:4222")
 	defer nc.Close()
 
+	if *queued {
+		runQueued(nc, cfg, env, *configPath, *envName, conn, *jobTimeout, *outputLimit)
+		return
+	}
+
+	var fan *artifactFanout
+	if *fanout {
+		secret, err := conn.hostKey(cfg, env, "")
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fan = newArtifactFanout(nc, *jobTimeout, secret)
+	}
+
 	fmt.Printf("🚀 Executing environment: %s\n", *envName)
 	fmt.Printf("   Hosts: %v\n", env.Hosts)
 	fmt.Printf("   Apps: %v\n", env.Apps)
@@ -653,31 +682,37 @@ func cmdRun(args []string) {
 
 	// Channel for collecting results
 	type result struct {
-		ok      int
-		changed int
-		failed  int
+		ok        int
+		changed   int
+		failed    int
+		cancelled int
 	}
 	resultCh := make(chan result, len(env.Hosts))
 
 	// Semaphore for concurrency control
 	semaphore := make(chan struct{}, concurrency)
 
+	// Ctrl-C cancels whatever is still running on the agents
+	cancels := newCanceller()
+	defer cancels.stop()
+	retry.interrupted = cancels.interrupted
+
 	// Execute hosts in parallel
 	for _, hostID := range env.Hosts {
 		// Acquire semaphore
 		semaphore <- struct{}{}
 
-		// Determine effective secret key for this run
-		// Priority: 1. Flag, 2. Env Var
-		effectiveKey := *secretKey
-		if effectiveKey == "" {
-			effectiveKey = os.Getenv("STAPPLY_SHARED_KEY")
+		if cancels.interrupted() {
+			// Don't dispatch to hosts that haven't started yet
+			<-semaphore
+			resultCh <- result{}
+			continue
 		}
 
-		go func(hID, key string) {
+		go func(hID string) {
 			defer func() { <-semaphore }() // Release semaphore
 
-			var ok, changed, failed int
+			var ok, changed, failed, cancelled int
 
 			host, exists := cfg.Hosts[hID]
 			if !exists {
@@ -693,7 +728,28 @@ func cmdRun(args []string) {
 
 			fmt.Printf("📦 Host: %s (agent_id=%s)\n", hID, agentID)
 
+			// Priority: 1. Flag, 2. host/env key_env, 3. STAPPLY_SHARED_KEY
+			key, err := conn.hostKey(cfg, env, hID)
+			if err != nil {
+				fmt.Printf("   ❌ %v\n", err)
+				resultCh <- result{failed: 1}
+				return
+			}
+
+			client := newAgentClient(nc, agentID, key)
+			if err := negotiateActions(client, envActions(cfg, env.Apps), *timeout); err != nil {
+				fmt.Printf("   ❌ %v\n", err)
+				resultCh <- result{failed: 1}
+				return
+			}
+			if *async && !client.supports(protocol.FeatureJobs) {
+				fmt.Printf("   ❌ Agent %s does not support -async; run 'stapply-ctl update %s'\n", agentID, agentID)
+				resultCh <- result{failed: 1}
+				return
+			}
+
 			// Execute each app
+		apps:
 			for _, appName := range env.Apps {
 				app, appExists := cfg.Apps[appName]
 				if !appExists {
@@ -706,7 +762,11 @@ func cmdRun(args []string) {
 
 				steps := app.GetOrderedSteps()
 				for i, step := range steps {
+					if cancels.interrupted() {
+						break apps
+					}
 					fmt.Printf("      Step %d: %s\n", i+1, step.Action)
+					stepRetry := retry.forStep(step)
 
 					// Use parsed args from step
 					stepArgs := step.ArgsMap
@@ -714,77 +774,73 @@ func cmdRun(args []string) {
 						stepArgs = make(map[string]string)
 					}
 
-					if step.Action == "cmd" {
-						cmdStr := stepArgs["command"]
-						if strings.HasPrefix(cmdStr, "STAPPLY_ACTION: deploy_artifact") {
-							// Parse args from string: src=... dest=...
-							kvText := strings.TrimPrefix(cmdStr, "STAPPLY_ACTION: deploy_artifact ")
-							artifactArgs := parseKVString(kvText)
-
-							src := artifactArgs["src"]
-							dest := artifactArgs["dest"]
-
-							if src == "" || dest == "" {
-								fmt.Printf("         ❌ Invalid deploy_artifact args: %s\n", kvText)
-								failed++
-								continue
-							}
-
-							fmt.Printf("         📦 Deploying artifact: %s -> %s\n", src, dest)
-
-							if err := runDeployArtifact(nc, agentID, src, dest, *timeout, key); err != nil {
-								fmt.Printf("         ❌ Artifact deployment failed: %v\n", err)
-								failed++
-							} else {
-								fmt.Printf("         ✅ Artifact deployed successfully\n")
-							}
+					if artifactArgs, isArtifact := artifactStepArgs(step.Action, stepArgs); isArtifact {
+						spec, err := parseArtifactSpec(artifactArgs)
+						if err != nil {
+							fmt.Printf("         ❌ Invalid deploy_artifact args: %v\n", err)
+							failed++
 							continue
 						}
-					}
 
-					req := protocol.NewRunRequest(step.Action, stepArgs, int(*timeout/time.Millisecond), false)
-					data, err := json.Marshal(req)
-					if err != nil {
-						fmt.Printf("         ❌ Marshal error: %v\n", err)
-						failed++
-						continue
-					}
+						fmt.Printf("         📦 Deploying artifact: %s -> %s\n", spec.src, spec.dest)
 
-					if key != "" {
-						var err error
-						data, err = security.Encrypt(data, key)
-						if err != nil {
-							fmt.Printf("         ❌ Encrypt error: %v\n", err)
+						var artifactChanged bool
+						if fan.canFetch(client) {
+							artifactChanged, err = fan.deploy(client, spec, *timeout, stepRetry)
+						} else {
+							artifactChanged, err = runDeployArtifact(client, spec, *timeout, stepRetry)
+						}
+						switch {
+						case err != nil:
+							fmt.Printf("         ❌ Artifact deployment failed: %v\n", err)
 							failed++
-							continue
+						case artifactChanged:
+							fmt.Printf("         ✅ Artifact deployed successfully\n")
+							changed++
+						default:
+							fmt.Printf("         ✅ OK (artifact unchanged)\n")
+							ok++
 						}
+						continue
 					}
 
-					subject := "stapply.run." + agentID
-					msg, err := nc.Request(subject, data, *timeout)
-					if err != nil {
-						if err == nats.ErrTimeout {
-							fmt.Printf("         ❌ Timeout\n")
+					req := protocol.NewRunRequest(step.Action, stepArgs, int(*timeout/time.Millisecond), false)
+					req.OutputLimit = *outputLimit
+
+					// Start following live output before sending so no line is missed
+					stopStream := func() {}
+					if *stream && step.Action == "cmd" && client.supports(protocol.FeatureStream) {
+						stop, err := followStream(client, req.RequestID, hID, "         ")
+						if err != nil {
+							fmt.Printf("         ⚠️  Live output unavailable: %v\n", err)
 						} else {
-							fmt.Printf("         ❌ Error: %v\n", err)
+							req.Stream = true
+							stopStream = stop
 						}
-						failed++
-						continue
 					}
 
 					var resp protocol.RunResponse
-					if key != "" {
-						var err error
-						msg.Data, err = security.Decrypt(msg.Data, key)
-						if err != nil {
-							fmt.Printf("         ❌ Decrypt error: %v\n", err)
-							failed++
-							continue
+					var err error
+					untrack := cancels.track(req.RequestID, hID, client)
+					if *async {
+						// Run as a background job; -timeout bounds each poll only
+						req.TimeoutMs = int(*jobTimeout / time.Millisecond)
+						var jobResp *protocol.RunResponse
+						jobResp, err = runAsync(client, req, *timeout, stepRetry)
+						if err == nil {
+							resp = *jobResp
 						}
+					} else {
+						err = client.callRun(req, &resp, *timeout+replyGrace, stepRetry, "         ")
 					}
-
-					if err := json.Unmarshal(msg.Data, &resp); err != nil {
-						fmt.Printf("         ❌ Response parse error: %v\n", err)
+					untrack()
+					stopStream()
+					if err != nil {
+						if errors.Is(err, nats.ErrTimeout) {
+							fmt.Printf("         ❌ Timeout\n")
+						} else {
+							fmt.Printf("         ❌ Error: %v\n", err)
+						}
 						failed++
 						continue
 					}
@@ -799,31 +855,51 @@ func cmdRun(args []string) {
 							ok++
 						}
 					case protocol.StatusFailed:
-						fmt.Printf("         ❌ Failed (exit=%d): %s\n", resp.ExitCode, resp.Stderr)
+						if req.Stream {
+							fmt.Printf("         ❌ Failed (exit=%d)\n", resp.ExitCode)
+						} else {
+							fmt.Printf("         ❌ Failed (exit=%d): %s\n", resp.ExitCode, resp.Stderr)
+						}
+						failed++
+					case protocol.StatusTimeout:
+						fmt.Printf("         ⏱️  Timeout: %s\n", resp.Error)
 						failed++
+					case protocol.StatusCancelled:
+						fmt.Printf("         🛑 Cancelled (%dms)\n", resp.DurationMs)
+						cancelled++
 					case protocol.StatusError:
 						fmt.Printf("         ❌ Error: %s\n", resp.Error)
 						failed++
+					case protocol.StatusDenied:
+						fmt.Printf("         ⛔ Denied by agent policy: %s\n", resp.Error)
+						failed++
 					}
+					printTruncated("         ", agentID, req.RequestID, &resp)
 				}
 			}
 			fmt.Println()
 
-			resultCh <- result{ok: ok, changed: changed, failed: failed}
-		}(hostID, effectiveKey)
+			resultCh <- result{ok: ok, changed: changed, failed: failed, cancelled: cancelled}
+		}(hostID)
 	}
 
 	// Wait for all hosts to complete
-	var okCount, changedCount, failedCount int
+	var okCount, changedCount, failedCount, cancelledCount int
 	for i := 0; i < len(env.Hosts); i++ {
 		r := <-resultCh
 		okCount += r.ok
 		changedCount += r.changed
 		failedCount += r.failed
+		cancelledCount += r.cancelled
 	}
 
 	// Print summary
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	if cancels.interrupted() {
+		fmt.Printf("Summary (interrupted, partial): ok=%d changed=%d failed=%d cancelled=%d\n",
+			okCount, changedCount, failedCount, cancelledCount)
+		os.Exit(130)
+	}
 	fmt.Printf("Summary: ok=%d changed=%d failed=%d\n", okCount, changedCount, failedCount)
 
 	if failedCount > 0 {
@@ -835,27 +911,9 @@ func cmdPreflight(args []string) {
 	fs := flag.NewFlagSet("preflight", flag.ExitOnError)
 	configPath := fs.String("c", "", "Path to configuration file")
 	envName := fs.String("e", "", "Environment name")
-
-	defaultNats := getDefaultNATSURL()
-	if defaultNats == "" {
-		defaultNats = "nats://localhost:4222"
-	}
-	natsURL := fs.String("nats", defaultNats, "NATS server URL")
-
-	allowPublic := fs.Bool("allow-public", false, "Allow connection to public NATS servers")
+	conn := connFlags(fs)
 	timeout := fs.Duration("timeout", 30*time.Second, "Request timeout")
-	secretKey := fs.String("sec", "", "Shared secret key for encryption")
-	// Determine effective secret key
-	effectiveKey := *secretKey
-	if effectiveKey == "" {
-		effectiveKey = os.Getenv("STAPPLY_SHARED_KEY")
-	}
-
-	// Validate NATS URL
-	*natsURL = netutil.NormalizeNATSURL(*natsURL)
-	if err := netutil.ValidateNATSURL(*natsURL, *allowPublic); err != nil {
-		log.Fatalf("NATS URL validation failed: %v", err)
-	}
+	fs.Parse(args)
 
 	if *configPath == "" || *envName == "" {
 		fmt.Fprintln(os.Stderr, "Usage: stapply-ctl preflight -c <config> -e <env>")
@@ -879,11 +937,7 @@ func cmdPreflight(args []string) {
 		log.Fatalf("Environment not found: %s", *envName)
 	}
 
-	// Connect to NATS
-	nc, err := nats.Connect(*natsURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to NATS: %v", err)
-	}
+	nc := conn.connect("nats://localhost:4222")
 	defer nc.Close()
 
 	fmt.Printf("🛡️  Preflight Check: %s\n", *envName)
@@ -912,46 +966,23 @@ func cmdPreflight(args []string) {
 				agentID = hID
 			}
 
-			// Send Discover Request
-			req := protocol.NewDiscoverRequest()
-			data, err := json.Marshal(req)
+			key, err := conn.hostKey(cfg, env, hID)
 			if err != nil {
-				fmt.Printf("   ❌ [%s] Marshal error: %v\n", hID, err)
+				fmt.Printf("   ❌ [%s] %v\n", hID, err)
 				healthCh <- hostHealth{hID, false}
 				return
 			}
 
-			if effectiveKey != "" {
-				var err error
-				data, err = security.Encrypt(data, *secretKey)
-				if err != nil {
-					fmt.Printf("   ❌ [%s] Encrypt error: %v\n", hID, err)
-					healthCh <- hostHealth{hID, false}
-					return
-				}
-			}
-
-			subject := "stapply.discover." + agentID
-			msg, err := nc.Request(subject, data, *timeout)
-			if err != nil {
+			// Send Discover Request
+			client := newAgentClient(nc, agentID, key)
+			var resp protocol.DiscoverResponse
+			if err := client.call(protocol.RequestTypeDiscover, protocol.NewDiscoverRequest(), &resp, *timeout); err != nil {
 				fmt.Printf("   ❌ [%s] Discovery failed: %v\n", hID, err)
 				healthCh <- hostHealth{hID, false}
 				return
 			}
-
-			var resp protocol.DiscoverResponse
-			if effectiveKey != "" {
-				var err error
-				msg.Data, err = security.Decrypt(msg.Data, effectiveKey)
-				if err != nil {
-					fmt.Printf("   ❌ [%s] Decrypt error: %v\n", hID, err)
-					healthCh <- hostHealth{hID, false}
-					return
-				}
-			}
-
-			if err := json.Unmarshal(msg.Data, &resp); err != nil {
-				fmt.Printf("   ❌ [%s] Response parse error: %v\n", hID, err)
+			if resp.Error != "" {
+				fmt.Printf("   ❌ [%s] Discovery failed: %s\n", hID, resp.Error)
 				healthCh <- hostHealth{hID, false}
 				return
 			}
@@ -1021,6 +1052,20 @@ func cmdPreflight(args []string) {
 
 			fmt.Printf("📦 Host: %s\n", hID)
 
+			key, err := conn.hostKey(cfg, env, hID)
+			if err != nil {
+				fmt.Printf("   ❌ %v\n", err)
+				resultCh <- result{failed: 1}
+				return
+			}
+
+			client := newAgentClient(nc, agentID, key)
+			if err := negotiateActions(client, envActions(cfg, env.Apps), *timeout); err != nil {
+				fmt.Printf("   ❌ %v\n", err)
+				resultCh <- result{failed: 1}
+				return
+			}
+
 			for _, appName := range env.Apps {
 				app, appExists := cfg.Apps[appName]
 				if !appExists {
@@ -1050,46 +1095,27 @@ func cmdPreflight(args []string) {
 						stepArgs = mergedArgs
 					}
 
-					// DRY RUN REQUEST
-					req := protocol.NewRunRequest(step.Action, stepArgs, int(*timeout/time.Millisecond), true)
-					data, err := json.Marshal(req)
-					if err != nil {
-						fmt.Printf("      ❌ Marshal error: %v\n", err)
-						failed++
-						continue
-					}
-
-					if effectiveKey != "" {
-						var err error
-						data, err = security.Encrypt(data, effectiveKey)
+					// Artifacts are sent by the controller, so their source must exist here
+					if artifactArgs, isArtifact := artifactStepArgs(step.Action, stepArgs); isArtifact {
+						spec, err := parseArtifactSpec(artifactArgs)
+						if err == nil {
+							err = checkArtifactSrc(spec.src)
+						}
 						if err != nil {
-							fmt.Printf("      ❌ Encrypt error: %v\n", err)
+							fmt.Printf("      ❌ Step %d: deploy_artifact: %v\n", i+1, err)
 							failed++
-							continue
+						} else {
+							fmt.Printf("      ✅ Step %d: Would deploy %s to %s (OK)\n", i+1, spec.src, spec.dest)
+							ok++
 						}
-					}
-
-					subject := "stapply.run." + agentID
-					msg, err := nc.Request(subject, data, *timeout)
-					if err != nil {
-						fmt.Printf("      ❌ Step %d (%s): Request failed: %v\n", i+1, step.Action, err)
-						failed++
 						continue
 					}
 
+					// DRY RUN REQUEST
+					req := protocol.NewRunRequest(step.Action, stepArgs, int(*timeout/time.Millisecond), true)
 					var resp protocol.RunResponse
-					if effectiveKey != "" {
-						var err error
-						msg.Data, err = security.Decrypt(msg.Data, effectiveKey)
-						if err != nil {
-							fmt.Printf("      ❌ Decrypt error: %v\n", err)
-							failed++
-							continue
-						}
-					}
-
-					if err := json.Unmarshal(msg.Data, &resp); err != nil {
-						fmt.Printf("      ❌ Step %d: Response error: %v\n", i+1, err)
+					if err := client.call(protocol.RequestTypeRun, req, &resp, *timeout+replyGrace); err != nil {
+						fmt.Printf("      ❌ Step %d (%s): Request failed: %v\n", i+1, step.Action, err)
 						failed++
 						continue
 					}
@@ -1106,9 +1132,15 @@ func cmdPreflight(args []string) {
 					case protocol.StatusFailed:
 						fmt.Printf("      ❌ Step %d: Failed: %s\n", i+1, resp.Stderr)
 						failed++
+					case protocol.StatusTimeout:
+						fmt.Printf("      ⏱️  Step %d: Timeout: %s\n", i+1, resp.Error)
+						failed++
 					case protocol.StatusError:
 						fmt.Printf("      ❌ Step %d: Error: %s\n", i+1, resp.Error)
 						failed++
+					case protocol.StatusDenied:
+						fmt.Printf("      ⛔ Step %d: Denied by agent policy: %s\n", i+1, resp.Error)
+						failed++
 					}
 				}
 			}
@@ -1147,97 +1179,3 @@ func parseKVString(s string) map[string]string {
 	}
 	return m
 }
-
-func runDeployArtifact(nc *nats.Conn, agentID, src, dest string, timeout time.Duration, secretKey string) error {
-	// 1. Open local file
-	f, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("open src: %v", err)
-	}
-	defer f.Close()
-
-	stat, err := f.Stat()
-	if err != nil {
-		return fmt.Errorf("stat src: %v", err)
-	}
-	totalSize := stat.Size()
-
-	// 2. Calculate Checksum
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return fmt.Errorf("calc checksum: %v", err)
-	}
-	checksum := hex.EncodeToString(h.Sum(nil))
-
-	// Reset file pointer
-	if _, err := f.Seek(0, 0); err != nil {
-		return fmt.Errorf("seek: %v", err)
-	}
-
-	// 3. Chunking Loop
-	const chunkSize = 10 * 1024 * 1024 // 10MB
-	totalChunks := int(math.Ceil(float64(totalSize) / float64(chunkSize)))
-
-	buf := make([]byte, chunkSize)
-	for i := 0; i < totalChunks; i++ {
-		n, err := f.Read(buf)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("read chunk %d: %v", i, err)
-		}
-		if n == 0 {
-			break
-		}
-
-		chunkData := buf[:n]
-		encoded := base64.StdEncoding.EncodeToString(chunkData)
-
-		args := map[string]string{
-			"dest":         dest,
-			"chunk_index":  fmt.Sprintf("%d", i),
-			"total_chunks": fmt.Sprintf("%d", totalChunks),
-			"total_size":   fmt.Sprintf("%d", totalSize),
-			"checksum":     checksum,
-			"chunk_data":   encoded,
-			"mode":         "0755", // Default executable
-		}
-
-		req := protocol.NewRunRequest("deploy_artifact", args, int(timeout/time.Millisecond), false)
-		data, err := json.Marshal(req)
-		if err != nil {
-			return fmt.Errorf("marshal chunk %d: %v", i, err)
-		}
-
-		if secretKey != "" {
-			data, err = security.Encrypt(data, secretKey)
-			if err != nil {
-				return fmt.Errorf("encrypt chunk %d: %v", i, err)
-			}
-		}
-
-		subject := "stapply.run." + agentID
-		msg, err := nc.Request(subject, data, timeout)
-		if err != nil {
-			return fmt.Errorf("send chunk %d: %v", i, err)
-		}
-
-		var resp protocol.RunResponse
-		if secretKey != "" {
-			msg.Data, err = security.Decrypt(msg.Data, secretKey)
-			if err != nil {
-				return fmt.Errorf("decrypt chunk %d response: %v", i, err)
-			}
-		}
-
-		if err := json.Unmarshal(msg.Data, &resp); err != nil {
-			return fmt.Errorf("parse chunk %d response: %v", i, err)
-		}
-
-		if resp.Status != protocol.StatusOK {
-			return fmt.Errorf("chunk %d failed: %s (stderr: %s)", i, resp.Error, resp.Stderr)
-		}
-
-		fmt.Printf("            Sent chunk %d/%d (%d bytes)\r", i+1, totalChunks, n)
-	}
-	fmt.Println() // Newline after progress
-	return nil
-}
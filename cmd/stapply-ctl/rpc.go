@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/config"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/security"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// controllerID identifies this controller as the sender of its envelopes.
+var controllerID = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "stapply-ctl"
+	}
+	return "stapply-ctl@" + hostname
+}()
+
+// signingKeyPath returns where the controller's nkey seed is kept:
+// STAPPLY_SIGNING_KEY if set, else ~/.config/stapply/controller.nk.
+func signingKeyPath() string {
+	if path := os.Getenv("STAPPLY_SIGNING_KEY"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "stapply", "controller.nk")
+}
+
+// controllerSigner returns the key requests are signed with, or nil if the
+// controller has none. Agents with trusted_controllers reject unsigned requests.
+var controllerSigner = sync.OnceValue(func() nkeys.KeyPair {
+	path := signingKeyPath()
+	if path == "" {
+		return nil
+	}
+	kp, err := security.LoadSigningKey(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && os.Getenv("STAPPLY_SIGNING_KEY") == "" {
+			return nil
+		}
+		log.Fatalf("Failed to load signing key: %v", err)
+	}
+	return kp
+})
+
+// knownAgentsPath returns where agent identities are pinned:
+// STAPPLY_KNOWN_AGENTS if set, else ~/.config/stapply/known_agents.
+func knownAgentsPath() string {
+	if path := os.Getenv("STAPPLY_KNOWN_AGENTS"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("Cannot locate known_agents: %v (set STAPPLY_KNOWN_AGENTS)", err)
+	}
+	return filepath.Join(home, ".config", "stapply", "known_agents")
+}
+
+// knownAgents returns the pinned agent identities, loaded once.
+var knownAgents = sync.OnceValue(func() *security.KnownAgents {
+	known, err := security.LoadKnownAgents(knownAgentsPath())
+	if err != nil {
+		log.Fatalf("Failed to load known agents: %v", err)
+	}
+	return known
+})
+
+// agentClient sends requests to a single agent. Before the first request it
+// pings the agent to learn its protocol version and capabilities, so it can
+// talk to agents that predate the protocol envelope.
+type agentClient struct {
+	nc      *nats.Conn
+	agentID string
+	key     security.Key
+
+	mu         sync.Mutex
+	negotiated bool
+	legacy     bool // agent speaks protocol v0 (bare payloads)
+	version    string
+	caps       *protocol.Capabilities
+	identity   string // Verified public key of the agent ("" if it does not sign)
+}
+
+// legacyCrypto makes agent clients encrypt in the legacy ciphertext format
+// and read only that (-legacy-crypto). Agents that predate the KDF header
+// cannot read anything else and drop such requests unanswered.
+var legacyCrypto bool
+
+// newAgentClient creates a client for agentID. secretKey is "kid:<id>:<secret>",
+// a bare secret, or empty to disable encryption.
+func newAgentClient(nc *nats.Conn, agentID, secretKey string) *agentClient {
+	key := security.ParseKey(secretKey)
+	if legacyCrypto {
+		key = key.WithLegacy()
+	}
+	return &agentClient{nc: nc, agentID: agentID, key: key}
+}
+
+// call sends req to the agent's subject for msgType and decodes the reply into resp.
+func (c *agentClient) call(msgType protocol.RequestType, req, resp interface{}, timeout time.Duration) error {
+	if _, err := c.negotiate(timeout); err != nil {
+		return err
+	}
+	_, err := c.send(msgType, req, resp, timeout)
+	return err
+}
+
+// retryPolicy is how often a run request is sent again after its reply
+// timed out, and how long to wait before the first retry; the wait doubles
+// with each.
+type retryPolicy struct {
+	retries     int
+	backoff     time.Duration
+	interrupted func() bool // Stops retrying once true, e.g. after Ctrl-C (nil = never)
+}
+
+// retryFlags registers -retries and -retry-backoff on fs.
+func retryFlags(fs *flag.FlagSet) *retryPolicy {
+	p := &retryPolicy{}
+	fs.IntVar(&p.retries, "retries", 2, "Times a step is sent again when its reply times out")
+	fs.DurationVar(&p.backoff, "retry-backoff", 2*time.Second, "Wait before the first retry of a step; doubles with each")
+	return p
+}
+
+// forStep returns the policy with the step's own retries and backoff, if set.
+func (p retryPolicy) forStep(step config.Step) retryPolicy {
+	if step.Retries >= 0 {
+		p.retries = step.Retries
+	}
+	if step.RetryBackoff > 0 {
+		p.backoff = step.RetryBackoff
+	}
+	return p
+}
+
+// callRun sends a run request like call and, when the reply times out or
+// the agent is briefly unreachable, sends it again with the same request ID
+// as retry allows. Agents with FeatureIdempotent answer a request ID they
+// have seen with its recorded result instead of running the action again,
+// so a retry is safe even if the lost attempt ran; other agents get none.
+// Retries are announced on stdout with indent.
+func (c *agentClient) callRun(req *protocol.RunRequest, resp interface{}, timeout time.Duration, retry retryPolicy, indent string) error {
+	for attempt := 0; ; attempt++ {
+		err := c.call(protocol.RequestTypeRun, req, resp, timeout)
+		if err == nil || attempt >= retry.retries || !c.supports(protocol.FeatureIdempotent) ||
+			!(errors.Is(err, nats.ErrTimeout) || errors.Is(err, nats.ErrNoResponders)) {
+			return err
+		}
+		wait := retry.backoff << attempt
+		fmt.Printf("%s⏳ %v; retrying in %s (%d/%d)\n", indent, err, wait, attempt+1, retry.retries)
+		time.Sleep(wait)
+		if retry.interrupted != nil && retry.interrupted() {
+			return err
+		}
+	}
+}
+
+// send performs a single request/reply exchange without negotiation.
+func (c *agentClient) send(msgType protocol.RequestType, req, resp interface{}, timeout time.Duration) (*protocol.Envelope, error) {
+	c.mu.Lock()
+	legacy := c.legacy
+	c.mu.Unlock()
+
+	var data []byte
+	var err error
+	if legacy {
+		data, err = json.Marshal(req)
+	} else {
+		data, err = c.marshal(msgType, req)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	if data, err = c.encrypt(data); err != nil {
+		return nil, err
+	}
+
+	msg, err := c.nc.Request(msgType.Subject(c.agentID), data, timeout)
+	if err != nil {
+		return nil, err
+	}
+	env, err := c.decode(msg.Data, resp)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(env, req, resp); err != nil {
+		return nil, fmt.Errorf("agent %s: %w", c.agentID, err)
+	}
+	return env, nil
+}
+
+// responseGuard rejects stale and replayed responses, so a captured reply
+// (e.g. of a successful run) cannot answer a later request.
+var responseGuard = security.NewReplayGuard(config.DefaultClockSkew)
+
+// checkResponse ties a response to the request it answers: it must be fresh,
+// not seen before and carry the request's ID. Agents that predate the
+// envelope send bare payloads with neither.
+func checkResponse(env *protocol.Envelope, req, resp interface{}) error {
+	if env.Version == 0 {
+		return nil
+	}
+	if err := responseGuard.Check(env.MessageID, env.Timestamp); err != nil {
+		return fmt.Errorf("rejected response: %w", err)
+	}
+	if want, got := requestID(req), requestID(resp); want != got {
+		return fmt.Errorf("rejected response: it answers request %q, not %q", got, want)
+	}
+	return nil
+}
+
+// requestID returns the RequestID field of a request or response, or ""
+// if it has none.
+func requestID(v interface{}) string {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return ""
+	}
+	if f := rv.FieldByName("RequestID"); f.IsValid() && f.Kind() == reflect.String {
+		return f.String()
+	}
+	return ""
+}
+
+// encrypt encrypts an outgoing message if the client has a key.
+func (c *agentClient) encrypt(data []byte) ([]byte, error) {
+	if c.key.Secret == "" {
+		return data, nil
+	}
+	data, err := c.key.Encrypt(data)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt request: %w", err)
+	}
+	return data, nil
+}
+
+// decode decrypts and unwraps a message from the agent into resp and checks
+// that the agent sent it.
+func (c *agentClient) decode(data []byte, resp interface{}) (*protocol.Envelope, error) {
+	var err error
+	if c.key.Secret != "" {
+		data, err = c.key.Decrypt(data)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt response: %w", err)
+		}
+	}
+
+	env, err := protocol.Unmarshal(data, resp)
+	if err != nil {
+		return nil, fmt.Errorf("parse response: %w", err)
+	}
+	if err := c.verifyIdentity(env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// verifyIdentity checks that a response was signed by the agent's pinned key,
+// pinning it on first contact. Unsigned responses are accepted only from
+// agents that were never pinned (builds that predate response signing).
+func (c *agentClient) verifyIdentity(env *protocol.Envelope) error {
+	known := knownAgents()
+
+	if env.Signer == "" {
+		if _, pinned := known.Pinned(c.agentID); pinned {
+			return fmt.Errorf("agent %s sent an unsigned response but its identity is pinned in %s", c.agentID, known.Path())
+		}
+		return nil
+	}
+
+	if env.SenderID != c.agentID {
+		return fmt.Errorf("response on %s claims to come from %q", c.agentID, env.SenderID)
+	}
+	if err := env.Verify(); err != nil {
+		return fmt.Errorf("agent %s: %w", c.agentID, err)
+	}
+
+	added, err := known.Verify(c.agentID, env.Signer)
+	if err != nil {
+		var mismatch *security.IdentityMismatchError
+		if errors.As(err, &mismatch) {
+			fmt.Fprintln(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+			fmt.Fprintf(os.Stderr, "@  WARNING: IDENTITY OF AGENT %s HAS CHANGED!\n", c.agentID)
+			fmt.Fprintln(os.Stderr, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+			fmt.Fprintln(os.Stderr, "Someone may be impersonating this agent, or it was reinstalled.")
+			fmt.Fprintf(os.Stderr, "Pinned:   %s\n", security.Fingerprint(mismatch.Pinned))
+			fmt.Fprintf(os.Stderr, "Received: %s\n", security.Fingerprint(mismatch.Got))
+			fmt.Fprintf(os.Stderr, "Refusing to talk to it. Remove its line from %s if the change is expected.\n", mismatch.Path)
+		}
+		return err
+	}
+	if added {
+		fmt.Fprintf(os.Stderr, "🪪 Pinned identity of agent %s (%s) in %s\n",
+			c.agentID, security.Fingerprint(env.Signer), known.Path())
+	}
+
+	c.mu.Lock()
+	c.identity = env.Signer
+	c.mu.Unlock()
+	return nil
+}
+
+// identityKey returns the agent's verified public key, or "" if its
+// responses are not signed.
+func (c *agentClient) identityKey() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.identity
+}
+
+// marshal wraps req in an envelope, signed if the controller has a signing
+// key and compressed (with compressed replies accepted) if the agent can
+// read it.
+func (c *agentClient) marshal(msgType protocol.RequestType, req interface{}) ([]byte, error) {
+	alg := c.compression()
+	return marshalRequest(msgType, req, protocol.MarshalOptions{Compression: alg, Accept: alg})
+}
+
+// marshalRequest wraps req in an envelope built with opts, signed if the
+// controller has a signing key.
+func marshalRequest(msgType protocol.RequestType, req interface{}, opts protocol.MarshalOptions) ([]byte, error) {
+	if kp := controllerSigner(); kp != nil {
+		opts.Signer = kp
+	}
+	return protocol.MarshalWith(msgType, controllerID, req, opts)
+}
+
+// compression returns the payload compression the agent supports, or "".
+func (c *agentClient) compression() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caps.HasCompression(protocol.CompressionZstd) {
+		return protocol.CompressionZstd
+	}
+	return ""
+}
+
+// ping sends a ping and records the agent's protocol version and capabilities.
+func (c *agentClient) ping(timeout time.Duration) (*protocol.PingResponse, error) {
+	var resp protocol.PingResponse
+	env, err := c.send(protocol.RequestTypePing, protocol.NewPingRequest(Version), &resp, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.negotiated = true
+	c.legacy = env.Version == 0
+	c.version = resp.Version
+	c.caps = resp.Capabilities
+	c.mu.Unlock()
+
+	return &resp, nil
+}
+
+// negotiate pings the agent once and returns its capabilities.
+// Agents that predate capability reporting return nil.
+func (c *agentClient) negotiate(timeout time.Duration) (*protocol.Capabilities, error) {
+	c.mu.Lock()
+	done := c.negotiated
+	c.mu.Unlock()
+
+	if !done {
+		if _, err := c.ping(timeout); err != nil {
+			return nil, fmt.Errorf("negotiate with %s: %w", c.agentID, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps, nil
+}
+
+// isLegacy reports whether the agent predates the protocol envelope.
+func (c *agentClient) isLegacy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.legacy
+}
+
+// supports reports whether the agent advertised an optional feature.
+func (c *agentClient) supports(feature string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps.HasFeature(feature)
+}
+
+// checkActions verifies the agent supports every action in names. Agents that
+// predate capability reporting are assumed to support the original built-ins.
+func (c *agentClient) checkActions(names []string) error {
+	c.mu.Lock()
+	caps, version := c.caps, c.version
+	c.mu.Unlock()
+
+	if caps == nil {
+		caps = &protocol.Capabilities{Actions: legacyActions}
+	}
+	if missing := caps.MissingActions(names); len(missing) > 0 {
+		return fmt.Errorf("agent %s (version %s) does not support action(s) %v; run 'stapply-ctl update %s'",
+			c.agentID, version, missing, c.agentID)
+	}
+	return nil
+}
+
+// legacyActions are the actions every agent released before capability
+// reporting supports.
+var legacyActions = []string{"cmd", "deploy_artifact", "systemd", "template_file", "write_file"}
+
+// negotiateActions negotiates with the agent and verifies it supports names.
+func negotiateActions(client *agentClient, names []string, timeout time.Duration) error {
+	if _, err := client.negotiate(timeout); err != nil {
+		return err
+	}
+	return client.checkActions(names)
+}
+
+// envActions returns the actions used by the steps of the given apps.
+func envActions(cfg *config.Config, apps []string) []string {
+	var names []string
+	for _, appName := range apps {
+		app, ok := cfg.Apps[appName]
+		if !ok {
+			continue
+		}
+		for _, step := range app.GetOrderedSteps() {
+			names = append(names, step.Action)
+			if _, ok := artifactStepArgs(step.Action, step.ArgsMap); ok && step.Action != "deploy_artifact" {
+				names = append(names, "deploy_artifact")
+			}
+		}
+	}
+	return names
+}
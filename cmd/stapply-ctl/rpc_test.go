@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+func TestCheckResponse(t *testing.T) {
+	req := protocol.NewRunRequest("cmd", map[string]string{"command": "true"}, 1000, false)
+	reply := func(requestID string) (*protocol.Envelope, *protocol.RunResponse) {
+		data, err := protocol.Marshal(protocol.RequestTypeRun.Reply(), "web1", protocol.NewRunResponse(requestID, true, 0, "", "", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp protocol.RunResponse
+		env, err := protocol.Unmarshal(data, &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env, &resp
+	}
+
+	env, resp := reply(req.RequestID)
+	if err := checkResponse(env, req, resp); err != nil {
+		t.Fatalf("checkResponse() error = %v", err)
+	}
+	// The same reply captured and sent again
+	if err := checkResponse(env, req, resp); err == nil {
+		t.Error("checkResponse() accepted a replayed response")
+	}
+	// A reply to another request
+	env, resp = reply("other")
+	if err := checkResponse(env, req, resp); err == nil {
+		t.Error("checkResponse() accepted a response to another request")
+	}
+	// Bare payloads of agents that predate the envelope carry neither
+	if err := checkResponse(&protocol.Envelope{}, req, &protocol.RunResponse{}); err != nil {
+		t.Errorf("checkResponse(legacy) error = %v", err)
+	}
+}
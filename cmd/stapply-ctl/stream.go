@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// streamBuffer is how many output lines may queue up before NATS starts
+// dropping them as a slow consumer.
+const streamBuffer = 4096
+
+// followStream prints live output of a run request as the agent of client
+// publishes it, each line prefixed with the host ID. Anyone may publish on
+// the stream subject, so lines not signed by the agent are dropped. It must
+// be started before the request is sent, after negotiating; the returned stop
+// function must be called once the final response has arrived, and prints
+// any lines still queued.
+func followStream(client *agentClient, requestID, hostID, indent string) (func(), error) {
+	ch := make(chan *nats.Msg, streamBuffer)
+	sub, err := client.nc.ChanSubscribe(protocol.StreamSubject(requestID), ch)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		var next uint64 = 1
+
+		show := func(m *nats.Msg) {
+			var sm protocol.StreamMessage
+			if err := client.decodeStream(m.Data, requestID, &sm); err != nil {
+				return
+			}
+			if sm.Seq < next {
+				return // duplicate
+			}
+			if sm.Seq > next {
+				fmt.Printf("%s%s | … %d line(s) lost\n", indent, hostID, sm.Seq-next)
+			}
+			next = sm.Seq + 1
+
+			marker := "|"
+			if sm.Stream == "stderr" {
+				marker = "!"
+			}
+			fmt.Printf("%s%s %s %s\n", indent, hostID, marker, sm.Line)
+		}
+
+		for {
+			select {
+			case m := <-ch:
+				show(m)
+			case <-done:
+				// The agent publishes all lines before replying, so anything
+				// still outstanding is already queued in ch.
+				for {
+					select {
+					case m := <-ch:
+						show(m)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	stop := func() {
+		sub.Unsubscribe()
+		close(done)
+		wg.Wait()
+	}
+	return stop, nil
+}
+
+// decodeStream decodes a line of live output of request requestID into sm.
+// Unlike replies, it must be signed by the agent: a subscriber cannot tell
+// who published it otherwise.
+func (c *agentClient) decodeStream(data []byte, requestID string, sm *protocol.StreamMessage) error {
+	env, err := c.decode(data, sm)
+	if err != nil {
+		return err
+	}
+	if env.Signer == "" {
+		return fmt.Errorf("output line of %s is not signed", c.agentID)
+	}
+	if env.Type != protocol.RequestTypeStream || sm.RequestID != requestID {
+		return fmt.Errorf("message is not an output line of request %s", requestID)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nkeys"
+)
+
+func TestDecodeStream(t *testing.T) {
+	t.Setenv("STAPPLY_KNOWN_AGENTS", filepath.Join(t.TempDir(), "known_agents"))
+	agent, _ := nkeys.CreateUser()
+	other, _ := nkeys.CreateUser()
+	client := newAgentClient(nil, "web1", "")
+
+	line := func(sender, requestID string, kp nkeys.KeyPair) []byte {
+		t.Helper()
+		data, err := protocol.MarshalWith(protocol.RequestTypeStream, sender, &protocol.StreamMessage{RequestID: requestID, Seq: 1, Stream: "stdout", Line: "hi"}, protocol.MarshalOptions{Signer: kp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	var sm protocol.StreamMessage
+	if err := client.decodeStream(line("web1", "r1", agent), "r1", &sm); err != nil || sm.Line != "hi" {
+		t.Fatalf("decodeStream() = %+v, %v", sm, err)
+	}
+	// Without a shared key, anyone could publish these
+	if err := client.decodeStream(line("web1", "r1", nil), "r1", &sm); err == nil {
+		t.Error("decodeStream() accepted an unsigned line")
+	}
+	if err := client.decodeStream(line("web1", "r1", other), "r1", &sm); err == nil {
+		t.Error("decodeStream() accepted a line signed by a key other than the pinned one")
+	}
+	if err := client.decodeStream(line("web2", "r1", agent), "r1", &sm); err == nil {
+		t.Error("decodeStream() accepted a line from another agent")
+	}
+	if err := client.decodeStream(line("web1", "r2", agent), "r1", &sm); err == nil {
+		t.Error("decodeStream() accepted a line of another request")
+	}
+}
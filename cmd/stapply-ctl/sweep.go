@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/config"
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// Ping sweep host states.
+const (
+	pingOK           = "ok"
+	pingUnreachable  = "unreachable"
+	pingIncompatible = "incompatible"
+)
+
+// pingTarget is a host to ping during a sweep.
+type pingTarget struct {
+	hostID  string
+	agentID string
+	key     string
+}
+
+// pingResult is the outcome of pinging one host, as printed by -o json.
+type pingResult struct {
+	Host          string   `json:"host"`
+	AgentID       string   `json:"agent_id"`
+	Status        string   `json:"status"`
+	Version       string   `json:"version,omitempty"`
+	Protocol      int      `json:"protocol"`
+	UptimeSeconds int64    `json:"uptime_seconds"`
+	CPUUsage      float64  `json:"cpu_usage"`
+	MemoryUsage   float64  `json:"memory_usage"`
+	RTTMs         int64    `json:"rtt_ms"`
+	Features      []string `json:"features,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// pingTargetsFromConfig selects the hosts of an environment, optionally
+// narrowed to a tag, or every host carrying the tag if no environment is given.
+func pingTargetsFromConfig(configPath, envName, tag string, conn *connOptions) []pingTarget {
+	if !strings.HasSuffix(configPath, ".stay.ini") {
+		fmt.Fprintf(os.Stderr, "Error: config file must have .stay.ini extension: %s\n", configPath)
+		os.Exit(1)
+	}
+
+	cfg, err := config.Parse(configPath)
+	if err != nil {
+		log.Fatalf("Failed to parse config: %v", err)
+	}
+
+	var hostIDs []string
+	var env *config.Environment
+	if envName != "" {
+		var ok bool
+		env, ok = cfg.Environments[envName]
+		if !ok {
+			log.Fatalf("Environment not found: %s", envName)
+		}
+		hostIDs = env.Hosts
+	} else {
+		for hostID := range cfg.Hosts {
+			hostIDs = append(hostIDs, hostID)
+		}
+	}
+
+	var targets []pingTarget
+	for _, hostID := range hostIDs {
+		host, ok := cfg.Hosts[hostID]
+		if tag != "" && (!ok || !hasTag(host.Tags, tag)) {
+			continue
+		}
+		agentID := hostID
+		if ok && host.AgentID != "" {
+			agentID = host.AgentID
+		}
+		key, err := conn.hostKey(cfg, env, hostID)
+		if err != nil {
+			log.Fatalf("Host %s: %v", hostID, err)
+		}
+		targets = append(targets, pingTarget{hostID: hostID, agentID: agentID, key: key})
+	}
+
+	if len(targets) == 0 {
+		log.Fatalf("No hosts match (env=%q tag=%q)", envName, tag)
+	}
+	return targets
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// pingSweep pings all targets concurrently and prints the results sorted by
+// host. It returns the process exit code: 1 if any host is unreachable or
+// runs an incompatible version.
+func pingSweep(nc *nats.Conn, targets []pingTarget, timeout time.Duration, output string) int {
+	results := make([]pingResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t pingTarget) {
+			defer wg.Done()
+			results[i] = pingOne(nc, t, timeout)
+		}(i, t)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, k int) bool {
+		return results[i].Host < results[k].Host
+	})
+
+	failed := 0
+	for _, r := range results {
+		if r.Status != pingOK {
+			failed++
+		}
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			log.Fatalf("Failed to encode results: %v", err)
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tAGENT\tVERSION\tUPTIME\tCPU\tMEM\tRTT\tSTATUS")
+		for _, r := range results {
+			switch r.Status {
+			case pingUnreachable:
+				fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\t-\t❌ %s\n", r.Host, r.AgentID, r.Error)
+			default:
+				status := "✅ ok"
+				if r.Status == pingIncompatible {
+					status = "⚠️  " + r.Error
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1f%%\t%.1f%%\t%dms\t%s\n",
+					r.Host, r.AgentID, r.Version,
+					time.Duration(r.UptimeSeconds)*time.Second,
+					r.CPUUsage, r.MemoryUsage, r.RTTMs, status)
+			}
+		}
+		tw.Flush()
+
+		fmt.Println()
+		fmt.Printf("Summary: ok=%d failed=%d\n", len(results)-failed, failed)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func pingOne(nc *nats.Conn, t pingTarget, timeout time.Duration) pingResult {
+	r := pingResult{Host: t.hostID, AgentID: t.agentID}
+
+	client := newAgentClient(nc, t.agentID, t.key)
+	start := time.Now()
+	resp, err := client.ping(timeout)
+	rtt := time.Since(start)
+	if err != nil {
+		r.Status = pingUnreachable
+		r.Error = err.Error()
+		switch {
+		case errors.Is(err, nats.ErrTimeout):
+			r.Error = "timeout"
+		case errors.Is(err, nats.ErrNoResponders):
+			r.Error = "no responders"
+		}
+		return r
+	}
+
+	r.Status = pingOK
+	r.Version = resp.Version
+	r.UptimeSeconds = resp.UptimeSeconds
+	r.CPUUsage = resp.CPUUsage
+	r.MemoryUsage = resp.MemoryUsage
+	r.RTTMs = rtt.Milliseconds()
+	if !client.isLegacy() {
+		r.Protocol = protocol.ProtocolVersion
+	}
+	if resp.Capabilities != nil {
+		r.Features = resp.Capabilities.Features
+	}
+
+	if !versionCompatible(resp.Version, Version) {
+		r.Status = pingIncompatible
+		r.Error = fmt.Sprintf("incompatible with controller %s", Version)
+	}
+	return r
+}
+
+// versionCompatible reports whether two versions share the same MAJOR.MINOR.
+// Malformed versions are compatible with nothing.
+func versionCompatible(a, b string) bool {
+	ma, okA := majorMinor(a)
+	mb, okB := majorMinor(b)
+	return okA && okB && ma == mb
+}
+
+// majorMinor returns the MAJOR.MINOR of a version like "v1.2.3-rc1",
+// reporting false if v has no numeric major and minor.
+func majorMinor(v string) (string, bool) {
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "+")
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) < 2 {
+		return "", false
+	}
+	// A pre-release suffix may follow the minor directly ("1.2-rc1")
+	minor, _, _ := strings.Cut(parts[1], "-")
+	for _, p := range []string{parts[0], minor} {
+		if _, err := strconv.Atoi(p); err != nil || strings.HasPrefix(p, "-") {
+			return "", false
+		}
+	}
+	return parts[0] + "." + minor, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestVersionCompatible(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"0.1.0", "0.1.7", true},
+		{"v0.1.0", "0.1.2", true},
+		{"v1.2.3", "v1.2.0", true},
+		{"0.1.202405201030-a1b2c3d", "0.1.0-dev", true},
+		{"1.2-rc1", "1.2.5", true},
+		{"1.2.0+build.7", "1.2.1", true},
+		{"0.1.0", "0.2.0", false},
+		{"1.1.0", "2.1.0", false},
+		{"1.2-rc1", "1.3", false},
+		{"dev", "dev", false},
+		{"", "", false},
+		{"1", "1", false},
+		{"a.b.c", "a.b.c", false},
+		{"1.x.0", "1.x.0", false},
+		{"vv1.2", "1.2", false},
+	}
+	for _, tt := range tests {
+		if got := versionCompatible(tt.a, tt.b); got != tt.want {
+			t.Errorf("versionCompatible(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMajorMinor(t *testing.T) {
+	tests := []struct {
+		v, want string
+		ok      bool
+	}{
+		{"v1.2.3", "1.2", true},
+		{"1.2", "1.2", true},
+		{"0.1.0-dev", "0.1", true},
+		{"2.0-beta.1", "2.0", true},
+		{"1", "", false},
+		{"x.1", "", false},
+		{"1.-1", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := majorMinor(tt.v)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("majorMinor(%q) = %q, %v, want %q, %v", tt.v, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -10,6 +10,11 @@ NATS_URL="nats://localhost:4222"
 NATS_URL="nats://localhost:4222"
 NATS_CREDS=""
 SECRET_KEY=""
+TRUSTED_CONTROLLERS=""
+TLS_CA=""
+TLS_CA_DATA=""
+TLS_CERT=""
+TLS_KEY=""
 INSTALL_DIR="/usr/local/bin"
 CONFIG_DIR="/etc/stapply"
 SYSTEMD_DIR="/etc/systemd/system"
@@ -34,18 +39,43 @@ while [[ $# -gt 0 ]]; do
             SECRET_KEY="$2"
             shift 2
             ;;
+        --trusted-controllers)
+            TRUSTED_CONTROLLERS="$2"
+            shift 2
+            ;;
+        --tls-ca)
+            TLS_CA="$2"
+            shift 2
+            ;;
+        --tls-ca-data)
+            TLS_CA_DATA="$2"
+            shift 2
+            ;;
+        --tls-cert)
+            TLS_CERT="$2"
+            shift 2
+            ;;
+        --tls-key)
+            TLS_KEY="$2"
+            shift 2
+            ;;
         --binary-url)
             BINARY_URL="$2"
             shift 2
             ;;
         *)
             echo "Unknown option: $1"
-            echo "Usage: $0 [--agent-id <id>] [--nats-server <fqdn>] [--nats-creds <path>] [--secret-key <key>]"
+            echo "Usage: $0 [--agent-id <id>] [--nats-server <fqdn>] [--nats-creds <path>] [--secret-key <key>] [--trusted-controllers <pubkeys>] [--tls-ca <path> | --tls-ca-data <base64>] [--tls-cert <path> --tls-key <path>]"
             exit 1
             ;;
     esac
 done
 
+if { [ -n "$TLS_CERT" ] && [ -z "$TLS_KEY" ]; } || { [ -z "$TLS_CERT" ] && [ -n "$TLS_KEY" ]; }; then
+    echo "Error: --tls-cert and --tls-key must be given together"
+    exit 1
+fi
+
 # Check if running as root
 if [ "$EUID" -ne 0 ]; then
     echo "Error: This script must be run as root"
@@ -114,6 +144,34 @@ if [ -n "$NATS_CREDS" ]; then
     echo "nats_creds=$NATS_CREDS" >> "$CONFIG_DIR/agent.ini"
 fi
 
+# Install TLS material into the config directory
+if [ -n "$TLS_CA" ] || [ -n "$TLS_CA_DATA" ] || [ -n "$TLS_CERT" ]; then
+    echo "🔒 Installing TLS material..."
+    mkdir -p "$CONFIG_DIR/tls"
+    if [ -n "$TLS_CA_DATA" ]; then
+        echo "$TLS_CA_DATA" | base64 -d > "$CONFIG_DIR/tls/ca.pem"
+    elif [ -n "$TLS_CA" ]; then
+        cp "$TLS_CA" "$CONFIG_DIR/tls/ca.pem"
+    fi
+    if [ -f "$CONFIG_DIR/tls/ca.pem" ]; then
+        chmod 644 "$CONFIG_DIR/tls/ca.pem"
+        echo "tls_ca_file=$CONFIG_DIR/tls/ca.pem" >> "$CONFIG_DIR/agent.ini"
+    fi
+    if [ -n "$TLS_CERT" ]; then
+        cp "$TLS_CERT" "$CONFIG_DIR/tls/client.pem"
+        cp "$TLS_KEY" "$CONFIG_DIR/tls/client.key"
+        chmod 644 "$CONFIG_DIR/tls/client.pem"
+        chmod 600 "$CONFIG_DIR/tls/client.key"
+        echo "tls_cert_file=$CONFIG_DIR/tls/client.pem" >> "$CONFIG_DIR/agent.ini"
+        echo "tls_key_file=$CONFIG_DIR/tls/client.key" >> "$CONFIG_DIR/agent.ini"
+    fi
+fi
+
+# Only accept requests signed by these controllers
+if [ -n "$TRUSTED_CONTROLLERS" ]; then
+    echo "trusted_controllers=$TRUSTED_CONTROLLERS" >> "$CONFIG_DIR/agent.ini"
+fi
+
 # Create systemd unit
 echo "🔧 Installing systemd service..."
 cat > "$SYSTEMD_DIR/stapply-agent.service" <<'EOF'
@@ -1,16 +1,24 @@
 package actions
 
-import "github.com/drax2gma/stapply/internal/protocol"
+import (
+	"context"
+	"sort"
+
+	"github.com/drax2gma/stapply/internal/policy"
+	"github.com/drax2gma/stapply/internal/protocol"
+)
 
 // Action is the interface for all action executors.
 type Action interface {
 	// Execute runs the action and returns the response.
-	Execute(requestID string, args map[string]string, dryRun bool) *protocol.RunResponse
+	// Implementations must stop work and return once ctx is done.
+	Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse
 }
 
 // Registry holds registered action executors.
 type Registry struct {
 	actions map[string]Action
+	policy  *policy.Policy
 }
 
 // NewRegistry creates a new action registry with default actions.
@@ -24,6 +32,7 @@ func NewRegistry() *Registry {
 	r.Register("template_file", &TemplateFileAction{})
 	r.Register("systemd", &SystemdAction{})
 	r.Register("deploy_artifact", &DeployArtifactAction{})
+	r.Register("rollback_artifact", &RollbackArtifactAction{})
 	return r
 }
 
@@ -32,18 +41,36 @@ func (r *Registry) Register(name string, action Action) {
 	r.actions[name] = action
 }
 
+// SetPolicy restricts what Execute will run. A nil policy allows everything.
+func (r *Registry) SetPolicy(p *policy.Policy) {
+	r.policy = p
+}
+
 // Get retrieves an action by name.
 func (r *Registry) Get(name string) (Action, bool) {
 	a, ok := r.actions[name]
 	return a, ok
 }
 
-// Execute runs an action by name.
-func (r *Registry) Execute(requestID, actionName string, args map[string]string, dryRun bool) *protocol.RunResponse {
+// Names returns the registered action names, sorted.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.actions))
+	for name := range r.actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Execute runs an action by name if the policy allows it.
+func (r *Registry) Execute(ctx context.Context, requestID, actionName string, args map[string]string, dryRun bool) *protocol.RunResponse {
 	action, ok := r.Get(actionName)
 	if !ok {
 		return protocol.NewErrorResponse(requestID,
 			&ActionError{Action: actionName, Err: ErrUnknownAction}, 0)
 	}
-	return action.Execute(requestID, args, dryRun)
+	if err := r.policy.Check(actionName, args); err != nil {
+		return protocol.NewDeniedResponse(requestID, &ActionError{Action: actionName, Err: err})
+	}
+	return action.Execute(ctx, requestID, args, dryRun)
 }
@@ -1,35 +1,215 @@
 package actions
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/drax2gma/stapply/internal/protocol"
 )
 
+// Suffixes of the files a transfer keeps in the staging directory.
+const (
+	partSuffix     = ".part"
+	manifestSuffix = ".json"
+)
+
 // DeployArtifactAction handles chunked binary transfer.
-// It is designed to be stateless regarding request handling, but stateful on disk.
+// Chunks are written at explicit offsets into a partial file in Dir, next to
+// a manifest of the chunks received so far, so they may arrive in any order
+// and an interrupted transfer resumes where it stopped. Once every chunk is
+// in and the checksum matches, the file is moved to its destination and kept
+// in a content-addressed cache, so a later transfer of the same content (see
+// protocol.ArtifactQueryPresent) needs no upload. Chunks may be compressed,
+// named by the chunk_encoding argument.
 type DeployArtifactAction struct {
-	// fileLocks prevents concurrent writes to the same file from multiple goroutines (if any)
-	fileLocks sync.Map // map[string]*sync.Mutex
+	Dir string // Staging directory for partial files ("" = <tmp>/stapply-artifacts)
+}
+
+// destLocks serializes the requests that change one dest, whether they
+// deploy to it or roll it back.
+var destLocks = &lockTable{}
+
+// lockTable holds a mutex per dest while requests for it run.
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string]*destLock
+}
+
+// destLock serializes the requests for one dest.
+type destLock struct {
+	mu   sync.Mutex
+	refs int // Requests holding or waiting for mu
 }
 
-func (a *DeployArtifactAction) Execute(requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
+// partManifest records which chunks of a transfer are in its partial file.
+type partManifest struct {
+	Dest      string `json:"dest"`
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`       // -1 if the controller did not send it
+	ChunkSize int64  `json:"chunk_size"` // 0 for controllers that predate offsets
+	Total     int    `json:"total_chunks"`
+	Received  []int  `json:"received"`
+}
+
+// matches reports whether m describes the same transfer as want.
+func (m *partManifest) matches(want *partManifest) bool {
+	return m.Dest == want.Dest && m.Checksum == want.Checksum && m.Size == want.Size &&
+		m.ChunkSize == want.ChunkSize && m.Total == want.Total
+}
+
+// missing returns the chunks not received yet.
+func (m *partManifest) missing() []int {
+	have := make(map[int]bool, len(m.Received))
+	for _, i := range m.Received {
+		have[i] = true
+	}
+	var missing []int
+	for i := 0; i < m.Total; i++ {
+		if !have[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func (a *DeployArtifactAction) dir() string {
+	if a.Dir != "" {
+		return a.Dir
+	}
+	return filepath.Join(os.TempDir(), "stapply-artifacts")
+}
+
+// staging returns the paths of the partial file and manifest for dest.
+func (a *DeployArtifactAction) staging(dest string) (part, manifest string) {
+	sum := sha256.Sum256([]byte(dest))
+	base := filepath.Join(a.dir(), hex.EncodeToString(sum[:16]))
+	return base + partSuffix, base + manifestSuffix
+}
+
+// lock serializes work on the transfer to dest.
+func (a *DeployArtifactAction) lock(dest string) func() {
+	return destLocks.lock(dest)
+}
+
+// lock waits for the mutex of dest and returns the function releasing it.
+// The entry is dropped once no request holds or waits for it.
+func (t *lockTable) lock(dest string) func() {
+	dest = filepath.Clean(dest)
+	t.mu.Lock()
+	if t.locks == nil {
+		t.locks = make(map[string]*destLock)
+	}
+	l := t.locks[dest]
+	if l == nil {
+		l = &destLock{}
+		t.locks[dest] = l
+	}
+	l.refs++
+	t.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		t.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(t.locks, dest)
+		}
+		t.mu.Unlock()
+	}
+}
+
+func loadManifest(path string) (*partManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m partManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+func saveManifest(path string, m *partManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (a *DeployArtifactAction) Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
 	// Parse arguments
 	destPath := args["dest"]
 	if destPath == "" {
 		return protocol.NewErrorResponse(requestID, fmt.Errorf("missing 'dest' argument"), 0)
 	}
 
-	chunkDataB64 := args["chunk_data"]
-	if chunkDataB64 == "" {
+	totalChunksStr := args["total_chunks"]
+	totalChunks, err := strconv.Atoi(totalChunksStr)
+	if err != nil || totalChunks < 1 {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'total_chunks': %q", totalChunksStr), 0)
+	}
+
+	want := &partManifest{Dest: destPath, Checksum: args["checksum"], Size: -1, Total: totalChunks}
+	if c := want.Checksum; c != "" {
+		// Checksums name cache files, so nothing but a SHA-256 is accepted
+		if b, err := hex.DecodeString(c); err != nil || len(b) != sha256.Size {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'checksum': %q", c), 0)
+		}
+	}
+	if s := args["total_size"]; s != "" {
+		if want.Size, err = strconv.ParseInt(s, 10, 64); err != nil || want.Size < 0 {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'total_size': %q", s), 0)
+		}
+	}
+	if s := args["chunk_size"]; s != "" {
+		if want.ChunkSize, err = strconv.ParseInt(s, 10, 64); err != nil || want.ChunkSize <= 0 {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'chunk_size': %q", s), 0)
+		}
+	}
+
+	attrs, releases, err := parseInstallArgs(args)
+	if err != nil {
+		return protocol.NewErrorResponse(requestID, err, 0)
+	}
+	if releases > 0 && want.Checksum == "" {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("releases mode needs a 'checksum'"), 0)
+	}
+
+	switch query := args["query"]; query {
+	case "":
+	case protocol.ArtifactQueryMissing:
+		return a.queryMissing(requestID, want)
+	case protocol.ArtifactQueryPresent:
+		if dryRun {
+			return protocol.NewRunResponse(requestID, false, 0, protocol.ArtifactAbsent, "", 0)
+		}
+		return a.queryPresent(requestID, want, attrs, releases)
+	default:
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("unknown query %q", query), 0)
+	}
+
+	// Empty files are sent as a single empty chunk
+	chunkDataB64, ok := args["chunk_data"]
+	if !ok {
 		return protocol.NewErrorResponse(requestID, fmt.Errorf("missing 'chunk_data' argument"), 0)
 	}
 
@@ -38,19 +218,14 @@ func (a *DeployArtifactAction) Execute(requestID string, args map[string]string,
 	if err != nil {
 		return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'chunk_index': %v", err), 0)
 	}
-
-	totalChunksStr := args["total_chunks"]
-	totalChunks, err := strconv.Atoi(totalChunksStr)
-	if err != nil {
-		return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'total_chunks': %v", err), 0)
+	if chunkIndex < 0 || chunkIndex >= totalChunks {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("chunk_index %d out of range (total_chunks %d)", chunkIndex, totalChunks), 0)
 	}
 
-	checksum := args["checksum"] // SHA256 of the *entire* file
-	modeStr := args["mode"]
-	mode := os.FileMode(0644)
-	if modeStr != "" {
-		if m, err := strconv.ParseUint(modeStr, 8, 32); err == nil {
-			mode = os.FileMode(m)
+	offset := int64(-1)
+	if s := args["offset"]; s != "" {
+		if offset, err = strconv.ParseInt(s, 10, 64); err != nil || offset < 0 {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'offset': %q", s), 0)
 		}
 	}
 
@@ -59,67 +234,415 @@ func (a *DeployArtifactAction) Execute(requestID string, args map[string]string,
 			fmt.Sprintf("Would write chunk %d/%d to %s", chunkIndex+1, totalChunks, destPath), "", 0)
 	}
 
-	// Lock based on destination path to avoid race conditions if requests come in parallel (though unexpected for same file)
-	lockVal, _ := a.fileLocks.LoadOrStore(destPath, &sync.Mutex{})
-	mutex := lockVal.(*sync.Mutex)
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	// Decode data
 	data, err := base64.StdEncoding.DecodeString(chunkDataB64)
 	if err != nil {
 		return protocol.NewErrorResponse(requestID, fmt.Errorf("base64 decode failed: %v", err), 0)
 	}
+	if enc := args["chunk_encoding"]; enc != "" {
+		if data, err = protocol.Decompress(enc, data); err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("chunk %d: %v", chunkIndex, err), 0)
+		}
+	}
 
-	// Prepare file flags
-	flags := os.O_CREATE | os.O_WRONLY
-	if chunkIndex == 0 {
-		// First chunk: Truncate file
-		flags |= os.O_TRUNC
-		// Create directory if not exists
-		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to create directory: %v", err), 0)
+	// Controllers that predate offsets send equal chunks in order, the last one short
+	if offset < 0 {
+		offset = int64(chunkIndex) * int64(len(data))
+		if chunkIndex == totalChunks-1 && want.Size >= 0 {
+			offset = want.Size - int64(len(data))
+		}
+	}
+	if want.Size >= 0 && offset+int64(len(data)) > want.Size {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("chunk %d at offset %d overruns total_size %d", chunkIndex, offset, want.Size), 0)
+	}
+
+	defer a.lock(destPath)()
+	partPath, manifestPath := a.staging(destPath)
+
+	// Continue the partial file if it belongs to this transfer, else start over
+	m, err := loadManifest(manifestPath)
+	resumed := err == nil && m.matches(want)
+	if !resumed {
+		m = want
+		if err := os.MkdirAll(a.dir(), 0700); err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to create staging directory: %v", err), 0)
 		}
-	} else {
-		// Subsequent chunks: Append
-		flags |= os.O_APPEND
 	}
 
-	f, err := os.OpenFile(destPath, flags, mode)
+	flags := os.O_CREATE | os.O_WRONLY
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partPath, flags, 0600)
 	if err != nil {
 		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to open file: %v", err), 0)
 	}
 	defer f.Close()
 
+	if !resumed && m.Size >= 0 {
+		if err := f.Truncate(m.Size); err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to size file: %v", err), 0)
+		}
+	}
+
 	// Write chunk
-	if _, err := f.Write(data); err != nil {
+	if _, err := f.WriteAt(data, offset); err != nil {
 		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to write chunk: %v", err), 0)
 	}
+	if i := sort.SearchInts(m.Received, chunkIndex); i == len(m.Received) || m.Received[i] != chunkIndex {
+		m.Received = append(m.Received, 0)
+		copy(m.Received[i+1:], m.Received[i:])
+		m.Received[i] = chunkIndex
+	}
 
 	// Per-chunk success message
 	msg := fmt.Sprintf("Received chunk %d/%d (%d bytes)", chunkIndex+1, totalChunks, len(data))
 
-	// Final verification
-	if chunkIndex == totalChunks-1 {
-		// Close file to flush writes before reading back
-		f.Close()
+	if len(m.Received) < m.Total {
+		if err := saveManifest(manifestPath, m); err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to save manifest: %v", err), 0)
+		}
+		return protocol.NewRunResponse(requestID, true, 0, msg, "", 0)
+	}
 
-		if checksum != "" {
-			hashStr, err := calculateSHA256(destPath)
-			if err != nil {
-				return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to calculate checksum: %v", err), 0)
-			}
-			if hashStr != checksum {
-				return protocol.NewErrorResponse(requestID, fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, hashStr), 0)
+	// Final verification once every chunk is in, whatever the order.
+	// A bad file is discarded so the next attempt starts from scratch.
+	if err := f.Sync(); err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to sync file: %v", err), 0)
+	}
+	if err := f.Close(); err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to write file: %v", err), 0)
+	}
+	defer os.Remove(manifestPath)
+	defer os.Remove(partPath)
+
+	if m.Checksum != "" {
+		hashStr, err := calculateSHA256(partPath)
+		if err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to calculate checksum: %v", err), 0)
+		}
+		if hashStr != m.Checksum {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("checksum mismatch: expected %s, got %s", m.Checksum, hashStr), 0)
+		}
+		msg += " - Checksum Verified ✅"
+	}
+
+	if m.Checksum != "" {
+		a.addToCache(partPath, m.Checksum)
+	}
+	if releases > 0 {
+		release, err := installRelease(partPath, destPath, m.Checksum, attrs, false, releases)
+		if err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to install release in %s: %v", destPath, err), 0)
+		}
+		msg += fmt.Sprintf(" - current -> %s", release)
+	} else if err := installFile(partPath, destPath, attrs, false); err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to install %s: %v", destPath, err), 0)
+	}
+	return protocol.NewRunResponse(requestID, true, 0, msg, "", 0)
+}
+
+func (a *DeployArtifactAction) cacheDir() string {
+	return filepath.Join(a.dir(), "cache")
+}
+
+// cachePath returns where the cache keeps the file with the given SHA-256.
+func (a *DeployArtifactAction) cachePath(checksum string) string {
+	return filepath.Join(a.cacheDir(), checksum)
+}
+
+// addToCache records a copy of the verified file at path in the
+// content-addressed cache. The copy is never hard-linked to an installed
+// file: a shared inode would let the mode or owner given to one install
+// change the cache and every other install of the same content. Failures
+// only mean a later upload is not skipped.
+func (a *DeployArtifactAction) addToCache(path, checksum string) {
+	if err := os.MkdirAll(a.cacheDir(), 0700); err != nil {
+		return
+	}
+	cached := a.cachePath(checksum)
+	tmp := cached + ".tmp"
+	os.Remove(tmp)
+	if err := copyFile(path, tmp); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, cached); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// queryPresent answers whether the transfer described by want can be skipped:
+// ArtifactPresent if dest already has the content, ArtifactRestored if it was
+// installed from an earlier release or the cache, ArtifactAbsent if it has to
+// be uploaded. With releases set, dest is a release directory.
+func (a *DeployArtifactAction) queryPresent(requestID string, want *partManifest, attrs fileAttrs, releases int) *protocol.RunResponse {
+	if want.Checksum == "" {
+		return protocol.NewRunResponse(requestID, false, 0, protocol.ArtifactAbsent, "", 0)
+	}
+	defer a.lock(want.Dest)()
+
+	installed := want.Dest
+	if releases > 0 {
+		installed = filepath.Join(want.Dest, currentLink)
+	}
+	if matchesChecksum(installed, want.Size, want.Checksum) {
+		ok, err := attrs.matches(installed)
+		if err != nil {
+			return protocol.NewErrorResponse(requestID, err, 0)
+		}
+		if ok {
+			return protocol.NewRunResponse(requestID, false, 0, protocol.ArtifactPresent, "", 0)
+		}
+		if err := attrs.apply(installed); err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to set attributes of %s: %v", installed, err), 0)
+		}
+		return protocol.NewRunResponse(requestID, true, 0, protocol.ArtifactPresent, "", 0)
+	}
+
+	// An earlier release with the same content only needs the link switched
+	if releases > 0 {
+		if release := findRelease(want.Dest, want.Size, want.Checksum); release != "" {
+			if err := switchCurrent(want.Dest, release); err != nil {
+				return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to switch %s: %v", want.Dest, err), 0)
 			}
-			msg += " - Checksum Verified ✅"
+			return protocol.NewRunResponse(requestID, true, 0, protocol.ArtifactRestored, "", 0)
 		}
+	}
 
-		// Clean up lock (optional, keeps map form growing indefinitely)
-		a.fileLocks.Delete(destPath)
+	// Cache entries are verified before use in case they were modified
+	cached := a.cachePath(want.Checksum)
+	if _, err := os.Stat(cached); err != nil {
+		return protocol.NewRunResponse(requestID, false, 0, protocol.ArtifactAbsent, "", 0)
+	}
+	if !matchesChecksum(cached, want.Size, want.Checksum) {
+		os.Remove(cached)
+		return protocol.NewRunResponse(requestID, false, 0, protocol.ArtifactAbsent, "", 0)
+	}
+	var err error
+	if releases > 0 {
+		_, err = installRelease(cached, want.Dest, want.Checksum, attrs, true, releases)
+	} else {
+		err = installFile(cached, want.Dest, attrs, true)
 	}
+	if err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to install %s from cache: %v", want.Dest, err), 0)
+	}
+	return protocol.NewRunResponse(requestID, true, 0, protocol.ArtifactRestored, "", 0)
+}
 
-	return protocol.NewRunResponse(requestID, true, 0, msg, "", 0)
+// matchesChecksum reports whether the file at path has the given SHA-256
+// (and size, if size is not -1).
+func matchesChecksum(path string, size int64, checksum string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || (size >= 0 && info.Size() != size) {
+		return false
+	}
+	sum, err := calculateSHA256(path)
+	return err == nil && sum == checksum
+}
+
+// queryMissing reports the chunks of the transfer described by want that
+// the agent does not have. Everything is missing unless a partial file of the
+// same transfer exists.
+func (a *DeployArtifactAction) queryMissing(requestID string, want *partManifest) *protocol.RunResponse {
+	defer a.lock(want.Dest)()
+	_, manifestPath := a.staging(want.Dest)
+
+	m, err := loadManifest(manifestPath)
+	if err != nil || !m.matches(want) {
+		m = want
+	}
+	missing := protocol.FormatChunkList(m.missing())
+	resp := protocol.NewRunResponse(requestID, false, 0, missing, "", 0)
+	resp.MissingChunks = missing
+	return resp
+}
+
+// parseInstallArgs reads the mode, owner and releases arguments saying how
+// an artifact is installed.
+func parseInstallArgs(args map[string]string) (attrs fileAttrs, releases int, err error) {
+	attrs = fileAttrs{mode: 0644, owner: args["owner"]}
+	if s := args["mode"]; s != "" {
+		if attrs.mode, err = parseFileMode(s); err != nil {
+			return attrs, 0, err
+		}
+	}
+	if attrs.owner != "" {
+		if _, _, err := lookupOwner(attrs.owner); err != nil {
+			return attrs, 0, fmt.Errorf("invalid 'owner': %v", err)
+		}
+	}
+	if s := args["releases"]; s != "" {
+		if releases, err = strconv.Atoi(s); err != nil || releases < 1 {
+			return attrs, 0, fmt.Errorf("invalid 'releases': %q", s)
+		}
+	}
+	return attrs, releases, nil
+}
+
+// fileAttrs are the mode and owner an artifact is installed with.
+type fileAttrs struct {
+	mode  os.FileMode
+	owner string // "user:group", empty to leave ownership alone
+}
+
+// apply sets the attributes on path. The owner goes first, since changing
+// it clears the setuid and setgid bits.
+func (f fileAttrs) apply(path string) error {
+	if f.owner != "" {
+		if err := applyOwner(path, f.owner); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, f.mode)
+}
+
+// matches reports whether path already has the attributes.
+func (f fileAttrs) matches(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&modeBits != f.mode&modeBits {
+		return false, nil
+	}
+	if f.owner == "" {
+		return true, nil
+	}
+	uid, gid, err := lookupOwner(f.owner)
+	if err != nil {
+		return false, err
+	}
+	curUID, curGID, err := getFileOwner(path)
+	if err != nil {
+		return false, err
+	}
+	return uid == curUID && gid == curGID, nil
+}
+
+// installFile puts src at dest with attrs, creating dest's directory, and
+// replaces dest in one step once the data is on disk. src is moved unless
+// keep is set, in which case it is copied next to dest first, as it is
+// across filesystems. A kept src is never hard-linked, so dest's attributes
+// stay its own.
+func installFile(src, dest string, attrs fileAttrs, keep bool) error {
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if !keep {
+		if err := attrs.apply(src); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dest); err == nil {
+			return syncDir(dir)
+		}
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	os.Remove(tmpPath)
+	if err := copyFile(src, tmpPath); err != nil {
+		return err
+	}
+	if err := attrs.apply(tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory, making renames in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// copyFile copies the content of src to a new file dest.
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	return out.Close()
+}
+
+// RemoveStale deletes partial transfers that have not received a chunk for
+// maxAge, returning how many were removed.
+func (a *DeployArtifactAction) RemoveStale(maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(a.dir())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, partSuffix) && !strings.HasSuffix(name, manifestSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(a.dir(), name)); err == nil && strings.HasSuffix(name, partSuffix) {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// PruneCache deletes cached artifacts older than maxAge, returning how many
+// were removed.
+func (a *DeployArtifactAction) PruneCache(maxAge time.Duration) (int, error) {
+	dir := a.cacheDir()
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if os.Remove(filepath.Join(dir, e.Name())) == nil {
+			removed++
+		}
+	}
+	return removed, nil
 }
 
 func calculateSHA256(path string) (string, error) {
@@ -0,0 +1,348 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+// artifactChunks returns the deploy_artifact requests that send content to dest.
+func artifactChunks(dest string, content []byte, chunkSize int) []map[string]string {
+	sum := sha256.Sum256(content)
+	total := max(1, (len(content)+chunkSize-1)/chunkSize)
+	var chunks []map[string]string
+	for i := 0; i < total; i++ {
+		offset := i * chunkSize
+		end := min(offset+chunkSize, len(content))
+		chunks = append(chunks, map[string]string{
+			"dest":         dest,
+			"chunk_index":  strconv.Itoa(i),
+			"total_chunks": strconv.Itoa(total),
+			"total_size":   strconv.Itoa(len(content)),
+			"chunk_size":   strconv.Itoa(chunkSize),
+			"offset":       strconv.Itoa(offset),
+			"checksum":     hex.EncodeToString(sum[:]),
+			"chunk_data":   base64.StdEncoding.EncodeToString(content[offset:end]),
+		})
+	}
+	return chunks
+}
+
+func TestDeployArtifactOutOfOrder(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "bin", "app")
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	chunks := artifactChunks(dest, content, 300)
+
+	// One chunk travels compressed
+	packed, err := protocol.Compress(protocol.CompressionZstd, content[300:600])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks[1]["chunk_encoding"] = protocol.CompressionZstd
+	chunks[1]["chunk_data"] = base64.StdEncoding.EncodeToString(packed)
+
+	a := &DeployArtifactAction{Dir: t.TempDir()}
+	order := []int{2, 0, 3, 0, 1} // Includes a duplicate
+	for n, i := range order {
+		resp := a.Execute(context.Background(), "req", chunks[i], false)
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("chunk %d: %s", i, resp.Error)
+		}
+		if last := n == len(order)-1; last != bytes.Contains([]byte(resp.Stdout), []byte("Checksum Verified")) {
+			t.Errorf("chunk %d (send %d): verified = %v, want %v", i, n, !last, last)
+		}
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("assembled file differs from source")
+	}
+
+	// Offsets past total_size are refused
+	resp := a.Execute(context.Background(), "req", map[string]string{
+		"dest": dest, "chunk_index": "0", "total_chunks": "1", "total_size": "4",
+		"offset": "2", "chunk_data": base64.StdEncoding.EncodeToString([]byte("abcd")),
+	}, false)
+	if resp.Status == protocol.StatusOK {
+		t.Errorf("chunk overrunning total_size was accepted")
+	}
+}
+
+func TestDeployArtifactEmpty(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(dest, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chunks := artifactChunks(dest, nil, 300)
+	if len(chunks) != 1 || chunks[0]["chunk_data"] != "" {
+		t.Fatalf("chunks = %v, want one empty chunk", chunks)
+	}
+
+	a := &DeployArtifactAction{Dir: t.TempDir()}
+	resp := a.Execute(context.Background(), "req", chunks[0], false)
+	if resp.Status != protocol.StatusOK || !resp.Changed {
+		t.Fatalf("Execute() = %s changed=%v: %s", resp.Status, resp.Changed, resp.Error)
+	}
+	if info, err := os.Stat(dest); err != nil || info.Size() != 0 {
+		t.Errorf("dest = %v, %v, want an empty file", info, err)
+	}
+
+	// A chunk without data is still refused
+	delete(chunks[0], "chunk_data")
+	if resp := a.Execute(context.Background(), "req", chunks[0], false); resp.Status == protocol.StatusOK {
+		t.Error("chunk without chunk_data was accepted")
+	}
+}
+
+func TestDeployArtifactResume(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "app")
+	content := bytes.Repeat([]byte("abcdefgh"), 100)
+	chunks := artifactChunks(dest, content, 200)
+	staging := t.TempDir()
+
+	missing := func(a *DeployArtifactAction) string {
+		args := map[string]string{"query": protocol.ArtifactQueryMissing}
+		for _, k := range []string{"dest", "total_chunks", "total_size", "chunk_size", "checksum"} {
+			args[k] = chunks[0][k]
+		}
+		resp := a.Execute(context.Background(), "req", args, false)
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("query: %s", resp.Error)
+		}
+		if resp.Stdout != resp.MissingChunks {
+			t.Errorf("query Stdout = %q, MissingChunks = %q, want the same list", resp.Stdout, resp.MissingChunks)
+		}
+		return resp.MissingChunks
+	}
+
+	a := &DeployArtifactAction{Dir: staging}
+	if got := missing(a); got != "0-3" {
+		t.Errorf("missing before transfer = %q, want 0-3", got)
+	}
+	for _, i := range []int{0, 2} {
+		if resp := a.Execute(context.Background(), "req", chunks[i], false); resp.Status != protocol.StatusOK {
+			t.Fatalf("chunk %d: %s", i, resp.Error)
+		}
+	}
+
+	// A restarted agent picks the transfer up from the manifest
+	a = &DeployArtifactAction{Dir: staging}
+	if got := missing(a); got != "1,3" {
+		t.Errorf("missing after restart = %q, want 1,3", got)
+	}
+	for _, i := range []int{3, 1} {
+		if resp := a.Execute(context.Background(), "req", chunks[i], false); resp.Status != protocol.StatusOK {
+			t.Fatalf("chunk %d: %s", i, resp.Error)
+		}
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Errorf("resumed file differs from source")
+	}
+	if n := len(destLocks.locks); n != 0 {
+		t.Errorf("%d dest locks left after the transfer", n)
+	}
+	if parts, _ := filepath.Glob(filepath.Join(staging, "*.*")); len(parts) != 0 {
+		t.Errorf("staging directory not cleaned up: %v", parts)
+	}
+
+	// Partial files are removed once stale
+	a.Execute(context.Background(), "req", chunks[0], false)
+	if n, err := a.RemoveStale(time.Hour); err != nil || n != 0 {
+		t.Errorf("RemoveStale(1h) = %d, %v; want 0", n, err)
+	}
+	if n, err := a.RemoveStale(0); err != nil || n != 1 {
+		t.Errorf("RemoveStale(0) = %d, %v; want 1", n, err)
+	}
+	if got := missing(a); got != "0-3" {
+		t.Errorf("missing after RemoveStale = %q, want 0-3", got)
+	}
+}
+
+func TestDeployArtifactPresent(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "app")
+	content := bytes.Repeat([]byte("xyz"), 100)
+	chunks := artifactChunks(dest, content, 200)
+	a := &DeployArtifactAction{Dir: t.TempDir()}
+
+	present := func() *protocol.RunResponse {
+		args := map[string]string{"query": protocol.ArtifactQueryPresent, "mode": "0755"}
+		for _, k := range []string{"dest", "total_chunks", "total_size", "checksum"} {
+			args[k] = chunks[0][k]
+		}
+		resp := a.Execute(context.Background(), "req", args, false)
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("query: %s", resp.Error)
+		}
+		return resp
+	}
+
+	if resp := present(); resp.Stdout != protocol.ArtifactAbsent {
+		t.Errorf("before upload = %q, want %q", resp.Stdout, protocol.ArtifactAbsent)
+	}
+	for _, c := range chunks {
+		c["mode"] = "0755"
+		if resp := a.Execute(context.Background(), "req", c, false); resp.Status != protocol.StatusOK {
+			t.Fatalf("upload: %s", resp.Error)
+		}
+	}
+	if resp := present(); resp.Stdout != protocol.ArtifactPresent || resp.Changed {
+		t.Errorf("after upload = %q changed=%v, want %q unchanged", resp.Stdout, resp.Changed, protocol.ArtifactPresent)
+	}
+
+	// A replaced file is restored from the cache without an upload
+	os.Remove(dest)
+	if err := os.WriteFile(dest, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if resp := present(); resp.Stdout != protocol.ArtifactRestored || !resp.Changed {
+		t.Errorf("after replace = %q changed=%v, want %q changed", resp.Stdout, resp.Changed, protocol.ArtifactRestored)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Errorf("restored file differs from source")
+	}
+
+	// Once pruned, the content has to be uploaded again
+	os.Remove(dest)
+	if n, err := a.PruneCache(0); err != nil || n != 1 {
+		t.Errorf("PruneCache(0) = %d, %v; want 1", n, err)
+	}
+	if resp := present(); resp.Stdout != protocol.ArtifactAbsent {
+		t.Errorf("after prune = %q, want %q", resp.Stdout, protocol.ArtifactAbsent)
+	}
+
+	// Owners that do not resolve are refused before anything is written
+	resp := a.Execute(context.Background(), "req", map[string]string{
+		"query": protocol.ArtifactQueryPresent, "dest": dest, "total_chunks": "1", "owner": "root",
+	}, false)
+	if resp.Status == protocol.StatusOK {
+		t.Errorf("owner without a group was accepted")
+	}
+
+	// Checksums name cache files and must be plain SHA-256 hex
+	resp = a.Execute(context.Background(), "req", map[string]string{
+		"query": protocol.ArtifactQueryPresent, "dest": dest, "total_chunks": "1", "checksum": "../../etc/passwd",
+	}, false)
+	if resp.Status == protocol.StatusOK {
+		t.Errorf("path-like checksum was accepted")
+	}
+}
+
+func TestDeployArtifactModesStayApart(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("same"), 100)
+	a := &DeployArtifactAction{Dir: t.TempDir()}
+
+	// Uploaded once, then restored from the cache with another mode
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	for _, c := range artifactChunks(first, content, 200) {
+		c["mode"] = "0755"
+		if resp := a.Execute(context.Background(), "req", c, false); resp.Status != protocol.StatusOK {
+			t.Fatalf("upload: %s", resp.Error)
+		}
+	}
+	args := artifactChunks(second, content, 200)[0]
+	delete(args, "chunk_data")
+	args["query"], args["mode"] = protocol.ArtifactQueryPresent, "0640"
+	if resp := a.Execute(context.Background(), "req", args, false); resp.Stdout != protocol.ArtifactRestored {
+		t.Fatalf("second deploy = %q (%s), want %q", resp.Stdout, resp.Error, protocol.ArtifactRestored)
+	}
+
+	// Changing one install's mode must not reach the other or the cache
+	args["dest"], args["mode"] = first, "0700"
+	if resp := a.Execute(context.Background(), "req", args, false); resp.Stdout != protocol.ArtifactPresent || !resp.Changed {
+		t.Fatalf("mode change = %q changed=%v (%s)", resp.Stdout, resp.Changed, resp.Error)
+	}
+
+	sum := sha256.Sum256(content)
+	for path, want := range map[string]os.FileMode{
+		first:                                   0700,
+		second:                                  0640,
+		a.cachePath(hex.EncodeToString(sum[:])): 0600, // As copyFile creates it
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s mode = %v, want %v", filepath.Base(path), info.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestFileAttrs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chowning a file to its own owner needs no privileges
+	attrs := fileAttrs{mode: 0755, owner: fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}
+	if ok, err := attrs.matches(path); err != nil || ok {
+		t.Errorf("matches before apply = %v, %v; want false", ok, err)
+	}
+	if err := attrs.apply(path); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if ok, err := attrs.matches(path); err != nil || !ok {
+		t.Errorf("matches after apply = %v, %v; want true", ok, err)
+	}
+
+	// Special bits count, and survive the owner being set
+	attrs.mode = 0755 | os.ModeSetuid | os.ModeSetgid
+	if ok, err := attrs.matches(path); err != nil || ok {
+		t.Errorf("matches without setuid/setgid = %v, %v; want false", ok, err)
+	}
+	if err := attrs.apply(path); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if ok, err := attrs.matches(path); err != nil || !ok {
+		t.Errorf("matches after applying setuid/setgid = %v, %v; want true", ok, err)
+	}
+
+	if _, _, err := lookupOwner("no-such-user-xyz:no-such-group-xyz"); err == nil {
+		t.Errorf("unknown owner resolved")
+	}
+}
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want os.FileMode
+		ok   bool
+	}{
+		{"0644", 0644, true},
+		{"755", 0755, true},
+		{"4755", 0755 | os.ModeSetuid, true},
+		{"2750", 0750 | os.ModeSetgid, true},
+		{"1777", 0777 | os.ModeSticky, true},
+		{"07777", 0777 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky, true},
+		{"10000", 0, false},
+		{"0855", 0, false},
+		{"rwx", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseFileMode(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseFileMode(%q) = %v, %v; want %v, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+
+	// A bad mode fails the request instead of falling back to 0644
+	if _, _, err := parseInstallArgs(map[string]string{"mode": "0x755"}); err == nil {
+		t.Error("parseInstallArgs accepted an unparsable mode")
+	}
+}
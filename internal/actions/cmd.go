@@ -1,21 +1,25 @@
 package actions
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/drax2gma/stapply/internal/protocol"
 )
 
+// killWaitDelay bounds how long a killed command may keep its output pipes open.
+const killWaitDelay = 2 * time.Second
+
 // CmdAction executes shell commands.
 type CmdAction struct{}
 
 // Execute runs a shell command and returns the result.
-func (a *CmdAction) Execute(requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
+func (a *CmdAction) Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
 	start := time.Now()
 
 	command, ok := args["command"]
@@ -72,14 +76,31 @@ func (a *CmdAction) Execute(requestID string, args map[string]string, dryRun boo
 		}
 	}
 
-	// Execute command via shell
-	cmd := exec.Command("sh", "-c", command)
+	// Execute command via shell in its own process group so that a timeout
+	// kills every child it spawned, not just the shell.
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait forever for pipes held open by escaped grandchildren
+	cmd.WaitDelay = killWaitDelay
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Capture output, forwarding lines live when the caller asked for it
+	output := outputFrom(ctx)
+	stdout := newLineWriter("stdout", output)
+	stderr := newLineWriter("stderr", output)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	err := cmd.Run()
+	stdout.Flush()
+	stderr.Flush()
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return contextResponse(requestID, ctxErr, stdout.String(), stderr.String(),
+			time.Since(start).Milliseconds())
+	}
 
 	exitCode := 0
 	if err != nil {
@@ -99,3 +120,17 @@ func (a *CmdAction) Execute(requestID string, args map[string]string, dryRun boo
 		time.Since(start).Milliseconds(),
 	)
 }
+
+// contextResponse builds the response for a command interrupted by its context.
+func contextResponse(requestID string, ctxErr error, stdout, stderr string, durationMs int64) *protocol.RunResponse {
+	switch ctxErr {
+	case context.DeadlineExceeded:
+		return protocol.NewTimeoutResponse(requestID, stdout, stderr, durationMs)
+	case context.Canceled:
+		return protocol.NewCancelledResponse(requestID, stdout, stderr, durationMs)
+	}
+	resp := protocol.NewErrorResponse(requestID, ctxErr, durationMs)
+	resp.Stdout = stdout
+	resp.Stderr = stderr
+	return resp
+}
@@ -0,0 +1,81 @@
+package actions
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+// running reports whether pid is a live process. Zombies count as gone: the
+// test may run where nobody reaps orphans.
+func running(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestCmdTimeoutKillsProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	resp := (&CmdAction{}).Execute(ctx, "r1", map[string]string{
+		"command": "echo hi; sleep 30 & echo $! > " + pidFile + "; sleep 30",
+	}, false)
+	elapsed := time.Since(start)
+
+	if resp.Status != protocol.StatusTimeout {
+		t.Errorf("status = %s (%s), want %s", resp.Status, resp.Error, protocol.StatusTimeout)
+	}
+	if !strings.Contains(resp.Stdout, "hi") {
+		t.Errorf("stdout = %q, want the output written before the timeout", resp.Stdout)
+	}
+	// The background child holds stdout open too; without the group kill
+	// only WaitDelay would end the wait
+	if elapsed >= killWaitDelay {
+		t.Errorf("Execute() took %s, want well under %s", elapsed, killWaitDelay)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for running(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("background child %d survived the timeout", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCmdCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	resp := (&CmdAction{}).Execute(ctx, "r1", map[string]string{"command": "echo hi; sleep 30"}, false)
+	if resp.Status != protocol.StatusCancelled {
+		t.Errorf("status = %s (%s), want %s", resp.Status, resp.Error, protocol.StatusCancelled)
+	}
+	if !strings.Contains(resp.Stdout, "hi") {
+		t.Errorf("stdout = %q, want the output written before cancellation", resp.Stdout)
+	}
+	if resp.DurationMs >= killWaitDelay.Milliseconds() {
+		t.Errorf("duration = %dms, want well under %s", resp.DurationMs, killWaitDelay)
+	}
+}
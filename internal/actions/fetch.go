@@ -0,0 +1,172 @@
+package actions
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/security"
+)
+
+// fetchAttempts is how often FetchArtifactAction tries to download an
+// artifact before giving up.
+const fetchAttempts = 3
+
+// fetchBackoff is the wait before the first retry; it doubles with each.
+var fetchBackoff = 2 * time.Second
+
+// FetchArtifactAction installs an artifact the controller uploaded once to
+// shared storage (the JetStream object store) for many agents to pull,
+// instead of sending it to each of them in chunks. The object is encrypted
+// with a content key (see security.ContentCipher) passed in the request.
+// Failed downloads are retried, and content already in dest, an earlier
+// release or the cache of Artifacts is not downloaded at all.
+type FetchArtifactAction struct {
+	Artifacts *DeployArtifactAction // Shares its staging directory, cache and locks
+
+	// Open returns a reader of the object name in bucket.
+	Open func(ctx context.Context, bucket, name string) (io.ReadCloser, error)
+}
+
+func (a *FetchArtifactAction) Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
+	start := time.Now()
+	for _, k := range []string{"bucket", "object", "dest", "checksum", "key"} {
+		if args[k] == "" {
+			return protocol.NewErrorResponse(requestID,
+				&ActionError{Action: "fetch_artifact", Err: ErrMissingArg(k)}, 0)
+		}
+	}
+	bucket, object := args["bucket"], args["object"]
+
+	want := &partManifest{Dest: args["dest"], Checksum: args["checksum"], Size: -1, Total: 1}
+	if b, err := hex.DecodeString(want.Checksum); err != nil || len(b) != sha256.Size {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'checksum': %q", want.Checksum), 0)
+	}
+	if s := args["total_size"]; s != "" {
+		var err error
+		if want.Size, err = strconv.ParseInt(s, 10, 64); err != nil || want.Size < 0 {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'total_size': %q", s), 0)
+		}
+	}
+	key, err := hex.DecodeString(args["key"])
+	if err != nil || len(key) != sha256.Size {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("invalid 'key'"), 0)
+	}
+	attrs, releases, err := parseInstallArgs(args)
+	if err != nil {
+		return protocol.NewErrorResponse(requestID, err, 0)
+	}
+
+	if dryRun {
+		return protocol.NewRunResponse(requestID, false, 0,
+			fmt.Sprintf("Would fetch %s/%s to %s", bucket, object, want.Dest), "", time.Since(start).Milliseconds())
+	}
+
+	// Nothing to download if the content is already on this host
+	resp := a.Artifacts.queryPresent(requestID, want, attrs, releases)
+	switch {
+	case resp.Status != protocol.StatusOK:
+		return resp
+	case resp.Stdout == protocol.ArtifactPresent:
+		resp.Stdout = "Already present in " + want.Dest
+		return resp
+	case resp.Stdout == protocol.ArtifactRestored:
+		resp.Stdout = "Restored from an earlier release or the cache"
+		return resp
+	}
+
+	var path string
+	for attempt := 1; ; attempt++ {
+		path, err = a.download(ctx, bucket, object, key, want)
+		if err == nil || attempt == fetchAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(fetchBackoff << (attempt - 1)):
+		}
+	}
+	if err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("fetch %s/%s: %v", bucket, object, err), time.Since(start).Milliseconds())
+	}
+	defer os.Remove(path)
+
+	defer a.Artifacts.lock(want.Dest)()
+	a.Artifacts.addToCache(path, want.Checksum)
+	msg := fmt.Sprintf("Fetched %s/%s - Checksum Verified ✅", bucket, object)
+	if releases > 0 {
+		release, err := installRelease(path, want.Dest, want.Checksum, attrs, false, releases)
+		if err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to install release in %s: %v", want.Dest, err), 0)
+		}
+		msg += fmt.Sprintf(" - current -> %s", release)
+	} else if err := installFile(path, want.Dest, attrs, false); err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to install %s: %v", want.Dest, err), 0)
+	}
+	return protocol.NewRunResponse(requestID, true, 0, msg, "", time.Since(start).Milliseconds())
+}
+
+// download decrypts the object into a new file in the staging directory and
+// returns its path once its size and checksum match want.
+func (a *FetchArtifactAction) download(ctx context.Context, bucket, name string, key []byte, want *partManifest) (string, error) {
+	stream, err := security.ContentCipher(key)
+	if err != nil {
+		return "", err
+	}
+	r, err := a.Open(ctx, bucket, name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(a.Artifacts.dir(), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(a.Artifacts.dir(), "fetch-*"+partSuffix)
+	if err != nil {
+		return "", err
+	}
+	done := false
+	defer func() {
+		f.Close()
+		if !done {
+			os.Remove(f.Name())
+		}
+	}()
+
+	// A byte past the expected size is enough to tell the object is too
+	// large, so an oversized object cannot fill the disk
+	var body io.Reader = r
+	if want.Size >= 0 {
+		body = io.LimitReader(r, want.Size+1)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), cipher.StreamReader{S: stream, R: body})
+	if err != nil {
+		return "", err
+	}
+	if want.Size >= 0 && n > want.Size {
+		return "", fmt.Errorf("object is larger than the expected %d bytes", want.Size)
+	}
+	if want.Size >= 0 && n != want.Size {
+		return "", fmt.Errorf("size mismatch: expected %d, got %d", want.Size, n)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != want.Checksum {
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", want.Checksum, sum)
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	done = true
+	return f.Name(), nil
+}
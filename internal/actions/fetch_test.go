@@ -0,0 +1,118 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/drax2gma/stapply/internal/security"
+)
+
+func TestFetchArtifact(t *testing.T) {
+	defer func(d time.Duration) { fetchBackoff = d }(fetchBackoff)
+	fetchBackoff = 0
+
+	content := bytes.Repeat([]byte("fan-out "), 1000)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	contentKey := func(secret string) []byte {
+		keyHash := security.ContentKey(secret)
+		keyHash.Write(content)
+		return keyHash.Sum(nil)
+	}
+	key := contentKey("shared secret")
+	if bytes.Equal(key, sum[:]) {
+		t.Fatal("content key equals the checksum")
+	}
+	if bytes.Equal(key, contentKey("")) || bytes.Equal(key, contentKey("other secret")) {
+		t.Fatal("content key does not depend on the secret")
+	}
+	stream, err := security.ContentCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := make([]byte, len(content))
+	stream.XORKeyStream(object, content)
+
+	opens := 0
+	a := &FetchArtifactAction{
+		Artifacts: &DeployArtifactAction{Dir: t.TempDir()},
+		Open: func(ctx context.Context, bucket, name string) (io.ReadCloser, error) {
+			opens++
+			return io.NopCloser(bytes.NewReader(object)), nil
+		},
+	}
+	dest := filepath.Join(t.TempDir(), "app")
+	args := map[string]string{
+		"bucket":     "stapply-artifacts",
+		"object":     checksum,
+		"key":        hex.EncodeToString(key),
+		"dest":       dest,
+		"checksum":   checksum,
+		"total_size": strconv.Itoa(len(content)),
+		"mode":       "0755",
+	}
+
+	resp := a.Execute(context.Background(), "req", args, false)
+	if resp.Status != protocol.StatusOK || !resp.Changed {
+		t.Fatalf("fetch: status=%s changed=%v error=%s", resp.Status, resp.Changed, resp.Error)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Errorf("fetched file differs from source")
+	}
+
+	// Content already in place is not downloaded again
+	resp = a.Execute(context.Background(), "req", args, false)
+	if resp.Status != protocol.StatusOK || resp.Changed || opens != 1 {
+		t.Errorf("refetch: status=%s changed=%v opens=%d, want unchanged without download", resp.Status, resp.Changed, opens)
+	}
+
+	// A wrong key yields garbage, which fails the checksum on every attempt
+	os.Remove(dest)
+	a.Artifacts.PruneCache(0)
+	opens = 0
+	wrong := sha256.Sum256([]byte("wrong"))
+	args["key"] = hex.EncodeToString(wrong[:])
+	resp = a.Execute(context.Background(), "req", args, false)
+	if resp.Status == protocol.StatusOK || opens != fetchAttempts {
+		t.Errorf("wrong key: status=%s opens=%d, want error after %d attempts", resp.Status, opens, fetchAttempts)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("dest written despite checksum mismatch")
+	}
+	if left, _ := filepath.Glob(filepath.Join(a.Artifacts.dir(), "*"+partSuffix)); len(left) != 0 {
+		t.Errorf("failed downloads left %v", left)
+	}
+
+	// Objects longer than total_size are cut off after one extra byte
+	args["key"] = hex.EncodeToString(key)
+	read := 0
+	a.Open = func(ctx context.Context, bucket, name string) (io.ReadCloser, error) {
+		return io.NopCloser(io.TeeReader(io.MultiReader(bytes.NewReader(object), bytes.NewReader(make([]byte, 1<<20))),
+			writerFunc(func(p []byte) { read += len(p) }))), nil
+	}
+	resp = a.Execute(context.Background(), "req", args, false)
+	if resp.Status == protocol.StatusOK {
+		t.Error("oversized object was accepted")
+	}
+	if limit := fetchAttempts * (len(object) + 1); read > limit {
+		t.Errorf("read %d bytes of oversized objects, want at most %d", read, limit)
+	}
+}
+
+// writerFunc is an io.Writer calling a function with everything written.
+type writerFunc func(p []byte)
+
+func (w writerFunc) Write(p []byte) (int, error) {
+	w(p)
+	return len(p), nil
+}
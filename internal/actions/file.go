@@ -2,14 +2,17 @@ package actions
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"text/template"
 	"time"
@@ -21,7 +24,7 @@ import (
 type WriteFileAction struct{}
 
 // Execute writes a file and detects changes via hash comparison.
-func (a *WriteFileAction) Execute(requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
+func (a *WriteFileAction) Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
 	start := time.Now()
 
 	// Validate required args
@@ -176,11 +179,35 @@ func computeHash(data []byte) string {
 
 // applyMode applies octal file mode.
 func applyMode(path, modeStr string) error {
-	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	mode, err := parseFileMode(modeStr)
 	if err != nil {
-		return fmt.Errorf("invalid mode %q: %w", modeStr, err)
+		return err
 	}
-	return os.Chmod(path, os.FileMode(mode))
+	return os.Chmod(path, mode)
+}
+
+// modeBits are the bits of an os.FileMode that a chmod sets.
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// parseFileMode parses an octal mode of up to 07777. The setuid, setgid and
+// sticky bits have their own os.FileMode flags rather than their octal
+// values, so they are mapped onto those.
+func parseFileMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, fmt.Errorf("invalid mode %q (expected octal, e.g. 0755)", s)
+	}
+	mode := os.FileMode(m) & os.ModePerm
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
 }
 
 // applyOwner applies user:group ownership.
@@ -206,6 +233,29 @@ func applyOwner(path, owner string) error {
 	return nil
 }
 
+// lookupOwner resolves a "user:group" owner, by name or numeric ID, to its IDs.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	u, g, ok := strings.Cut(owner, ":")
+	if !ok || u == "" || g == "" {
+		return 0, 0, fmt.Errorf("invalid owner format %q (expected user:group)", owner)
+	}
+	if uid, err = strconv.Atoi(u); err != nil {
+		usr, err := user.Lookup(u)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(usr.Uid)
+	}
+	if gid, err = strconv.Atoi(g); err != nil {
+		grp, err := user.LookupGroup(g)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(grp.Gid)
+	}
+	return uid, gid, nil
+}
+
 // getFileOwner retrieves current file ownership.
 func getFileOwner(path string) (uid, gid int, err error) {
 	info, err := os.Stat(path)
@@ -0,0 +1,87 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// OutputFunc receives command output line by line as it is produced.
+// stream is either "stdout" or "stderr". It may be called concurrently.
+type OutputFunc func(stream, line string)
+
+type outputKey struct{}
+
+// WithOutput returns a context that makes actions report output to fn
+// while they run, in addition to returning it in the final response.
+func WithOutput(ctx context.Context, fn OutputFunc) context.Context {
+	return context.WithValue(ctx, outputKey{}, fn)
+}
+
+// outputFrom returns the OutputFunc attached to ctx, if any.
+func outputFrom(ctx context.Context) OutputFunc {
+	fn, _ := ctx.Value(outputKey{}).(OutputFunc)
+	return fn
+}
+
+// maxLineLength is the longest line forwarded to an OutputFunc. Longer
+// lines, e.g. progress output without newlines, are forwarded in pieces of
+// this size so the pending line cannot grow without bound.
+const maxLineLength = 8 << 10
+
+// lineWriter captures everything written to it and forwards complete
+// lines to an OutputFunc.
+type lineWriter struct {
+	mu      sync.Mutex
+	stream  string
+	fn      OutputFunc
+	buf     bytes.Buffer // full captured output
+	partial []byte       // incomplete trailing line
+}
+
+func newLineWriter(stream string, fn OutputFunc) *lineWriter {
+	return &lineWriter{stream: stream, fn: fn}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	if w.fn == nil {
+		return len(p), nil
+	}
+
+	w.partial = append(w.partial, p...)
+	for {
+		idx := bytes.IndexByte(w.partial, '\n')
+		if idx == -1 {
+			break
+		}
+		w.fn(w.stream, string(w.partial[:idx]))
+		w.partial = w.partial[idx+1:]
+	}
+	for len(w.partial) >= maxLineLength {
+		w.fn(w.stream, string(w.partial[:maxLineLength]))
+		w.partial = w.partial[maxLineLength:]
+	}
+	return len(p), nil
+}
+
+// Flush forwards any unterminated trailing line.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.fn != nil && len(w.partial) > 0 {
+		w.fn(w.stream, string(w.partial))
+		w.partial = nil
+	}
+}
+
+// String returns everything written so far.
+func (w *lineWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
@@ -0,0 +1,32 @@
+package actions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := newLineWriter("stdout", func(stream, line string) { lines = append(lines, line) })
+
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\n"))
+	if len(lines) != 2 || lines[0] != "one" || lines[1] != "two" {
+		t.Fatalf("lines = %q, want [one two]", lines)
+	}
+
+	// Output without newlines is forwarded in pieces, not buffered forever
+	lines = nil
+	long := strings.Repeat("x", 2*maxLineLength+10)
+	w.Write([]byte(long))
+	if len(lines) != 2 || len(w.partial) != 10 {
+		t.Fatalf("got %d line(s) with %d bytes pending, want 2 with 10", len(lines), len(w.partial))
+	}
+	w.Flush()
+	if got := strings.Join(lines, ""); got != long {
+		t.Errorf("forwarded %d bytes, want %d", len(got), len(long))
+	}
+	if w.String() != "one\ntwo\n"+long {
+		t.Errorf("captured output differs from what was written")
+	}
+}
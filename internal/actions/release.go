@@ -0,0 +1,237 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+// Layout of a release directory: every deployed version lives in
+// releases/<id>, and the current symlink points at the active one. The
+// history file lists the releases current pointed at before each switch,
+// oldest first, so a rollback returns to the release that was actually
+// running rather than the one whose name sorts before it.
+const (
+	releasesDir = "releases"
+	currentLink = "current"
+	historyFile = "history"
+)
+
+// maxHistory bounds the history file; older entries are dropped.
+const maxHistory = 100
+
+// releaseID names a release after its deploy time and content, so names
+// sort in deploy order.
+func releaseID(checksum string) string {
+	return time.Now().UTC().Format("20060102-150405.000") + "-" + checksum[:12]
+}
+
+// listReleases returns the releases under root, oldest first.
+func listReleases(root string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(root, releasesDir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// currentRelease returns the release the current link of root points at.
+func currentRelease(root string) (string, error) {
+	target, err := os.Readlink(filepath.Join(root, currentLink))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// switchCurrent points the current link of root at release and records the
+// release it pointed at before in the history.
+func switchCurrent(root, release string) error {
+	if old, err := currentRelease(root); err == nil && old != release {
+		history, err := readHistory(root)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		history = append(history, old)
+		if len(history) > maxHistory {
+			history = history[len(history)-maxHistory:]
+		}
+		if err := writeHistory(root, history); err != nil {
+			return err
+		}
+	}
+	return pointCurrent(root, release)
+}
+
+// pointCurrent points the current link of root at release, replacing the
+// old link in one step.
+func pointCurrent(root, release string) error {
+	tmp := filepath.Join(root, "."+currentLink+".tmp")
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(releasesDir, release), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(root, currentLink)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(root)
+}
+
+// readHistory returns the releases listed in the history of root, oldest
+// first.
+func readHistory(root string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(root, historyFile))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// writeHistory replaces the history of root.
+func writeHistory(root string, history []string) error {
+	path := filepath.Join(root, historyFile)
+	tmp := path + ".tmp"
+	var data []byte
+	for _, r := range history {
+		data = append(data, r+"\n"...)
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// installRelease installs src (see installFile) as a new release under root,
+// switches current to it and removes the oldest releases beyond keep. It
+// returns the new release's name.
+func installRelease(src, root, checksum string, attrs fileAttrs, keepSrc bool, keep int) (string, error) {
+	if err := os.MkdirAll(filepath.Join(root, releasesDir), 0755); err != nil {
+		return "", err
+	}
+	release := releaseID(checksum)
+	if err := installFile(src, filepath.Join(root, releasesDir, release), attrs, keepSrc); err != nil {
+		return "", err
+	}
+	if err := switchCurrent(root, release); err != nil {
+		return "", err
+	}
+	pruneReleases(root, keep)
+	return release, nil
+}
+
+// pruneReleases removes the oldest releases of root until keep are left.
+// The current release is never removed.
+func pruneReleases(root string, keep int) {
+	releases, err := listReleases(root)
+	if err != nil {
+		return
+	}
+	current, _ := currentRelease(root)
+	excess := len(releases) - keep
+	for _, r := range releases {
+		if excess <= 0 {
+			break
+		}
+		if r != current && os.Remove(filepath.Join(root, releasesDir, r)) == nil {
+			excess--
+		}
+	}
+}
+
+// findRelease returns the newest release of root with the given content,
+// or "" if there is none.
+func findRelease(root string, size int64, checksum string) string {
+	releases, _ := listReleases(root)
+	for i := len(releases) - 1; i >= 0; i-- {
+		r := releases[i]
+		if strings.HasSuffix(r, "-"+checksum[:12]) && matchesChecksum(filepath.Join(root, releasesDir, r), size, checksum) {
+			return r
+		}
+	}
+	return ""
+}
+
+// RollbackArtifactAction points the current link of a release directory
+// (see deploy_artifact with releases) back at the release that was current
+// before it, as recorded in the history. Release directories without a
+// history, written by agents that predate it, go back to the release whose
+// name sorts before the current one.
+type RollbackArtifactAction struct{}
+
+func (a *RollbackArtifactAction) Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
+	start := time.Now()
+	root := args["dest"]
+	if root == "" {
+		return protocol.NewErrorResponse(requestID,
+			&ActionError{Action: "rollback_artifact", Err: ErrMissingArg("dest")}, 0)
+	}
+	defer destLocks.lock(root)()
+
+	releases, err := listReleases(root)
+	if err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("no releases in %s: %w", root, err), 0)
+	}
+	current, err := currentRelease(root)
+	if err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("no current release in %s: %w", root, err), 0)
+	}
+	i := sort.SearchStrings(releases, current)
+	if i == len(releases) || releases[i] != current {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("current release %s of %s is missing", current, root), 0)
+	}
+
+	history, err := readHistory(root)
+	legacy := os.IsNotExist(err)
+	if legacy {
+		if i == 0 {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("%s is the oldest release in %s, nothing to roll back to", current, root), 0)
+		}
+		history, err = releases[i-1:i], nil
+	}
+	if err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to read history of %s: %w", root, err), 0)
+	}
+
+	// Entries for releases pruned since, or for current itself, are skipped
+	previous := ""
+	for previous == "" && len(history) > 0 {
+		r := history[len(history)-1]
+		history = history[:len(history)-1]
+		if j := sort.SearchStrings(releases, r); r != current && j < len(releases) && releases[j] == r {
+			previous = r
+		}
+	}
+	if previous == "" {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("no earlier release of %s to roll back to", root), 0)
+	}
+
+	msg := fmt.Sprintf("current: %s -> %s", current, previous)
+	if dryRun {
+		return protocol.NewRunResponse(requestID, false, 0, "Would switch "+msg, "", time.Since(start).Milliseconds())
+	}
+	// The history loses the entries rolled back over, so a second rollback
+	// goes further back instead of returning to current
+	if !legacy {
+		if err := writeHistory(root, history); err != nil {
+			return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to update history of %s: %w", root, err), time.Since(start).Milliseconds())
+		}
+	}
+	if err := pointCurrent(root, previous); err != nil {
+		return protocol.NewErrorResponse(requestID, fmt.Errorf("failed to switch %s: %w", root, err), time.Since(start).Milliseconds())
+	}
+	return protocol.NewRunResponse(requestID, true, 0, msg, "", time.Since(start).Milliseconds())
+}
@@ -0,0 +1,106 @@
+package actions
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+)
+
+func TestArtifactReleases(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "app")
+	a := &DeployArtifactAction{Dir: t.TempDir()}
+	current := filepath.Join(root, currentLink)
+
+	deploy := func(content []byte) {
+		t.Helper()
+		for _, c := range artifactChunks(root, content, 64) {
+			c["releases"] = "2"
+			if resp := a.Execute(context.Background(), "req", c, false); resp.Status != protocol.StatusOK {
+				t.Fatalf("deploy: %s", resp.Error)
+			}
+		}
+		if got, err := os.ReadFile(current); err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("current = %q, %v; want %q", got, err, content)
+		}
+	}
+	v1, v2, v3 := []byte("version one"), []byte("version two"), bytes.Repeat([]byte("version three "), 10)
+	deploy(v1)
+	deploy(v2)
+	deploy(v3)
+
+	if releases, _ := listReleases(root); len(releases) != 2 {
+		t.Errorf("releases kept = %v, want 2", releases)
+	}
+
+	rollback := &RollbackArtifactAction{}
+	if resp := rollback.Execute(context.Background(), "req", map[string]string{"dest": root}, false); resp.Status != protocol.StatusOK {
+		t.Fatalf("rollback: %s", resp.Error)
+	}
+	if got, _ := os.ReadFile(current); !bytes.Equal(got, v2) {
+		t.Errorf("after rollback current = %q, want %q", got, v2)
+	}
+	if resp := rollback.Execute(context.Background(), "req", map[string]string{"dest": root}, false); resp.Status == protocol.StatusOK {
+		t.Errorf("rollback past the oldest release succeeded")
+	}
+
+	// Deploying v3 again only switches the link back
+	args := map[string]string{"query": protocol.ArtifactQueryPresent, "releases": "2"}
+	for k, v := range artifactChunks(root, v3, 64)[0] {
+		if k == "dest" || k == "total_chunks" || k == "total_size" || k == "checksum" {
+			args[k] = v
+		}
+	}
+	args["mode"] = "0644"
+	resp := a.Execute(context.Background(), "req", args, false)
+	if resp.Status != protocol.StatusOK || resp.Stdout != protocol.ArtifactRestored {
+		t.Errorf("present query = %q (%s), want %q", resp.Stdout, resp.Error, protocol.ArtifactRestored)
+	}
+	if got, _ := os.ReadFile(current); !bytes.Equal(got, v3) {
+		t.Errorf("after redeploy current = %q, want v3", got)
+	}
+}
+
+func TestRollbackFollowsHistory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "app")
+	a := &DeployArtifactAction{Dir: t.TempDir()}
+	current := filepath.Join(root, currentLink)
+	v1, v2 := []byte("version one"), []byte("version two")
+
+	upload := func(content []byte) {
+		t.Helper()
+		for _, c := range artifactChunks(root, content, 64) {
+			c["releases"] = "5"
+			if resp := a.Execute(context.Background(), "req", c, false); resp.Status != protocol.StatusOK {
+				t.Fatalf("deploy: %s", resp.Error)
+			}
+		}
+	}
+	upload(v1)
+	upload(v2)
+
+	// Redeploying v1 switches back to its release, whose name sorts first
+	args := artifactChunks(root, v1, 64)[0]
+	delete(args, "chunk_data")
+	args["query"], args["releases"] = protocol.ArtifactQueryPresent, "5"
+	if resp := a.Execute(context.Background(), "req", args, false); resp.Stdout != protocol.ArtifactRestored {
+		t.Fatalf("redeploy = %q (%s), want %q", resp.Stdout, resp.Error, protocol.ArtifactRestored)
+	}
+
+	// Rolling back returns to v2, which was running before, and then to v1
+	rollback := &RollbackArtifactAction{}
+	for _, want := range [][]byte{v2, v1} {
+		if resp := rollback.Execute(context.Background(), "req", map[string]string{"dest": root}, false); resp.Status != protocol.StatusOK {
+			t.Fatalf("rollback: %s", resp.Error)
+		}
+		if got, _ := os.ReadFile(current); !bytes.Equal(got, want) {
+			t.Errorf("after rollback current = %q, want %q", got, want)
+		}
+	}
+	if resp := rollback.Execute(context.Background(), "req", map[string]string{"dest": root}, false); resp.Status == protocol.StatusOK {
+		t.Errorf("rollback with an exhausted history succeeded")
+	}
+}
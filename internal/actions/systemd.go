@@ -2,6 +2,7 @@ package actions
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
@@ -14,7 +15,7 @@ import (
 type SystemdAction struct{}
 
 // Execute performs systemd operations with change detection.
-func (a *SystemdAction) Execute(requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
+func (a *SystemdAction) Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
 	start := time.Now()
 
 	// Validate args
@@ -99,16 +100,21 @@ func (a *SystemdAction) Execute(requestID string, args map[string]string, dryRun
 	// Execute systemd command
 	var cmd *exec.Cmd
 	if action == "daemon-reload" {
-		cmd = exec.Command("systemctl", "daemon-reload")
+		cmd = exec.CommandContext(ctx, "systemctl", "daemon-reload")
 	} else {
-		cmd = exec.Command("systemctl", action, args["unit"])
+		cmd = exec.CommandContext(ctx, "systemctl", action, args["unit"])
 	}
+	cmd.WaitDelay = killWaitDelay
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	err := cmd.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return contextResponse(requestID, ctxErr, stdout.String(), stderr.String(),
+			time.Since(start).Milliseconds())
+	}
 	exitCode := 0
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
@@ -2,6 +2,7 @@ package actions
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -15,7 +16,7 @@ import (
 type TemplateFileAction struct{}
 
 // Execute renders a template and writes to file with change detection.
-func (a *TemplateFileAction) Execute(requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
+func (a *TemplateFileAction) Execute(ctx context.Context, requestID string, args map[string]string, dryRun bool) *protocol.RunResponse {
 	start := time.Now()
 
 	// Validate required args
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/drax2gma/stapply/internal/netutil"
+)
+
+// Context is a named set of controller connection settings from contexts.ini.
+type Context struct {
+	Name          string
+	NatsURLs      []string          // Servers tried in order (empty = command default)
+	NatsCreds     string            // NATS credentials file (JWT + nkey seed)
+	TLS           netutil.TLSConfig // CA, client cert and key for tls:// servers
+	KeyEnv        string            // Environment variable holding the encryption key
+	KeyFile       string            // File holding the encryption key
+	SubjectPrefix string            // First token of all subjects (empty = "stapply")
+	AllowPublic   bool              // Allow connecting to public IPs
+}
+
+// Contexts holds all contexts of a contexts.ini file.
+type Contexts struct {
+	Path     string
+	Current  string // current_context from the file
+	Contexts map[string]*Context
+}
+
+// DefaultContextsPath returns STAPPLY_CONTEXTS or ~/.config/stapply/contexts.ini.
+func DefaultContextsPath() string {
+	if path := os.Getenv("STAPPLY_CONTEXTS"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "stapply", "contexts.ini")
+}
+
+// LoadContexts reads a contexts file. A missing file yields no contexts.
+func LoadContexts(path string) (*Contexts, error) {
+	c := &Contexts{Path: path, Contexts: make(map[string]*Context)}
+	if path == "" {
+		return c, nil
+	}
+	sections, err := parseSimpleINI(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	for section, values := range sections {
+		if section == "" {
+			c.Current = values["current_context"]
+			continue
+		}
+		name, ok := strings.CutPrefix(section, "context:")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s: unknown section [%s]", path, section)
+		}
+		ctx, err := parseContext(name, values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: context %s: %w", path, name, err)
+		}
+		c.Contexts[name] = ctx
+	}
+
+	if c.Current != "" && c.Contexts[c.Current] == nil {
+		return nil, fmt.Errorf("%s: current_context %s is not defined", path, c.Current)
+	}
+	return c, nil
+}
+
+// parseContext builds a context from a [context:<name>] section.
+func parseContext(name string, values map[string]string) (*Context, error) {
+	ctx := &Context{Name: name}
+	for key, value := range values {
+		switch key {
+		case "nats_server":
+			ctx.NatsURLs = splitList(value)
+		case "nats_creds":
+			ctx.NatsCreds = expandHome(value)
+		case "tls_ca_file":
+			ctx.TLS.CAFile = expandHome(value)
+		case "tls_cert_file":
+			ctx.TLS.CertFile = expandHome(value)
+		case "tls_key_file":
+			ctx.TLS.KeyFile = expandHome(value)
+		case "key_env":
+			ctx.KeyEnv = value
+		case "key_file":
+			ctx.KeyFile = expandHome(value)
+		case "subject_prefix":
+			ctx.SubjectPrefix = value
+		case "allow_public":
+			ctx.AllowPublic = value == "true" || value == "yes" || value == "1"
+		default:
+			return nil, fmt.Errorf("unknown key: %s", key)
+		}
+	}
+	if ctx.KeyEnv != "" && ctx.KeyFile != "" {
+		return nil, fmt.Errorf("key_env and key_file are mutually exclusive")
+	}
+	return ctx, nil
+}
+
+// Names returns the context names in sorted order.
+func (c *Contexts) Names() []string {
+	names := make([]string, 0, len(c.Contexts))
+	for name := range c.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Active returns the context selected by name, or by STAPPLY_CONTEXT, or the
+// file's current_context, in that order. It returns nil if none is selected.
+func (c *Contexts) Active(name string) (*Context, error) {
+	if name == "" {
+		name = os.Getenv("STAPPLY_CONTEXT")
+	}
+	if name == "" {
+		name = c.Current
+	}
+	if name == "" {
+		return nil, nil
+	}
+	ctx := c.Contexts[name]
+	if ctx == nil {
+		return nil, fmt.Errorf("context %s not found in %s", name, c.Path)
+	}
+	return ctx, nil
+}
+
+// Key returns the encryption key named by the context's key source, or ""
+// if it has none.
+func (ctx *Context) Key() (string, error) {
+	switch {
+	case ctx.KeyEnv != "":
+		return os.Getenv(ctx.KeyEnv), nil
+	case ctx.KeyFile != "":
+		data, err := os.ReadFile(ctx.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("context %s key_file: %w", ctx.Name, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// SetCurrentContext rewrites the current_context line of the contexts file,
+// keeping everything else as written.
+func SetCurrentContext(path, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	line := "current_context = " + name
+	lines := strings.Split(string(data), "\n")
+	replaced := false
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "[") {
+			break // current_context is only valid before the first section
+		}
+		if key, _, ok := strings.Cut(trimmed, "="); ok && strings.TrimSpace(key) == "current_context" {
+			lines[i] = line
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		lines = append([]string{line}, lines...)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// expandHome replaces a leading ~/ with the user's home directory.
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeContexts(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "contexts.ini")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadContexts(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	path := writeContexts(t, `current_context = prod
+
+[context:prod]
+nats_server = tls://nats1:4222, tls://nats2:4222
+nats_creds = ~/prod.creds
+tls_ca_file = /etc/stapply/ca.pem
+key_env = PROD_KEY
+subject_prefix = prod
+allow_public = yes
+
+[context:lab]
+nats_server = nats://lab:4222
+key_file = ~/lab.key
+`)
+
+	c, err := LoadContexts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Current != "prod" || !reflect.DeepEqual(c.Names(), []string{"lab", "prod"}) {
+		t.Fatalf("current = %q, names = %v", c.Current, c.Names())
+	}
+	prod := c.Contexts["prod"]
+	want := &Context{
+		Name:          "prod",
+		NatsURLs:      []string{"tls://nats1:4222", "tls://nats2:4222"},
+		NatsCreds:     filepath.Join(home, "prod.creds"),
+		KeyEnv:        "PROD_KEY",
+		SubjectPrefix: "prod",
+		AllowPublic:   true,
+	}
+	want.TLS.CAFile = "/etc/stapply/ca.pem"
+	if !reflect.DeepEqual(prod, want) {
+		t.Errorf("prod = %+v, want %+v", prod, want)
+	}
+	if got := c.Contexts["lab"].KeyFile; got != filepath.Join(home, "lab.key") {
+		t.Errorf("lab key_file = %q", got)
+	}
+
+	// A missing file is no contexts, not an error
+	c, err = LoadContexts(filepath.Join(t.TempDir(), "missing.ini"))
+	if err != nil || len(c.Contexts) != 0 {
+		t.Errorf("LoadContexts(missing) = %+v, %v", c, err)
+	}
+}
+
+func TestLoadContextsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown section", "[prod]\nnats_server = nats://a\n", "unknown section"},
+		{"empty context name", "[context:]\nnats_server = nats://a\n", "unknown section"},
+		{"unknown key", "[context:prod]\nnats_url = nats://a\n", "unknown key: nats_url"},
+		{"two key sources", "[context:prod]\nkey_env = K\nkey_file = /k\n", "mutually exclusive"},
+		{"undefined current", "current_context = lab\n[context:prod]\n", "current_context lab is not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadContexts(writeContexts(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadContexts() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestActiveContext(t *testing.T) {
+	c := &Contexts{
+		Path:     "contexts.ini",
+		Current:  "prod",
+		Contexts: map[string]*Context{"prod": {Name: "prod"}, "lab": {Name: "lab"}},
+	}
+
+	t.Setenv("STAPPLY_CONTEXT", "")
+	if ctx, err := c.Active(""); err != nil || ctx.Name != "prod" {
+		t.Errorf("Active(\"\") = %v, %v, want current_context prod", ctx, err)
+	}
+	t.Setenv("STAPPLY_CONTEXT", "lab")
+	if ctx, err := c.Active(""); err != nil || ctx.Name != "lab" {
+		t.Errorf("Active(\"\") = %v, %v, want STAPPLY_CONTEXT lab", ctx, err)
+	}
+	if ctx, err := c.Active("prod"); err != nil || ctx.Name != "prod" {
+		t.Errorf("Active(prod) = %v, %v, want the named context", ctx, err)
+	}
+	if _, err := c.Active("staging"); err == nil {
+		t.Error("Active(staging) succeeded for an undefined context")
+	}
+
+	t.Setenv("STAPPLY_CONTEXT", "")
+	none := &Contexts{Contexts: map[string]*Context{}}
+	if ctx, err := none.Active(""); ctx != nil || err != nil {
+		t.Errorf("Active() without a selection = %v, %v, want nil", ctx, err)
+	}
+}
+
+func TestSetCurrentContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			"replace",
+			"# comment\ncurrent_context = prod\n\n[context:prod]\n[context:lab]\n",
+			"# comment\ncurrent_context = lab\n\n[context:prod]\n[context:lab]\n",
+		},
+		{
+			"insert",
+			"[context:prod]\n[context:lab]\n",
+			"current_context = lab\n[context:prod]\n[context:lab]\n",
+		},
+		{
+			// A key of that name inside a section is not the file's setting
+			"only before sections",
+			"[context:prod]\ncurrent_context = prod\n[context:lab]\n",
+			"current_context = lab\n[context:prod]\ncurrent_context = prod\n[context:lab]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeContexts(t, tt.content)
+			if err := SetCurrentContext(path, "lab"); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("file = %q, want %q", data, tt.want)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("mode = %v, want 0600 kept", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	t.Setenv("HOME", "/home/ops")
+	tests := map[string]string{
+		"~/keys/prod.key": "/home/ops/keys/prod.key",
+		"/etc/ca.pem":     "/etc/ca.pem",
+		"~other/file":     "~other/file",
+		"relative/~/file": "relative/~/file",
+	}
+	for in, want := range tests {
+		if got := expandHome(in); got != want {
+			t.Errorf("expandHome(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
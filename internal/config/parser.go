@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -83,6 +85,14 @@ func Parse(path string) (*Config, error) {
 		return nil, fmt.Errorf("scan config: %w", err)
 	}
 
+	for _, app := range cfg.Apps {
+		for num, step := range app.Steps {
+			if step.Action == "" {
+				return nil, fmt.Errorf("app %s: step%d has options but no step%d", app.Name, num, num)
+			}
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -116,6 +126,8 @@ func (c *Config) setKeyValue(section, name, key, value string, lineNum int) erro
 				}
 				env.Concurrency = n
 			}
+		case "key_env":
+			env.KeyEnv = value
 		default:
 			// Check for var1=, var2=, etc.
 			if strings.HasPrefix(key, "var") {
@@ -142,22 +154,49 @@ func (c *Config) setKeyValue(section, name, key, value string, lineNum int) erro
 			host.AgentID = value
 		case "tags":
 			host.Tags = parseList(value)
+		case "key_env":
+			host.KeyEnv = value
 		default:
 			return fmt.Errorf("line %d: unknown host key: %s", lineNum, key)
 		}
 
 	case "app":
 		app := c.Apps[name]
-		// Parse step keys like "step1", "step2", etc.
+		// Parse step keys like "step1", "step2", etc., and their options
+		// like "step1_retries"
 		if strings.HasPrefix(key, "step") {
-			numStr := strings.TrimPrefix(key, "step")
+			numStr, option, _ := strings.Cut(strings.TrimPrefix(key, "step"), "_")
 			num, err := strconv.Atoi(numStr)
 			if err != nil {
 				return fmt.Errorf("line %d: invalid step number: %s", lineNum, key)
 			}
-			step, err := parseStep(value)
-			if err != nil {
-				return fmt.Errorf("line %d: %w", lineNum, err)
+			// Options may come before the step itself
+			step, ok := app.Steps[num]
+			if !ok {
+				step.Retries = -1
+			}
+			switch option {
+			case "":
+				parsed, err := parseStep(value)
+				if err != nil {
+					return fmt.Errorf("line %d: %w", lineNum, err)
+				}
+				parsed.Retries, parsed.RetryBackoff = step.Retries, step.RetryBackoff
+				step = parsed
+			case "retries":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return fmt.Errorf("line %d: invalid %s: %s (use a number >= 0)", lineNum, key, value)
+				}
+				step.Retries = n
+			case "retry_backoff":
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return fmt.Errorf("line %d: invalid %s: %s (use a duration like 5s)", lineNum, key, value)
+				}
+				step.RetryBackoff = d
+			default:
+				return fmt.Errorf("line %d: unknown step option: %s", lineNum, key)
 			}
 			app.Steps[num] = step
 		} else {
@@ -277,6 +316,14 @@ func parseStep(value string) (Step, error) {
 			}
 		}
 
+	case "deploy_artifact":
+		// First token is the remote dest, rest are key=value pairs
+		argsMap, err := ParseArtifactArgs(args)
+		if err != nil {
+			return Step{}, fmt.Errorf("deploy_artifact: %w", err)
+		}
+		step.ArgsMap = argsMap
+
 	case "systemd":
 		// For systemd, args format is "action unit"
 		parts := strings.Fields(args)
@@ -294,3 +341,51 @@ func parseStep(value string) (Step, error) {
 
 	return step, nil
 }
+
+// ParseArtifactArgs parses deploy_artifact arguments like
+// "/opt/app/bin src=./dist/bin mode=0755 owner=app:app releases=5" into a
+// map with dest, src and whichever optional keys were given.
+func ParseArtifactArgs(args string) (map[string]string, error) {
+	parts := shellTokenize(args)
+	if len(parts) == 0 || strings.Contains(parts[0], "=") {
+		return nil, fmt.Errorf("missing dest path")
+	}
+	if !filepath.IsAbs(parts[0]) {
+		return nil, fmt.Errorf("dest %s is not absolute", parts[0])
+	}
+	argsMap := map[string]string{"dest": filepath.Clean(parts[0])}
+
+	for _, part := range parts[1:] {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid argument %q (expected key=value)", part)
+		}
+		switch key {
+		case "src":
+			if val == "" {
+				return nil, fmt.Errorf("empty src")
+			}
+		case "mode":
+			if m, err := strconv.ParseUint(val, 8, 32); err != nil || m > 07777 {
+				return nil, fmt.Errorf("invalid mode %q (expected octal, e.g. 0755)", val)
+			}
+		case "owner":
+			user, group, ok := strings.Cut(val, ":")
+			if !ok || user == "" || group == "" {
+				return nil, fmt.Errorf("invalid owner %q (expected user:group)", val)
+			}
+		case "releases":
+			if n, err := strconv.Atoi(val); err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid releases %q (expected a positive number)", val)
+			}
+		default:
+			return nil, fmt.Errorf("unknown argument %q", key)
+		}
+		argsMap[key] = val
+	}
+
+	if argsMap["src"] == "" {
+		return nil, fmt.Errorf("missing src")
+	}
+	return argsMap, nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArtifactArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		want map[string]string // nil = error expected
+	}{
+		{
+			"all arguments",
+			"/opt/app/bin/app src=build/app mode=0755 owner=app:app releases=3",
+			map[string]string{"dest": "/opt/app/bin/app", "src": "build/app", "mode": "0755", "owner": "app:app", "releases": "3"},
+		},
+		{"dest is cleaned", "/opt/app/../app/bin src=app", map[string]string{"dest": "/opt/app/bin", "src": "app"}},
+		{"quoted src", `/opt/app/bin src="my build/app"`, map[string]string{"dest": "/opt/app/bin", "src": "my build/app"}},
+		{"setuid mode", "/usr/local/bin/tool src=tool mode=4755", map[string]string{"dest": "/usr/local/bin/tool", "src": "tool", "mode": "4755"}},
+		{"highest mode", "/srv/x src=x mode=07777", map[string]string{"dest": "/srv/x", "src": "x", "mode": "07777"}},
+		{"mode too large", "/srv/x src=x mode=010000", nil},
+		{"mode not octal", "/srv/x src=x mode=0855", nil},
+		{"mode not a number", "/srv/x src=x mode=rwxr-xr-x", nil},
+		{"missing dest", "src=app", nil},
+		{"relative dest", "opt/app src=app", nil},
+		{"missing src", "/opt/app", nil},
+		{"empty src", "/opt/app src=", nil},
+		{"owner without group", "/opt/app src=app owner=app", nil},
+		{"zero releases", "/opt/app src=app releases=0", nil},
+		{"not key=value", "/opt/app src=app 0755", nil},
+		{"unknown argument", "/opt/app src=app perms=0755", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseArtifactArgs(tt.args)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("ParseArtifactArgs(%q) = %v, want error", tt.args, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseArtifactArgs(%q) error = %v", tt.args, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseArtifactArgs(%q) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStepRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		app         string
+		wantRetries int           // of step1
+		wantBackoff time.Duration // of step1
+		wantErr     string        // non-empty = error containing it expected
+	}{
+		{name: "not set", app: "step1=cmd:true", wantRetries: -1},
+		{name: "after the step", app: "step1=cmd:true\nstep1_retries=3\nstep1_retry_backoff=5s", wantRetries: 3, wantBackoff: 5 * time.Second},
+		{name: "before the step", app: "step1_retries=0\nstep1_retry_backoff=1m\nstep1=cmd:true", wantRetries: 0, wantBackoff: time.Minute},
+		{name: "only backoff", app: "step1_retry_backoff=2s\nstep1=cmd:true", wantRetries: -1, wantBackoff: 2 * time.Second},
+		{name: "option without step", app: "step1=cmd:true\nstep2_retries=1", wantErr: "step2 has options but no step2"},
+		{name: "negative retries", app: "step1=cmd:true\nstep1_retries=-1", wantErr: "invalid step1_retries"},
+		{name: "retries not a number", app: "step1=cmd:true\nstep1_retries=many", wantErr: "invalid step1_retries"},
+		{name: "zero backoff", app: "step1=cmd:true\nstep1_retry_backoff=0s", wantErr: "invalid step1_retry_backoff"},
+		{name: "backoff without unit", app: "step1=cmd:true\nstep1_retry_backoff=5", wantErr: "invalid step1_retry_backoff"},
+		{name: "unknown option", app: "step1=cmd:true\nstep1_timeout=5s", wantErr: "unknown step option"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.stay.ini")
+			if err := os.WriteFile(path, []byte("[app:web]\n"+tt.app+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := Parse(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Parse() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			step := cfg.Apps["web"].Steps[1]
+			if step.Action != "cmd" || step.Retries != tt.wantRetries || step.RetryBackoff != tt.wantBackoff {
+				t.Errorf("step1 = %+v, want cmd with retries %d and backoff %s", step, tt.wantRetries, tt.wantBackoff)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/drax2gma/stapply/internal/policy"
+)
+
+// policyKeyPattern matches the [policy] keys holding regexes. Each may be
+// given once or numbered (cmd_deny1, cmd_deny2, ...) like steps and vars.
+var policyKeyPattern = regexp.MustCompile(`^(cmd_allow|cmd_deny|unit_allow|unit_deny)[0-9]*$`)
+
+// parsePolicy builds an action policy from a [policy] section.
+func parsePolicy(section map[string]string) (*policy.Policy, error) {
+	p := &policy.Policy{}
+	patterns := make(map[string][]*regexp.Regexp)
+
+	// Sort keys so errors and pattern order are deterministic
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := section[key]
+		switch {
+		case key == "actions":
+			p.Actions = splitList(value)
+		case key == "paths":
+			for _, prefix := range splitList(value) {
+				if !filepath.IsAbs(prefix) {
+					return nil, fmt.Errorf("policy paths: %s is not absolute", prefix)
+				}
+				p.PathPrefixes = append(p.PathPrefixes, filepath.Clean(prefix))
+			}
+		case policyKeyPattern.MatchString(key):
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("policy %s: %w", key, err)
+			}
+			base := policyKeyPattern.FindStringSubmatch(key)[1]
+			patterns[base] = append(patterns[base], re)
+		default:
+			return nil, fmt.Errorf("unknown policy key: %s", key)
+		}
+	}
+
+	p.CmdAllow = patterns["cmd_allow"]
+	p.CmdDeny = patterns["cmd_deny"]
+	p.UnitAllow = patterns["unit_allow"]
+	p.UnitDeny = patterns["unit_deny"]
+	return p, nil
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -2,8 +2,15 @@ package config
 
 import (
 	"bufio"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/netutil"
+	"github.com/drax2gma/stapply/internal/policy"
+	"github.com/nats-io/nkeys"
 )
 
 // Config holds all parsed configuration sections.
@@ -20,6 +27,7 @@ type Environment struct {
 	Apps        []string          // List of app names
 	Concurrency int               // Max parallel agents (0 = unlimited)
 	Vars        map[string]string // Environment-specific variables
+	KeyEnv      string            // Name of the environment variable holding this environment's key
 }
 
 // Host defines a target machine.
@@ -27,6 +35,7 @@ type Host struct {
 	ID      string   // Host identifier (matches section name)
 	AgentID string   // NATS subject agent_id
 	Tags    []string // Optional metadata tags
+	KeyEnv  string   // Name of the environment variable holding this host's key (overrides env)
 }
 
 // App defines an application with ordered steps.
@@ -40,6 +49,11 @@ type Step struct {
 	Action  string            // Action type: cmd, write_file, template_file, systemd
 	Args    string            // Raw action arguments (action-specific format)
 	ArgsMap map[string]string // Parsed arguments for controller
+
+	// Overrides of the controller's -retries and -retry-backoff, set with
+	// stepN_retries and stepN_retry_backoff
+	Retries      int           // Retries of a request whose reply timed out (-1 = not set)
+	RetryBackoff time.Duration // Wait before the first retry, doubling after each (0 = not set)
 }
 
 // GetOrderedSteps returns steps sorted by step number.
@@ -66,11 +80,42 @@ func (a *App) GetOrderedSteps() []Step {
 	return result
 }
 
+// DefaultJobRetention is how long finished jobs are kept when job_retention is not set.
+const DefaultJobRetention = time.Hour
+
+// DefaultHeartbeatInterval is how often agents announce themselves when heartbeat_interval is not set.
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// DefaultClockSkew is how far request timestamps may drift from the agent's clock when clock_skew is not set.
+const DefaultClockSkew = 2 * time.Minute
+
+// DefaultPartialMaxAge is how long an interrupted artifact transfer is kept
+// for resuming when partial_max_age is not set.
+const DefaultPartialMaxAge = 24 * time.Hour
+
+// DefaultArtifactCacheMaxAge is how long deployed artifacts stay in the
+// agent's cache when artifact_cache_max_age is not set.
+const DefaultArtifactCacheMaxAge = 7 * 24 * time.Hour
+
 // AgentConfig holds agent-specific configuration.
 type AgentConfig struct {
-	AgentID    string
-	NatsServer string // FQDN only, normalized to URL by agent
-	NatsCreds  string
+	AgentID            string
+	NatsServer         string // FQDN only, normalized to URL by agent
+	NatsCreds          string
+	TLS                netutil.TLSConfig // CA, client cert and key for tls:// connections
+	JobRetention       time.Duration     // How long finished job results are kept in memory
+	HeartbeatInterval  time.Duration     // Period of presence heartbeats (0 = disabled)
+	ClockSkew          time.Duration     // Accepted age of request timestamps (replay window)
+	KeyringFile        string            // Persistent list of accepted encryption keys
+	IdentityFile       string            // Agent's nkey seed used to sign responses
+	TrustedControllers []string          // nkey public keys allowed to sign requests (empty = unsigned accepted)
+	Policy             *policy.Policy    // What requests may do (nil = unrestricted)
+	SubjectPrefix      string            // First token of all subjects (empty = "stapply")
+	AllowLegacyCrypto  bool              // Also accept ciphertexts in the pre-KDF formats (migration only)
+	ArtifactDir        string            // Staging directory for partial artifact transfers
+	PartialMaxAge      time.Duration     // Age after which idle partial transfers are removed (0 = never)
+	CacheMaxAge        time.Duration     // Age after which cached artifacts are removed (0 = never)
+	WorkQueue          bool              // Run requests queued in JetStream for this agent (see 'run -queued')
 }
 
 // ParseAgentConfig parses an agent configuration file.
@@ -95,10 +140,147 @@ func ParseAgentConfig(path string) (*AgentConfig, error) {
 		secretKey = agent["secret_key"]
 	}
 
+	jobRetention := DefaultJobRetention
+	if v := agent["job_retention"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job_retention %q: %w", v, err)
+		}
+		jobRetention = d
+	}
+
+	heartbeatInterval := DefaultHeartbeatInterval
+	if v := agent["heartbeat_interval"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid heartbeat_interval %q", v)
+		}
+		heartbeatInterval = d
+	}
+
+	clockSkew := DefaultClockSkew
+	if v := agent["clock_skew"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid clock_skew %q", v)
+		}
+		clockSkew = d
+	}
+
+	partialMaxAge := DefaultPartialMaxAge
+	if v := agent["partial_max_age"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid partial_max_age %q", v)
+		}
+		partialMaxAge = d
+	}
+
+	cacheMaxAge := DefaultArtifactCacheMaxAge
+	if v := agent["artifact_cache_max_age"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid artifact_cache_max_age %q", v)
+		}
+		cacheMaxAge = d
+	}
+
+	// Partial artifact transfers are staged next to the config file by default
+	artifactDir := agent["artifact_dir"]
+	if artifactDir == "" {
+		artifactDir = filepath.Join(filepath.Dir(path), "artifacts")
+	}
+
+	// Keyring lives next to the config file unless set explicitly
+	keyringFile := security["keyring_file"]
+	if keyringFile == "" {
+		keyringFile = agent["keyring_file"]
+	}
+	if keyringFile == "" {
+		keyringFile = filepath.Join(filepath.Dir(path), "keyring")
+	}
+
+	// Identity key is generated next to the config file on first start
+	identityFile := security["identity_file"]
+	if identityFile == "" {
+		identityFile = agent["identity_file"]
+	}
+	if identityFile == "" {
+		identityFile = filepath.Join(filepath.Dir(path), "identity.nk")
+	}
+
+	// Legacy ciphertexts are only accepted while controllers are upgraded
+	allowLegacy := security["allow_legacy_crypto"]
+	if allowLegacy == "" {
+		allowLegacy = agent["allow_legacy_crypto"]
+	}
+
+	// Controllers whose signed requests are accepted
+	trusted := security["trusted_controllers"]
+	if trusted == "" {
+		trusted = agent["trusted_controllers"]
+	}
+	var trustedControllers []string
+	for _, pub := range strings.Split(trusted, ",") {
+		pub = strings.TrimSpace(pub)
+		if pub == "" {
+			continue
+		}
+		if !nkeys.IsValidPublicUserKey(pub) {
+			return nil, fmt.Errorf("invalid trusted_controllers key %q", pub)
+		}
+		trustedControllers = append(trustedControllers, pub)
+	}
+
+	// Policy comes from a [policy] section or a separate file with one
+	policySection := cfg["policy"]
+	if policyFile := agent["policy_file"]; policyFile != "" {
+		if policySection != nil {
+			return nil, fmt.Errorf("policy_file and a [policy] section are mutually exclusive")
+		}
+		if !filepath.IsAbs(policyFile) {
+			policyFile = filepath.Join(filepath.Dir(path), policyFile)
+		}
+		pcfg, err := parseSimpleINI(policyFile)
+		if err != nil {
+			return nil, fmt.Errorf("policy_file: %w", err)
+		}
+		if policySection = pcfg["policy"]; policySection == nil {
+			return nil, fmt.Errorf("policy_file %s has no [policy] section", policyFile)
+		}
+	}
+	var actionPolicy *policy.Policy
+	if policySection != nil {
+		if actionPolicy, err = parsePolicy(policySection); err != nil {
+			return nil, err
+		}
+	}
+
+	// Consuming the work queue needs JetStream, so agents opt in
+	workQueue := agent["work_queue"]
+
 	return &AgentConfig{
 		AgentID:    agent["agent_id"],
 		NatsServer: agent["nats_server"],
 		NatsCreds:  agent["nats_creds"],
+		TLS: netutil.TLSConfig{
+			CAFile:   agent["tls_ca_file"],
+			CertFile: agent["tls_cert_file"],
+			KeyFile:  agent["tls_key_file"],
+		},
+		JobRetention:       jobRetention,
+		HeartbeatInterval:  heartbeatInterval,
+		ClockSkew:          clockSkew,
+		KeyringFile:        keyringFile,
+		IdentityFile:       identityFile,
+		Policy:             actionPolicy,
+		TrustedControllers: trustedControllers,
+		SubjectPrefix:      agent["subject_prefix"],
+		AllowLegacyCrypto:  allowLegacy == "true" || allowLegacy == "yes" || allowLegacy == "1",
+		ArtifactDir:        artifactDir,
+		PartialMaxAge:      partialMaxAge,
+		CacheMaxAge:        cacheMaxAge,
+		WorkQueue:          workQueue == "true" || workQueue == "yes" || workQueue == "1",
 	}, nil
 }
 
@@ -0,0 +1,41 @@
+package netutil
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// TLSConfig holds the TLS material for a NATS connection.
+type TLSConfig struct {
+	CAFile   string // CA bundle the server certificate must chain to (default: system roots)
+	CertFile string // Client certificate for mTLS
+	KeyFile  string // Client private key for mTLS
+}
+
+// Enabled reports whether any TLS material is configured.
+func (c *TLSConfig) Enabled() bool {
+	return c != nil && (c.CAFile != "" || c.CertFile != "" || c.KeyFile != "")
+}
+
+// Options returns the nats.Connect options for c. Any configured file makes
+// TLS mandatory; the server certificate is always verified, so a server
+// that does not present a valid certificate fails the connection.
+func (c *TLSConfig) Options() ([]nats.Option, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("TLS client certificate and key must be given together")
+	}
+
+	opts := []nats.Option{nats.Secure(&tls.Config{MinVersion: tls.VersionTLS12})}
+	if c.CAFile != "" {
+		opts = append(opts, nats.RootCAs(c.CAFile))
+	}
+	if c.CertFile != "" {
+		opts = append(opts, nats.ClientCert(c.CertFile, c.KeyFile))
+	}
+	return opts, nil
+}
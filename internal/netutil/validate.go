@@ -45,6 +45,12 @@ func ValidateNATSURL(natsURL string, allowPublic bool) error {
 		return fmt.Errorf("invalid NATS URL: %v", err)
 	}
 
+	switch u.Scheme {
+	case "nats", "tls", "ws", "wss":
+	default:
+		return fmt.Errorf("unsupported NATS URL scheme %q (use nats:// or tls://)", u.Scheme)
+	}
+
 	// Extract host (may include port)
 	host := u.Hostname()
 	if host == "" {
@@ -94,7 +100,7 @@ func FormatAllowedNetworks() string {
 }
 
 // NormalizeNATSURL adds default scheme and port if missing.
-// defaults: scheme=nats://, port=4222
+// defaults: scheme=nats://, port=4222. An explicit tls:// scheme is kept.
 func NormalizeNATSURL(server string) string {
 	if server == "" {
 		return ""
@@ -49,3 +49,30 @@ func TestNormalizeNATSURL(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateNATSURLScheme(t *testing.T) {
+	for _, u := range []string{"nats://127.0.0.1:4222", "tls://127.0.0.1:4222"} {
+		if err := ValidateNATSURL(u, false); err != nil {
+			t.Errorf("ValidateNATSURL(%q) error = %v", u, err)
+		}
+	}
+	if err := ValidateNATSURL("http://127.0.0.1:4222", false); err == nil {
+		t.Error("ValidateNATSURL(http://) succeeded, want error")
+	}
+}
+
+func TestTLSConfigOptions(t *testing.T) {
+	var none *TLSConfig
+	if opts, err := none.Options(); err != nil || opts != nil {
+		t.Errorf("nil Options() = %v, %v; want nil, nil", opts, err)
+	}
+
+	if _, err := (&TLSConfig{CertFile: "client.pem"}).Options(); err == nil {
+		t.Error("Options() with cert but no key succeeded, want error")
+	}
+
+	opts, err := (&TLSConfig{CAFile: "ca.pem"}).Options()
+	if err != nil || len(opts) != 2 {
+		t.Errorf("Options(CA) = %d options, %v; want 2, nil", len(opts), err)
+	}
+}
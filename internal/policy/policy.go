@@ -0,0 +1,144 @@
+// Package policy restricts what actions an agent may run. It depends on
+// nothing else in stapply so both the config parser and the action registry
+// can use it.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ErrDenied is returned when the agent's policy forbids a request.
+var ErrDenied = errors.New("denied by policy")
+
+// shellMetachars are the characters that let a shell run more than the
+// command an allow pattern matched: separators, pipes, redirects,
+// substitutions and subshells.
+const shellMetachars = ";&|<>`$()\n\r"
+
+// pathArgs names the argument holding the target path of file-writing actions.
+var pathArgs = map[string]string{
+	"write_file":        "path",
+	"template_file":     "path",
+	"deploy_artifact":   "dest",
+	"rollback_artifact": "dest",
+	"fetch_artifact":    "dest",
+}
+
+// Policy restricts what an agent may execute. Empty lists place no
+// restriction; a nil *Policy allows everything.
+type Policy struct {
+	Actions      []string         // Allowed action names
+	PathPrefixes []string         // Directories file-writing actions may write below
+	CmdAllow     []*regexp.Regexp // cmd commands must match one of these
+	CmdDeny      []*regexp.Regexp // cmd commands matching any of these are refused
+	UnitAllow    []*regexp.Regexp // systemd units must match one of these
+	UnitDeny     []*regexp.Regexp // systemd units matching any of these are refused
+}
+
+// Check returns an error wrapping ErrDenied if the policy forbids running
+// action with args.
+func (p *Policy) Check(action string, args map[string]string) error {
+	if p == nil {
+		return nil
+	}
+
+	if len(p.Actions) > 0 && !containsString(p.Actions, action) {
+		return fmt.Errorf("%w: action %s is not allowed", ErrDenied, action)
+	}
+
+	if arg, ok := pathArgs[action]; ok && len(p.PathPrefixes) > 0 {
+		if err := p.checkPath(args[arg]); err != nil {
+			return err
+		}
+	}
+
+	switch action {
+	case "cmd":
+		command := args["command"]
+		// Allow patterns match the command line, not what the shell runs
+		if len(p.CmdAllow) > 0 && strings.ContainsAny(command, shellMetachars) {
+			return fmt.Errorf("%w: command %q contains shell metacharacters", ErrDenied, command)
+		}
+		return checkPatterns("command", command, p.CmdAllow, p.CmdDeny)
+	case "systemd":
+		if unit := args["unit"]; unit != "" {
+			return checkPatterns("unit", unit, p.UnitAllow, p.UnitDeny)
+		}
+	}
+	return nil
+}
+
+// checkPath requires path to resolve below one of the allowed prefixes.
+// Symlinks in existing parent directories are resolved first so a link
+// cannot be used to escape the allowed tree.
+func (p *Policy) checkPath(path string) error {
+	if path == "" {
+		return nil // The action reports the missing argument itself
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%w: path %s is not absolute", ErrDenied, path)
+	}
+
+	resolved := resolvePath(path)
+	for _, prefix := range p.PathPrefixes {
+		if isBelow(resolved, resolvePath(prefix)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: path %s is outside the allowed paths", ErrDenied, path)
+}
+
+// resolvePath cleans path and resolves symlinks in its longest existing ancestor.
+func resolvePath(path string) string {
+	path = filepath.Clean(path)
+	rest := ""
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(real, rest)
+		}
+		if dir == filepath.Dir(dir) {
+			return path
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// isBelow reports whether path is dir or inside it.
+func isBelow(path, dir string) bool {
+	if path == dir || dir == "/" {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// checkPatterns applies deny patterns first, then requires a match among the
+// allow patterns if there are any.
+func checkPatterns(what, value string, allow, deny []*regexp.Regexp) error {
+	for _, re := range deny {
+		if re.MatchString(value) {
+			return fmt.Errorf("%w: %s %q matches deny pattern %s", ErrDenied, what, value, re)
+		}
+	}
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, re := range allow {
+		if re.MatchString(value) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s %q matches no allow pattern", ErrDenied, what, value)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
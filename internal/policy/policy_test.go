@@ -0,0 +1,79 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "app")
+	if err := os.Mkdir(allowed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A link inside the allowed tree pointing outside of it
+	if err := os.Symlink("/etc", filepath.Join(allowed, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{
+		Actions:      []string{"cmd", "write_file", "systemd"},
+		PathPrefixes: []string{allowed},
+		CmdAllow:     []*regexp.Regexp{regexp.MustCompile(`^systemctl `), regexp.MustCompile(`^echo `)},
+		CmdDeny:      []*regexp.Regexp{regexp.MustCompile(`^echo forbidden`)},
+		UnitDeny:     []*regexp.Regexp{regexp.MustCompile(`^sshd\.service$`)},
+	}
+
+	tests := []struct {
+		name   string
+		action string
+		args   map[string]string
+		denied bool
+	}{
+		{"allowed command", "cmd", map[string]string{"command": "echo hi"}, false},
+		{"command not allowed", "cmd", map[string]string{"command": "rm -rf /"}, true},
+		{"denied pattern wins", "cmd", map[string]string{"command": "echo hi; reboot"}, true},
+		{"chained with &&", "cmd", map[string]string{"command": "echo hi && reboot"}, true},
+		{"command substitution", "cmd", map[string]string{"command": "echo $(reboot)"}, true},
+		{"backticks", "cmd", map[string]string{"command": "echo `reboot`"}, true},
+		{"redirect", "cmd", map[string]string{"command": "echo x > /etc/passwd"}, true},
+		{"newline", "cmd", map[string]string{"command": "echo hi\nreboot"}, true},
+		{"deny pattern", "cmd", map[string]string{"command": "echo forbidden"}, true},
+		{"action not allowed", "template_file", map[string]string{"path": allowed + "/x"}, true},
+		{"path inside", "write_file", map[string]string{"path": allowed + "/conf/app.ini"}, false},
+		{"path outside", "write_file", map[string]string{"path": "/etc/shadow"}, true},
+		{"dot-dot escape", "write_file", map[string]string{"path": allowed + "/../shadow"}, true},
+		{"symlink escape", "write_file", map[string]string{"path": allowed + "/etc/shadow"}, true},
+		{"prefix is not a directory match", "write_file", map[string]string{"path": allowed + "x/file"}, true},
+		{"relative path", "write_file", map[string]string{"path": "app/file"}, true},
+		{"unit allowed", "systemd", map[string]string{"action": "restart", "unit": "nginx.service"}, false},
+		{"unit denied", "systemd", map[string]string{"action": "stop", "unit": "sshd.service"}, true},
+		{"daemon-reload has no unit", "systemd", map[string]string{"action": "daemon-reload"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Check(tt.action, tt.args)
+			if tt.denied != (err != nil) {
+				t.Fatalf("Check() error = %v, denied = %v", err, tt.denied)
+			}
+			if err != nil && !errors.Is(err, ErrDenied) {
+				t.Errorf("Check() error = %v, want ErrDenied", err)
+			}
+		})
+	}
+
+	// Without allow patterns only the deny patterns apply
+	denyOnly := &Policy{CmdDeny: p.CmdDeny}
+	if err := denyOnly.Check("cmd", map[string]string{"command": "echo a | wc -l"}); err != nil {
+		t.Errorf("deny-only Check() error = %v", err)
+	}
+
+	var none *Policy
+	if err := none.Check("cmd", map[string]string{"command": "anything"}); err != nil {
+		t.Errorf("nil Policy Check() error = %v", err)
+	}
+}
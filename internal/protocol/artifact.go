@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ArtifactQueryMissing, passed as the "query" argument of deploy_artifact,
+// asks the agent which chunks of a transfer it does not have yet instead of
+// writing one. The reply lists them with FormatChunkList in MissingChunks,
+// and in Stdout for controllers that predate that field.
+const ArtifactQueryMissing = "missing"
+
+// ArtifactQueryPresent, passed as the "query" argument of deploy_artifact,
+// asks the agent whether dest already has the content with the given
+// checksum, before any chunk is sent. Stdout of the reply is ArtifactPresent,
+// ArtifactRestored or ArtifactAbsent.
+const ArtifactQueryPresent = "present"
+
+// Answers to ArtifactQueryPresent.
+const (
+	ArtifactPresent  = "present"  // dest already matches; Changed only if its mode was fixed
+	ArtifactRestored = "restored" // dest was installed from the agent's cache
+	ArtifactAbsent   = "absent"   // The content has to be uploaded
+)
+
+// FormatChunkList renders chunk indices as sorted, comma-separated ranges
+// ("0-149,151,160-199"). An empty list renders as "".
+func FormatChunkList(chunks []int) string {
+	sorted := append([]int(nil), chunks...)
+	sort.Ints(sorted)
+
+	var b strings.Builder
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Itoa(sorted[i]))
+		if sorted[j] != sorted[i] {
+			fmt.Fprintf(&b, "-%d", sorted[j])
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// ParseChunkList parses the output of FormatChunkList.
+func ParseChunkList(s string) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	var chunks []int
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid chunk %q", part)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid chunk range %q", part)
+			}
+		}
+		for i := first; i <= last; i++ {
+			chunks = append(chunks, i)
+		}
+	}
+	return chunks, nil
+}
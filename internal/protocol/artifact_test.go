@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChunkList(t *testing.T) {
+	chunks := []int{7, 0, 1, 2, 5, 3, 9, 8}
+	s := FormatChunkList(chunks)
+	if s != "0-3,5,7-9" {
+		t.Errorf("FormatChunkList() = %q, want %q", s, "0-3,5,7-9")
+	}
+	got, err := ParseChunkList(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 1, 2, 3, 5, 7, 8, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseChunkList(%q) = %v, want %v", s, got, want)
+	}
+
+	if s := FormatChunkList(nil); s != "" {
+		t.Errorf("FormatChunkList(nil) = %q, want empty", s)
+	}
+	for _, bad := range []string{"x", "3-1", "-2", "1,,2"} {
+		if _, err := ParseChunkList(bad); err == nil {
+			t.Errorf("ParseChunkList(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package protocol
+
+// CancelRequest asks an agent to kill a running request.
+// Sent to stapply.cancel.<agent_id>.
+type CancelRequest struct {
+	RequestID string `json:"request_id"`
+	TargetID  string `json:"target_id"` // RequestID (or job ID) to cancel
+}
+
+// CancelResponse reports whether the target was still running and got cancelled.
+type CancelResponse struct {
+	RequestID string `json:"request_id"`
+	Cancelled bool   `json:"cancelled"`
+	Error     string `json:"error,omitempty"`
+}
+
+// NewCancelRequest creates a cancel request for the given request ID.
+func NewCancelRequest(targetID string) *CancelRequest {
+	return &CancelRequest{
+		RequestID: generateID(),
+		TargetID:  targetID,
+	}
+}
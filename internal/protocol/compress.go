@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for envelope payloads and artifact chunks.
+const (
+	CompressionZstd = "zstd"
+)
+
+// CompressMinSize is the smallest payload worth compressing.
+const CompressMinSize = 4 * 1024
+
+// MaxDecompressedSize bounds what Decompress will inflate, so a small
+// message cannot expand into an arbitrarily large one.
+const MaxDecompressedSize = 64 << 20
+
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+	})
+)
+
+// Compress compresses data with the named algorithm.
+func Compress(alg string, data []byte) ([]byte, error) {
+	switch alg {
+	case CompressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", alg)
+}
+
+// Decompress reverses Compress.
+func Decompress(alg string, data []byte) ([]byte, error) {
+	switch alg {
+	case CompressionZstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		out, err := dec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", alg)
+}
@@ -0,0 +1,244 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nkeys"
+)
+
+// ProtocolVersion is the wire protocol version spoken by this build.
+// Version 0 means bare JSON payloads without an envelope (pre-envelope builds).
+const ProtocolVersion = 1
+
+// Envelope wraps every payload exchanged between controller and agent.
+// MessageID and Timestamp are unique per message; when the envelope is
+// encrypted or signed they are authenticated and let the receiver reject
+// replays. Signer is the nkey public key of the sender of a signed envelope.
+// A compressed Payload is a JSON string holding the compressed JSON; Accept
+// names the compression the sender can read in a reply.
+type Envelope struct {
+	Version     int             `json:"v"`
+	Type        RequestType     `json:"type"`
+	SenderID    string          `json:"sender"`
+	MessageID   string          `json:"id,omitempty"`
+	Timestamp   time.Time       `json:"ts"`
+	Compression string          `json:"compression,omitempty"`
+	Accept      string          `json:"accept,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Signer      string          `json:"signer,omitempty"`
+	Signature   []byte          `json:"sig,omitempty"`
+}
+
+// MarshalOptions tune how MarshalWith builds an envelope.
+type MarshalOptions struct {
+	Signer      Signer // nil = unsigned
+	Compression string // Compress payloads of CompressMinSize or more ("" = never)
+	Accept      string // Compression accepted in the reply
+	MessageID   string // "" = random
+}
+
+// Signer signs envelopes. nkeys.KeyPair satisfies it.
+type Signer interface {
+	PublicKey() (string, error)
+	Sign(input []byte) ([]byte, error)
+}
+
+// Marshal wraps payload in an envelope of the current protocol version.
+func Marshal(msgType RequestType, senderID string, payload interface{}) ([]byte, error) {
+	return MarshalSigned(msgType, senderID, payload, nil)
+}
+
+// MarshalSigned is like Marshal but signs the envelope with signer.
+// A nil signer produces an unsigned envelope.
+func MarshalSigned(msgType RequestType, senderID string, payload interface{}, signer Signer) ([]byte, error) {
+	return MarshalWith(msgType, senderID, payload, MarshalOptions{Signer: signer})
+}
+
+// MarshalWith wraps payload in an envelope built according to opts. The
+// payload is only sent compressed if that makes it smaller.
+func MarshalWith(msgType RequestType, senderID string, payload interface{}, opts MarshalOptions) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{
+		Version:   ProtocolVersion,
+		Type:      msgType,
+		SenderID:  senderID,
+		MessageID: opts.MessageID,
+		Timestamp: time.Now().UTC(),
+		Accept:    opts.Accept,
+		Payload:   data,
+	}
+	if env.MessageID == "" {
+		env.MessageID = uuid.New().String()
+	}
+
+	if opts.Compression != "" && len(data) >= CompressMinSize {
+		packed, err := Compress(opts.Compression, data)
+		if err != nil {
+			return nil, fmt.Errorf("compress payload: %w", err)
+		}
+		if wrapped, _ := json.Marshal(packed); len(wrapped) < len(data) {
+			env.Compression, env.Payload = opts.Compression, wrapped
+		}
+	}
+
+	if opts.Signer != nil {
+		if env.Signer, err = opts.Signer.PublicKey(); err != nil {
+			return nil, fmt.Errorf("signing key: %w", err)
+		}
+		if env.Signature, err = opts.Signer.Sign(env.signedBytes()); err != nil {
+			return nil, fmt.Errorf("sign envelope: %w", err)
+		}
+	}
+	return json.Marshal(env)
+}
+
+// Verify checks the envelope's signature against its Signer.
+func (e *Envelope) Verify() error {
+	if e.Signer == "" || len(e.Signature) == 0 {
+		return fmt.Errorf("envelope is not signed")
+	}
+	kp, err := nkeys.FromPublicKey(e.Signer)
+	if err != nil {
+		return fmt.Errorf("invalid signer %q: %w", e.Signer, err)
+	}
+	if err := kp.Verify(e.signedBytes(), e.Signature); err != nil {
+		return fmt.Errorf("bad signature from %s", e.Signer)
+	}
+	return nil
+}
+
+// signedBytes is the canonical form covered by the signature: every header
+// field, one per line, followed by the payload bytes as sent. The compression
+// fields are only included when set, so envelopes of peers that predate them
+// keep their canonical form.
+func (e *Envelope) signedBytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(strconv.Itoa(e.Version) + "\n")
+	b.WriteString(string(e.Type) + "\n")
+	b.WriteString(e.SenderID + "\n")
+	b.WriteString(e.MessageID + "\n")
+	b.WriteString(e.Timestamp.UTC().Format(time.RFC3339Nano) + "\n")
+	b.WriteString(e.Signer + "\n")
+	if e.Compression != "" || e.Accept != "" {
+		b.WriteString(e.Compression + "\n")
+		b.WriteString(e.Accept + "\n")
+	}
+	b.Write(e.Payload)
+	return b.Bytes()
+}
+
+// Unmarshal decodes an envelope and its payload into v. Bare payloads from
+// pre-envelope peers are accepted and reported as Version 0.
+func Unmarshal(data []byte, v interface{}) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+
+	if env.Version == 0 {
+		// Legacy peer: the whole message is the payload
+		return &Envelope{Type: env.Type}, json.Unmarshal(data, v)
+	}
+
+	if len(env.Payload) == 0 {
+		return &env, fmt.Errorf("envelope v%d %s: empty payload", env.Version, env.Type)
+	}
+	payload := []byte(env.Payload)
+	if env.Compression != "" {
+		var packed []byte
+		if err := json.Unmarshal(env.Payload, &packed); err != nil {
+			return &env, fmt.Errorf("envelope v%d %s: compressed payload: %w", env.Version, env.Type, err)
+		}
+		var err error
+		if payload, err = Decompress(env.Compression, packed); err != nil {
+			return &env, fmt.Errorf("envelope v%d %s: %w", env.Version, env.Type, err)
+		}
+	}
+	return &env, json.Unmarshal(payload, v)
+}
+
+// Capabilities advertises what an agent can do.
+type Capabilities struct {
+	Actions   []string `json:"actions"`            // Registered action names
+	Encodings []string `json:"encodings"`          // Supported payload encodings
+	Features  []string `json:"features,omitempty"` // Optional protocol features
+
+	Compression []string `json:"compression,omitempty"` // Supported payload compression
+}
+
+// Payload encodings.
+const (
+	EncodingJSON = "json"
+)
+
+// Optional protocol features.
+const (
+	FeatureStream = "stream" // Live output on stapply.stream.<request_id>
+	FeatureJobs   = "jobs"   // Async runs and stapply.job.* queries
+	FeatureCancel = "cancel" // stapply.cancel.<agent_id>
+	FeatureKeys   = "keys"   // Keyring management on stapply.key.<agent_id>
+	FeatureOutput = "output" // Output limits and chunked output on stapply.job.output.<agent_id>
+
+	// deploy_artifact chunks carry an offset and may arrive in any order
+	FeatureArtifactOffsets = "artifact-offsets"
+	// deploy_artifact keeps partial transfers and answers ArtifactQueryMissing
+	FeatureArtifactResume = "artifact-resume"
+	// deploy_artifact answers ArtifactQueryPresent from dest or its cache
+	FeatureArtifactCache = "artifact-cache"
+	// deploy_artifact installs into release directories and rollback_artifact exists
+	FeatureArtifactReleases = "artifact-releases"
+	// deploy_artifact applies an "owner" argument
+	FeatureArtifactOwner = "artifact-owner"
+	// Runs queued on stapply.queue.<agent_id> in JetStream are consumed
+	FeatureQueue = "queue"
+	// A repeated run request ID is answered with the recorded result, not run again
+	FeatureIdempotent = "idempotent"
+)
+
+// HasCompression reports whether the agent reads and writes payloads
+// compressed with alg.
+func (c *Capabilities) HasCompression(alg string) bool {
+	return c != nil && contains(c.Compression, alg)
+}
+
+// HasAction reports whether the agent registered the named action.
+func (c *Capabilities) HasAction(name string) bool {
+	return c != nil && contains(c.Actions, name)
+}
+
+// HasFeature reports whether the agent supports an optional feature.
+func (c *Capabilities) HasFeature(name string) bool {
+	return c != nil && contains(c.Features, name)
+}
+
+// MissingActions returns the names the agent does not support, sorted.
+func (c *Capabilities) MissingActions(names []string) []string {
+	seen := make(map[string]bool)
+	var missing []string
+	for _, n := range names {
+		if !seen[n] && !c.HasAction(n) {
+			missing = append(missing, n)
+		}
+		seen[n] = true
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
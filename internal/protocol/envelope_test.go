@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	data, err := Marshal(RequestTypePing, "ctl@test", NewPingRequest("1.2.3"))
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	var req PingRequest
+	env, err := Unmarshal(data, &req)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if env.Version != ProtocolVersion || env.Type != RequestTypePing || env.SenderID != "ctl@test" {
+		t.Errorf("Unmarshal() envelope = %+v", env)
+	}
+	if req.ControllerVersion != "1.2.3" {
+		t.Errorf("Unmarshal() payload = %+v", req)
+	}
+}
+
+func TestEnvelopeSignature(t *testing.T) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	pub, _ := kp.PublicKey()
+
+	data, err := MarshalSigned(RequestTypeRun, "ctl@test", NewRunRequest("cmd", map[string]string{"command": "whoami"}, 0, false), kp)
+	if err != nil {
+		t.Fatalf("MarshalSigned() error = %v", err)
+	}
+
+	var req RunRequest
+	env, err := Unmarshal(data, &req)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if env.Signer != pub {
+		t.Errorf("Signer = %q, want %q", env.Signer, pub)
+	}
+	if err := env.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	// Any change to the signed content must be detected
+	tampered := bytes.Replace(data, []byte("whoami"), []byte("reboot"), 1)
+	env, err = Unmarshal(tampered, &req)
+	if err != nil {
+		t.Fatalf("Unmarshal(tampered) error = %v", err)
+	}
+	if err := env.Verify(); err == nil {
+		t.Error("Verify(tampered) succeeded, want error")
+	}
+
+	unsigned, _ := Marshal(RequestTypeRun, "ctl@test", &req)
+	env, _ = Unmarshal(unsigned, &req)
+	if err := env.Verify(); err == nil {
+		t.Error("Verify(unsigned) succeeded, want error")
+	}
+}
+
+func TestEnvelopeCompression(t *testing.T) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatalf("CreateUser() error = %v", err)
+	}
+	content := strings.Repeat("compressible line\n", 1000)
+	opts := MarshalOptions{Signer: kp, Compression: CompressionZstd, Accept: CompressionZstd}
+
+	data, err := MarshalWith(RequestTypeRun, "ctl@test", NewRunRequest("write_file", map[string]string{"content": content}, 0, false), opts)
+	if err != nil {
+		t.Fatalf("MarshalWith() error = %v", err)
+	}
+	if len(data) > len(content)/4 {
+		t.Errorf("compressed envelope is %d bytes for %d bytes of content", len(data), len(content))
+	}
+
+	var req RunRequest
+	env, err := Unmarshal(data, &req)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if env.Compression != CompressionZstd || env.Accept != CompressionZstd || req.Args["content"] != content {
+		t.Errorf("Unmarshal() compression %q accept %q, content intact %v", env.Compression, env.Accept, req.Args["content"] == content)
+	}
+	if err := env.Verify(); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	// Dropping the compression flag must break the signature
+	env.Accept = ""
+	if err := env.Verify(); err == nil {
+		t.Errorf("Verify() accepted an envelope with a stripped accept field")
+	}
+
+	// Small payloads are sent as is
+	data, _ = MarshalWith(RequestTypePing, "ctl@test", NewPingRequest("1.2.3"), opts)
+	if env, err := Unmarshal(data, &PingRequest{}); err != nil || env.Compression != "" {
+		t.Errorf("small payload: compression %q, err %v", env.Compression, err)
+	}
+}
+
+func TestUnmarshalLegacy(t *testing.T) {
+	var req PingRequest
+	env, err := Unmarshal([]byte(`{"request_id":"abc","controller_version":"0.9"}`), &req)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if env.Version != 0 {
+		t.Errorf("Unmarshal() version = %d, want 0", env.Version)
+	}
+	if req.RequestID != "abc" || req.ControllerVersion != "0.9" {
+		t.Errorf("Unmarshal() payload = %+v", req)
+	}
+}
+
+func TestMissingActions(t *testing.T) {
+	caps := &Capabilities{Actions: []string{"cmd", "write_file"}}
+
+	got := caps.MissingActions([]string{"systemd", "cmd", "deploy_artifact", "systemd"})
+	want := []string{"deploy_artifact", "systemd"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MissingActions() = %v, want %v", got, want)
+	}
+
+	var none *Capabilities
+	if got := none.MissingActions([]string{"cmd"}); len(got) != 1 {
+		t.Errorf("nil MissingActions() = %v, want [cmd]", got)
+	}
+}
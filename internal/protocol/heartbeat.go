@@ -0,0 +1,20 @@
+package protocol
+
+import "time"
+
+// HeartbeatSubjectWildcard returns the subject matching the heartbeats of
+// every agent. Each agent publishes on RequestTypeHeartbeat.Subject(agent_id).
+func HeartbeatSubjectWildcard() string {
+	return RequestTypeHeartbeat.Subject("*")
+}
+
+// Heartbeat is published periodically by every agent to announce it is alive.
+type Heartbeat struct {
+	AgentID       string    `json:"agent_id"`
+	Version       string    `json:"version"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	CPUUsage      float64   `json:"cpu_usage"`
+	MemoryUsage   float64   `json:"memory_usage"`
+	IntervalMs    int64     `json:"interval_ms"` // Time until the next heartbeat
+	SentAt        time.Time `json:"sent_at"`
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import "time"
+
+// JobState is the lifecycle state of a job on the agent.
+type JobState string
+
+const (
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+)
+
+// JobAck is the immediate reply to an asynchronous RunRequest.
+type JobAck struct {
+	RequestID string   `json:"request_id"`
+	JobID     string   `json:"job_id"`
+	AgentID   string   `json:"agent_id"`
+	State     JobState `json:"state"`
+}
+
+// JobRequest queries jobs on an agent.
+// Sent to stapply.job.status.<agent_id> or stapply.job.result.<agent_id>.
+type JobRequest struct {
+	RequestID string `json:"request_id"`
+	JobID     string `json:"job_id,omitempty"`  // Empty lists all jobs (status only)
+	WaitMs    int    `json:"wait_ms,omitempty"` // Result only: wait up to this long for completion
+}
+
+// JobInfo describes a single job.
+type JobInfo struct {
+	JobID      string       `json:"job_id"`
+	Action     string       `json:"action"`
+	State      JobState     `json:"state"`
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	Result     *RunResponse `json:"result,omitempty"`
+}
+
+// JobResponse is the reply to a JobRequest.
+type JobResponse struct {
+	RequestID string    `json:"request_id"`
+	Jobs      []JobInfo `json:"jobs"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// NewJobRequest creates a job query for the given job ID.
+func NewJobRequest(jobID string, wait time.Duration) *JobRequest {
+	return &JobRequest{
+		RequestID: generateID(),
+		JobID:     jobID,
+		WaitMs:    int(wait / time.Millisecond),
+	}
+}
@@ -0,0 +1,34 @@
+package protocol
+
+// Key operations.
+const (
+	KeyOpList   = "list"
+	KeyOpAdd    = "add"
+	KeyOpRetire = "retire"
+)
+
+// KeyRequest manages the agent's keyring. Sent to stapply.key.<agent_id>,
+// always encrypted with a key the agent already trusts.
+type KeyRequest struct {
+	RequestID string `json:"request_id"`
+	Op        string `json:"op"`               // list, add or retire
+	KeyID     string `json:"key_id,omitempty"` // Key to add or retire ("" = key without ID)
+	Secret    string `json:"secret,omitempty"` // Secret of the key to add
+}
+
+// KeyResponse lists the agent's key IDs after the operation, primary first.
+type KeyResponse struct {
+	RequestID string   `json:"request_id"`
+	KeyIDs    []string `json:"key_ids"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// NewKeyRequest creates a keyring request.
+func NewKeyRequest(op, keyID, secret string) *KeyRequest {
+	return &KeyRequest{
+		RequestID: generateID(),
+		Op:        op,
+		KeyID:     keyID,
+		Secret:    secret,
+	}
+}
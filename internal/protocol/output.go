@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultOutputLimit caps stdout and stderr (each) in a RunResponse when the
+// request sets no OutputLimit. The agent keeps the full output in its job
+// store, where OutputRequest fetches it.
+const DefaultOutputLimit = 64 * 1024
+
+// Output streams of a job.
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+// OutputRequest fetches part of a job's full output from the agent's job
+// store. Sent to stapply.job.output.<agent_id>.
+type OutputRequest struct {
+	RequestID string `json:"request_id"`
+	JobID     string `json:"job_id"`
+	Stream    string `json:"stream"`           // OutputStdout or OutputStderr
+	Offset    int64  `json:"offset"`           // First byte to return
+	Length    int    `json:"length,omitempty"` // Max bytes to return (0 = agent's chunk size)
+}
+
+// OutputResponse is the reply to an OutputRequest. Data is raw bytes, so
+// chunks may split multi-byte characters.
+type OutputResponse struct {
+	RequestID string `json:"request_id"`
+	Data      []byte `json:"data,omitempty"`
+	Offset    int64  `json:"offset"`
+	Total     int64  `json:"total"` // Full size of the stream
+	Error     string `json:"error,omitempty"`
+}
+
+// NewOutputRequest creates a request for length bytes of a job's stream
+// starting at offset.
+func NewOutputRequest(jobID, stream string, offset int64, length int) *OutputRequest {
+	return &OutputRequest{
+		RequestID: generateID(),
+		JobID:     jobID,
+		Stream:    stream,
+		Offset:    offset,
+		Length:    length,
+	}
+}
+
+// TruncateOutput keeps the head and tail of s, about limit bytes in total,
+// joined by a marker naming how much was dropped. It reports whether s was
+// truncated. Cuts are moved to character boundaries.
+func TruncateOutput(s string, limit int) (string, bool) {
+	if limit <= 0 || len(s) <= limit {
+		return s, false
+	}
+
+	head := limit / 2
+	for head > 0 && !utf8.RuneStart(s[head]) {
+		head--
+	}
+	tail := len(s) - (limit - limit/2)
+	for tail < len(s) && !utf8.RuneStart(s[tail]) {
+		tail++
+	}
+
+	marker := fmt.Sprintf("\n... [%d bytes truncated] ...\n", tail-head)
+	return s[:head] + marker + s[tail:], true
+}
+
+// WithOutputLimit returns r with stdout and stderr cut to limit bytes each
+// by TruncateOutput. r itself is not modified; byte counts keep the full sizes.
+func (r *RunResponse) WithOutputLimit(limit int) *RunResponse {
+	out := *r
+	if !r.Truncated {
+		out.StdoutBytes = int64(len(r.Stdout))
+		out.StderrBytes = int64(len(r.Stderr))
+	}
+	var cutOut, cutErr bool
+	out.Stdout, cutOut = TruncateOutput(r.Stdout, limit)
+	out.Stderr, cutErr = TruncateOutput(r.Stderr, limit)
+	out.Truncated = r.Truncated || cutOut || cutErr
+	return &out
+}
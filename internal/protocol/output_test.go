@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateOutput(t *testing.T) {
+	if got, cut := TruncateOutput("short", 10); got != "short" || cut {
+		t.Errorf("TruncateOutput(short) = %q, %v", got, cut)
+	}
+
+	s := strings.Repeat("a", 100) + strings.Repeat("z", 100)
+	got, cut := TruncateOutput(s, 20)
+	if !cut {
+		t.Fatalf("TruncateOutput() did not truncate")
+	}
+	if !strings.HasPrefix(got, strings.Repeat("a", 10)+"\n") || !strings.HasSuffix(got, "\n"+strings.Repeat("z", 10)) {
+		t.Errorf("TruncateOutput() = %q, want head and tail kept", got)
+	}
+	if !strings.Contains(got, "[180 bytes truncated]") {
+		t.Errorf("TruncateOutput() = %q, want marker with dropped byte count", got)
+	}
+
+	// Cuts never split a multi-byte character
+	got, _ = TruncateOutput(strings.Repeat("é", 50), 15)
+	if !utf8.ValidString(got) {
+		t.Errorf("TruncateOutput() produced invalid UTF-8: %q", got)
+	}
+}
+
+func TestWithOutputLimit(t *testing.T) {
+	r := &RunResponse{Stdout: strings.Repeat("x", 1000), Stderr: "err"}
+	got := r.WithOutputLimit(100)
+	if !got.Truncated || got.StdoutBytes != 1000 || got.StderrBytes != 3 || got.Stderr != "err" {
+		t.Errorf("WithOutputLimit() = truncated %v, bytes %d/%d, stderr %q",
+			got.Truncated, got.StdoutBytes, got.StderrBytes, got.Stderr)
+	}
+	if len(r.Stdout) != 1000 {
+		t.Errorf("WithOutputLimit() modified the original response")
+	}
+	// Limiting again keeps the original sizes
+	if again := got.WithOutputLimit(50); again.StdoutBytes != 1000 {
+		t.Errorf("WithOutputLimit() twice StdoutBytes = %d, want 1000", again.StdoutBytes)
+	}
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QueuedRequest is a run request delivered through an agent's JetStream
+// work queue on RequestTypeQueue.Subject(agent_id) rather than by
+// request/reply, so it reaches agents that are offline when it is sent.
+// Its envelope's message ID is also the JetStream message ID, so the
+// stream refuses to queue a captured request again.
+type QueuedRequest struct {
+	RunID string      `json:"run_id"`
+	Host  string      `json:"host"`
+	App   string      `json:"app"`
+	Step  int         `json:"step"`  // Position among the steps queued for the agent, from 1
+	Steps int         `json:"steps"` // Number of steps queued for the agent in this run
+	Run   *RunRequest `json:"run"`
+}
+
+// QueuedResult is the outcome of a QueuedRequest, published by the agent on
+// ResultSubject(run_id, agent_id).
+type QueuedResult struct {
+	RunID   string       `json:"run_id"`
+	Host    string       `json:"host"`
+	AgentID string       `json:"agent_id"`
+	App     string       `json:"app"`
+	Step    int          `json:"step"`
+	Steps   int          `json:"steps"`
+	Action  string       `json:"action"`
+	Result  *RunResponse `json:"result"`
+}
+
+// NewRunID generates the ID of a queued run.
+func NewRunID() string {
+	return generateID()
+}
+
+// ResultSubject returns the subject results of run runID from agentID are
+// published on. "*" and ">" work as wildcards.
+func ResultSubject(runID, agentID string) string {
+	return subjectPrefix + ".results." + runID + "." + agentID
+}
+
+// CheckRunID rejects run IDs that would not form a single subject token.
+func CheckRunID(runID string) error {
+	if runID == "" || strings.ContainsAny(runID, ".*> \t") {
+		return fmt.Errorf("invalid run id %q", runID)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package protocol
+
+import "testing"
+
+func TestQueuedRequest(t *testing.T) {
+	runID := NewRunID()
+	if err := CheckRunID(runID); err != nil {
+		t.Fatalf("CheckRunID(NewRunID()) error = %v", err)
+	}
+	for _, bad := range []string{"", "a.b", "a*", ">", "a b"} {
+		if err := CheckRunID(bad); err == nil {
+			t.Errorf("CheckRunID(%q) succeeded, want error", bad)
+		}
+	}
+	if got, want := ResultSubject(runID, "web1"), "stapply.results."+runID+".web1"; got != want {
+		t.Errorf("ResultSubject() = %q, want %q", got, want)
+	}
+
+	// The message ID is the one JetStream deduplicates by, so it must be kept
+	qr := &QueuedRequest{RunID: runID, Host: "web", Step: 1, Steps: 2, Run: NewRunRequest("cmd", map[string]string{"command": "true"}, 0, false)}
+	data, err := MarshalWith(RequestTypeQueue, "ctl@test", qr, MarshalOptions{MessageID: "queued-1", Compression: CompressionZstd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got QueuedRequest
+	env, err := Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.MessageID != "queued-1" || env.Type != RequestTypeQueue {
+		t.Errorf("envelope = %+v, want message id queued-1 of type %s", env, RequestTypeQueue)
+	}
+	if got.RunID != runID || got.Step != 1 || got.Steps != 2 || got.Run == nil || got.Run.Args["command"] != "true" {
+		t.Errorf("payload = %+v", got)
+	}
+}
@@ -1,16 +1,66 @@
 package protocol
 
-import "github.com/google/uuid"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
 
 // RequestType identifies the type of request.
 type RequestType string
 
 const (
-	RequestTypePing     RequestType = "ping"
-	RequestTypeRun      RequestType = "run"
-	RequestTypeDiscover RequestType = "discover"
+	RequestTypePing      RequestType = "ping"
+	RequestTypeRun       RequestType = "run"
+	RequestTypeDiscover  RequestType = "discover"
+	RequestTypeUpdate    RequestType = "update"
+	RequestTypeJobStatus RequestType = "job.status"
+	RequestTypeJobResult RequestType = "job.result"
+	RequestTypeCancel    RequestType = "cancel"
+	RequestTypeStream    RequestType = "stream"
+	RequestTypeHeartbeat RequestType = "heartbeat"
+	RequestTypeKey       RequestType = "key"
+	RequestTypeJobOutput RequestType = "job.output"
+	RequestTypeQueue     RequestType = "queue"
 )
 
+// DefaultSubjectPrefix is the first token of every stapply subject.
+const DefaultSubjectPrefix = "stapply"
+
+// subjectPrefix is shared by agent and controller; both sides must use the
+// same one to talk to each other.
+var subjectPrefix = DefaultSubjectPrefix
+
+// SetSubjectPrefix changes the prefix of all subjects, e.g. to run several
+// independent installations on one NATS account. Empty restores the default.
+func SetSubjectPrefix(prefix string) error {
+	if prefix == "" {
+		prefix = DefaultSubjectPrefix
+	}
+	if strings.ContainsAny(prefix, " \t*>") || strings.HasPrefix(prefix, ".") ||
+		strings.HasSuffix(prefix, ".") || strings.Contains(prefix, "..") {
+		return fmt.Errorf("invalid subject prefix %q", prefix)
+	}
+	subjectPrefix = prefix
+	return nil
+}
+
+// SubjectPrefix returns the prefix of all subjects.
+func SubjectPrefix() string {
+	return subjectPrefix
+}
+
+// Subject returns the NATS subject an agent listens on for this request type.
+func (t RequestType) Subject(agentID string) string {
+	return subjectPrefix + "." + string(t) + "." + agentID
+}
+
+// Reply returns the message type used for responses to this request type.
+func (t RequestType) Reply() RequestType {
+	return t + ".reply"
+}
+
 // PingRequest is a health check request.
 type PingRequest struct {
 	RequestID         string      `json:"request_id"`
@@ -40,6 +90,12 @@ type RunRequest struct {
 	Action    string            `json:"action"`
 	Args      map[string]string `json:"args"`
 	DryRun    bool              `json:"dry_run,omitempty"`
+	Stream    bool              `json:"stream,omitempty"` // Publish output lines while running
+	Async     bool              `json:"async,omitempty"`  // Acknowledge with a JobAck and run in background
+
+	// OutputLimit caps stdout and stderr (each) in the response; the full
+	// output stays fetchable with an OutputRequest (0 = DefaultOutputLimit).
+	OutputLimit int `json:"output_limit,omitempty"`
 }
 
 // NewPingRequest creates a new ping request with a generated ID.
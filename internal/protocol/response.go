@@ -1,23 +1,28 @@
 package protocol
 
+import "fmt"
+
 // Status represents the execution status.
 type Status string
 
 const (
-	StatusOK      Status = "ok"
-	StatusFailed  Status = "failed"
-	StatusTimeout Status = "timeout"
-	StatusError   Status = "error"
+	StatusOK        Status = "ok"
+	StatusFailed    Status = "failed"
+	StatusTimeout   Status = "timeout"
+	StatusCancelled Status = "cancelled"
+	StatusError     Status = "error"
+	StatusDenied    Status = "denied" // Refused by the agent's policy
 )
 
 // PingResponse is the response to a ping request.
 type PingResponse struct {
-	RequestID     string  `json:"request_id"`
-	AgentID       string  `json:"agent_id"`
-	Version       string  `json:"version"`
-	UptimeSeconds int64   `json:"uptime_seconds"`
-	CPUUsage      float64 `json:"cpu_usage"`    // Percentage
-	MemoryUsage   float64 `json:"memory_usage"` // Percentage
+	RequestID     string        `json:"request_id"`
+	AgentID       string        `json:"agent_id"`
+	Version       string        `json:"version"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	CPUUsage      float64       `json:"cpu_usage"`    // Percentage
+	MemoryUsage   float64       `json:"memory_usage"` // Percentage
+	Capabilities  *Capabilities `json:"capabilities,omitempty"`
 }
 
 // DiscoverResponse contains system facts.
@@ -32,18 +37,26 @@ type DiscoverResponse struct {
 	MemoryFree    uint64   `json:"memory_free"`     // bytes
 	DiskUsageRoot int      `json:"disk_usage_root"` // percentage
 	IPAddresses   []string `json:"ip_addresses"`
+	Error         string   `json:"error,omitempty"`
 }
 
 // RunResponse is the response to a run request.
 type RunResponse struct {
-	RequestID  string `json:"request_id"`
-	Status     Status `json:"status"`
-	Changed    bool   `json:"changed"`
-	ExitCode   int    `json:"exit_code,omitempty"`
-	Stdout     string `json:"stdout,omitempty"`
-	Stderr     string `json:"stderr,omitempty"`
-	Error      string `json:"error,omitempty"`
-	DurationMs int64  `json:"duration_ms"`
+	RequestID   string `json:"request_id"`
+	Status      Status `json:"status"`
+	Changed     bool   `json:"changed"`
+	ExitCode    int    `json:"exit_code,omitempty"`
+	Stdout      string `json:"stdout,omitempty"`
+	Stderr      string `json:"stderr,omitempty"`
+	StdoutBytes int64  `json:"stdout_bytes"`        // Full size of stdout, even if truncated
+	StderrBytes int64  `json:"stderr_bytes"`        // Full size of stderr, even if truncated
+	Truncated   bool   `json:"truncated,omitempty"` // Stdout or Stderr was cut to the output limit
+	Error       string `json:"error,omitempty"`
+	DurationMs  int64  `json:"duration_ms"`
+
+	// MissingChunks answers ArtifactQueryMissing, as FormatChunkList renders
+	// it. Unlike Stdout it is never truncated.
+	MissingChunks string `json:"missing_chunks,omitempty"`
 }
 
 // NewPingResponse creates a ping response.
@@ -75,6 +88,45 @@ func NewRunResponse(requestID string, changed bool, exitCode int, stdout, stderr
 	}
 }
 
+// NewTimeoutResponse creates a run response for an action killed at its deadline.
+// Output captured before the kill is preserved.
+func NewTimeoutResponse(requestID, stdout, stderr string, durationMs int64) *RunResponse {
+	return &RunResponse{
+		RequestID:  requestID,
+		Status:     StatusTimeout,
+		Changed:    true, // the action may have partially applied
+		ExitCode:   -1,
+		Stdout:     stdout,
+		Stderr:     stderr,
+		Error:      fmt.Sprintf("action timed out after %dms", durationMs),
+		DurationMs: durationMs,
+	}
+}
+
+// NewCancelledResponse creates a run response for an action killed on request.
+// Output captured before the kill is preserved.
+func NewCancelledResponse(requestID, stdout, stderr string, durationMs int64) *RunResponse {
+	return &RunResponse{
+		RequestID:  requestID,
+		Status:     StatusCancelled,
+		Changed:    true, // the action may have partially applied
+		ExitCode:   -1,
+		Stdout:     stdout,
+		Stderr:     stderr,
+		Error:      fmt.Sprintf("action cancelled after %dms", durationMs),
+		DurationMs: durationMs,
+	}
+}
+
+// NewDeniedResponse creates a response for a request refused by policy.
+func NewDeniedResponse(requestID string, err error) *RunResponse {
+	return &RunResponse{
+		RequestID: requestID,
+		Status:    StatusDenied,
+		Error:     err.Error(),
+	}
+}
+
 // NewErrorResponse creates an error run response.
 func NewErrorResponse(requestID string, err error, durationMs int64) *RunResponse {
 	return &RunResponse{
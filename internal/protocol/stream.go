@@ -0,0 +1,15 @@
+package protocol
+
+// StreamSubject returns the subject live output of a run request is
+// published on.
+func StreamSubject(requestID string) string {
+	return RequestTypeStream.Subject(requestID)
+}
+
+// StreamMessage carries one line of live output from a running action.
+type StreamMessage struct {
+	RequestID string `json:"request_id"`
+	Seq       uint64 `json:"seq"`    // Starts at 1, increases per line
+	Stream    string `json:"stream"` // "stdout" or "stderr"
+	Line      string `json:"line"`
+}
@@ -0,0 +1,83 @@
+// Package queue sets up the JetStream streams that carry queued runs to
+// agents and their results back, for agents that are not always connected.
+package queue
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/drax2gma/stapply/internal/protocol"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// MaxAge is how long queued requests wait for their agent and results wait
+// to be collected. Request message IDs are deduplicated for as long.
+const MaxAge = 7 * 24 * time.Hour
+
+// streamName turns the subject prefix into a stream name, which may not
+// contain dots or wildcards.
+func streamName(suffix string) string {
+	name := strings.ToUpper(protocol.SubjectPrefix())
+	name = strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(name)
+	return name + "_" + suffix
+}
+
+// WorkStream returns the name of the stream holding queued requests.
+func WorkStream() string {
+	return streamName("QUEUE")
+}
+
+// ResultStream returns the name of the stream holding results.
+func ResultStream() string {
+	return streamName("RESULTS")
+}
+
+// ConsumerName returns the name of the durable consumer agentID reads its
+// queue with.
+func ConsumerName(agentID string) string {
+	return "agent_" + strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(agentID)
+}
+
+// AckWait is how long JetStream waits for a queued request to be
+// acknowledged before redelivering it. Agents keep running requests alive
+// well within it.
+const AckWait = time.Minute
+
+// Ensure creates both streams, or updates them to the current settings. Only
+// the controller calls it: agents need no rights to manage streams.
+func Ensure(ctx context.Context, js jetstream.JetStream) error {
+	if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:        WorkStream(),
+		Description: "stapply run requests queued per agent",
+		Subjects:    []string{protocol.RequestTypeQueue.Subject(">")},
+		Retention:   jetstream.WorkQueuePolicy,
+		MaxAge:      MaxAge,
+		Duplicates:  MaxAge,
+		Storage:     jetstream.FileStorage,
+	}); err != nil {
+		return err
+	}
+	_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:        ResultStream(),
+		Description: "stapply results of queued runs",
+		Subjects:    []string{protocol.ResultSubject("*", ">")},
+		MaxAge:      MaxAge,
+		Storage:     jetstream.FileStorage,
+	})
+	return err
+}
+
+// EnsureConsumer creates the durable consumer agentID reads its queue with,
+// or updates it to the current settings. It hands out one request at a time,
+// so steps run in the order they were queued.
+func EnsureConsumer(ctx context.Context, js jetstream.JetStream, agentID string) error {
+	_, err := js.CreateOrUpdateConsumer(ctx, WorkStream(), jetstream.ConsumerConfig{
+		Durable:       ConsumerName(agentID),
+		FilterSubject: protocol.RequestTypeQueue.Subject(agentID),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       AckWait,
+		MaxAckPending: 1,
+	})
+	return err
+}
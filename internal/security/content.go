@@ -0,0 +1,50 @@
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// contentKeyLabel keys the HMAC content keys are derived with, after being
+// bound to the shared secret if there is one.
+const contentKeyLabel = "stapply v1 artifact content key"
+
+// ContentKey returns a hash that, fed an artifact, yields the key it is
+// encrypted with in storage shared by several agents (see ContentCipher).
+// The key depends on the content and on secret, so identical artifacts are
+// stored once per secret, and it cannot be computed without the secret, not
+// even by someone holding the artifact.
+//
+// Without a secret, that is with encryption disabled, the key depends on the
+// content alone: this is convergent encryption, which anyone who has or can
+// guess the artifact can reproduce. The key then also travels in plaintext
+// inside the request, so the storage encryption only keeps the artifact from
+// those who can read the bucket but not the requests.
+func ContentKey(secret string) hash.Hash {
+	key := []byte(contentKeyLabel)
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(key)
+		key = mac.Sum(nil)
+	}
+	return hmac.New(sha256.New, key)
+}
+
+// ContentCipher returns the AES-256-CTR keystream of an artifact encrypted
+// with a key from ContentKey. Every key encrypts a single content, so the
+// IV is fixed. It provides no integrity: readers must check the artifact's
+// SHA-256, which they receive over the authenticated request channel.
+func ContentCipher(key []byte) (cipher.Stream, error) {
+	if len(key) != sha256.Size {
+		return nil, fmt.Errorf("content key must be %d bytes, got %d", sha256.Size, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}
@@ -1,58 +1,362 @@
 package security
 
 import (
+	"bytes"
+	"container/list"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
 )
 
-// DeriveKey generates a 32-byte key from a string secret using SHA-256.
-func DeriveKey(secret string) []byte {
-	hash := sha256.Sum256([]byte(secret))
-	return hash[:]
+// Ciphertext format (version 2):
+//
+//	"stap" | version | kdf | salt len | salt | key id len | key id | nonce | sealed
+//
+// Everything before the nonce is authenticated as AES-GCM additional data.
+// Version 1 (key ID header only) and headerless ciphertexts use DeriveKey
+// and are only accepted as legacy formats.
+const cipherVersion = 2
+
+// KDF identifiers stored in the ciphertext header.
+const (
+	KDFHKDF     byte = 1 // HKDF-SHA256, for random hex keys
+	KDFArgon2id byte = 2 // Argon2id, for human passphrases
+)
+
+const saltSize = 16
+
+// Argon2id parameters (RFC 9106, second recommended option).
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+)
+
+// hkdfInfo binds derived keys to their use.
+const hkdfInfo = "stapply v2 aes-256-gcm"
+
+// maxDerivedKeys bounds the cache of derived keys; the least recently used
+// key is dropped when it is full.
+const maxDerivedKeys = 1024
+
+// Argon2id costs 64 MiB per run and salts come from unauthenticated headers,
+// so uncached derivations are limited: at most maxArgonRuns at a time, and
+// per key argonBurst in a row before they are paced to one per argonRefill.
+// Honest senders reuse one salt per process, so they need a single run.
+const (
+	maxArgonRuns = 2
+	argonBurst   = 16
+	argonRefill  = 250 * time.Millisecond
+)
+
+var (
+	deriveMu    sync.Mutex
+	derived     = newKeyCache(maxDerivedKeys)   // kdf|key id|salt|secret -> AES key
+	sendSalt    = make(map[string][]byte)       // kdf|secret -> salt used when encrypting
+	argonLimits = make(map[string]*tokenBucket) // key id|secret -> Argon2id runs left
+
+	argonSlots = make(chan struct{}, maxArgonRuns)
+)
+
+// keyCache is a least-recently-used cache of derived keys.
+type keyCache struct {
+	max   int
+	order *list.List // Front is the most recently used
+	items map[string]*list.Element
 }
 
-// Encrypt encrypts data using AES-GCM with the given string secret.
-func Encrypt(data []byte, secret string) ([]byte, error) {
+type keyCacheEntry struct {
+	name string
+	key  []byte
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{max: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *keyCache) get(name string) ([]byte, bool) {
+	e, ok := c.items[name]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*keyCacheEntry).key, true
+}
+
+func (c *keyCache) add(name string, key []byte) {
+	if e, ok := c.items[name]; ok {
+		e.Value.(*keyCacheEntry).key = key
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[name] = c.order.PushFront(&keyCacheEntry{name: name, key: key})
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*keyCacheEntry).name)
+	}
+}
+
+// tokenBucket allows max events at once and one more per refill after that.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens int
+	max    int
+	refill time.Duration
+	last   time.Time
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.last = now
+	}
+	if n := int(now.Sub(b.last) / b.refill); n > 0 {
+		b.tokens = min(b.max, b.tokens+n)
+		b.last = b.last.Add(time.Duration(n) * b.refill)
+	}
+	if b.tokens == 0 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// kdfFor picks the KDF for a secret: HKDF for random keys of at least 128
+// bits written in hex (as made by GenerateKey), Argon2id for anything else.
+func kdfFor(secret string) byte {
+	if len(secret) >= 32 {
+		if _, err := hex.DecodeString(secret); err == nil {
+			return KDFHKDF
+		}
+	}
+	return KDFArgon2id
+}
+
+// derivedName is the cache key of the AES key for secret, named id, and salt.
+func derivedName(kdf byte, salt []byte, id, secret string) string {
+	return string([]byte{kdf}) + id + "\x00" + string(salt) + secret
+}
+
+// deriveAESKey returns the AES-256 key for the key secret, named id, and salt
+// with kdf, and whether it had to be derived rather than taken from the
+// cache. Callers only pass keys they hold, so forged headers naming an
+// unknown key ID never get here, and those naming a known one only use up
+// that key's Argon2id runs.
+func deriveAESKey(kdf byte, salt []byte, id, secret string) ([]byte, bool, error) {
+	name := derivedName(kdf, salt, id, secret)
+	deriveMu.Lock()
+	key, ok := derived.get(name)
+	limit := argonLimits[id+"\x00"+secret]
+	if limit == nil && kdf == KDFArgon2id {
+		limit = &tokenBucket{tokens: argonBurst, max: argonBurst, refill: argonRefill}
+		argonLimits[id+"\x00"+secret] = limit
+	}
+	deriveMu.Unlock()
+	if ok {
+		return key, false, nil
+	}
+
+	switch kdf {
+	case KDFHKDF:
+		var err error
+		if key, err = hkdf.Key(sha256.New, []byte(secret), salt, hkdfInfo, 32); err != nil {
+			return nil, false, err
+		}
+	case KDFArgon2id:
+		if !limit.allow(time.Now()) {
+			return nil, false, fmt.Errorf("too many Argon2id key derivations for key %q, try again later", id)
+		}
+		argonSlots <- struct{}{}
+		key = argon2.IDKey([]byte(secret), salt, argonTime, argonMemory, argonThreads, 32)
+		<-argonSlots
+	default:
+		return nil, false, fmt.Errorf("unknown KDF %d", kdf)
+	}
+	return key, true, nil
+}
+
+// rememberKey caches a derived key once it is known to be genuine: used to
+// encrypt, or authenticated a ciphertext. Keys for forged salts are never
+// cached, so they cannot evict the keys of real senders.
+func rememberKey(kdf byte, salt []byte, id, secret string, key []byte) {
+	deriveMu.Lock()
+	defer deriveMu.Unlock()
+	derived.add(derivedName(kdf, salt, id, secret), key)
+}
+
+// senderSalt returns the salt this process encrypts with for secret. One salt
+// per secret and process keeps receivers from re-running the KDF per message.
+func senderSalt(kdf byte, secret string) []byte {
+	deriveMu.Lock()
+	defer deriveMu.Unlock()
+	cacheKey := string([]byte{kdf}) + secret
+	if salt, ok := sendSalt[cacheKey]; ok {
+		return salt
+	}
+	salt := make([]byte, saltSize)
+	rand.Read(salt) // Never fails; it crashes the program instead
+	sendSalt[cacheKey] = salt
+	return salt
+}
+
+// seal encrypts data with secret in the version 2 format.
+func seal(data []byte, id, secret string) ([]byte, error) {
 	if secret == "" {
 		return nil, fmt.Errorf("secret key is empty")
 	}
-
-	key := DeriveKey(secret)
-	block, err := aes.NewCipher(key)
+	kdf := kdfFor(secret)
+	salt := senderSalt(kdf, secret)
+	key, fresh, err := deriveAESKey(kdf, salt, id, secret)
 	if err != nil {
 		return nil, err
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	if fresh {
+		rememberKey(kdf, salt, id, secret, key)
+	}
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
 
+	header := make([]byte, 0, len(keyHeaderMagic)+4+len(salt)+len(id))
+	header = append(header, keyHeaderMagic...)
+	header = append(header, cipherVersion, kdf, byte(len(salt)))
+	header = append(header, salt...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
+	// Seal's output must not overlap the additional data, so copy the header
+	out := make([]byte, 0, len(header)+len(nonce)+len(data)+gcm.Overhead())
+	out = append(append(out, header...), nonce...)
+	return gcm.Seal(out, nonce, data, header), nil
+}
 
-	return gcm.Seal(nonce, nonce, data, nil), nil
+// sealed is a parsed version 2 ciphertext.
+type sealed struct {
+	kdf    byte
+	salt   []byte
+	id     string
+	header []byte // Authenticated header bytes
+	body   []byte // Nonce and sealed data
 }
 
-// Decrypt decrypts data using AES-GCM with the given string secret.
-func Decrypt(data []byte, secret string) ([]byte, error) {
+// parseSealed parses a version 2 ciphertext. ok is false for anything else.
+func parseSealed(data []byte) (s sealed, ok bool) {
+	n := len(keyHeaderMagic)
+	if len(data) < n+4 || !bytes.Equal(data[:n], keyHeaderMagic) || data[n] != cipherVersion {
+		return s, false
+	}
+	s.kdf = data[n+1]
+	saltLen := int(data[n+2])
+	pos := n + 3
+	if saltLen != saltSize || len(data) < pos+saltLen+1 {
+		return s, false
+	}
+	s.salt = data[pos : pos+saltLen]
+	pos += saltLen
+	idLen := int(data[pos])
+	pos++
+	if len(data) < pos+idLen {
+		return s, false
+	}
+	s.id = string(data[pos : pos+idLen])
+	if s.id != "" && !keyIDPattern.MatchString(s.id) {
+		return s, false
+	}
+	pos += idLen
+	s.header, s.body = data[:pos], data[pos:]
+	return s, true
+}
+
+// open decrypts a parsed version 2 ciphertext with secret. The header is
+// not authenticated until the key is derived, so a KDF other than the one
+// secret calls for is refused before any work is done: otherwise anyone
+// could make a hex key holder run Argon2id.
+func (s sealed) open(secret string) ([]byte, error) {
 	if secret == "" {
 		return nil, fmt.Errorf("secret key is empty")
 	}
+	if want := kdfFor(secret); s.kdf != want {
+		return nil, fmt.Errorf("ciphertext uses KDF %d, key calls for %d", s.kdf, want)
+	}
+	key, fresh, err := deriveAESKey(s.kdf, s.salt, s.id, secret)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.body) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := s.body[:gcm.NonceSize()], s.body[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, s.header)
+	if err == nil && fresh {
+		rememberKey(s.kdf, s.salt, s.id, secret, key)
+	}
+	return plain, err
+}
 
-	key := DeriveKey(secret)
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
+
+// DeriveKey generates a 32-byte key from a string secret using SHA-256.
+// Only the legacy ciphertext formats use it.
+func DeriveKey(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// Encrypt encrypts data using AES-GCM with the given string secret in the
+// legacy headerless format.
+func Encrypt(data []byte, secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("secret key is empty")
+	}
+
+	gcm, err := newGCM(DeriveKey(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// Decrypt decrypts legacy headerless data using AES-GCM with the given
+// string secret.
+func Decrypt(data []byte, secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("secret key is empty")
+	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(DeriveKey(secret))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,110 @@
+package security
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newKeyCache(2)
+	c.add("a", []byte{1})
+	c.add("b", []byte{2})
+	if _, ok := c.get("a"); !ok { // a is now more recent than b
+		t.Fatal("get(a) missed")
+	}
+	c.add("c", []byte{3})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used key b was kept")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, ok := c.get(name); !ok {
+			t.Errorf("get(%s) missed after eviction", name)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := &tokenBucket{tokens: 2, max: 2, refill: time.Second}
+	now := time.Unix(1000, 0)
+	if !b.allow(now) || !b.allow(now) {
+		t.Fatal("burst was not allowed")
+	}
+	if b.allow(now) {
+		t.Error("allowed past the burst")
+	}
+	if !b.allow(now.Add(time.Second)) {
+		t.Error("no token after one refill interval")
+	}
+	if b.allow(now.Add(1500 * time.Millisecond)) {
+		t.Error("allowed before the next refill")
+	}
+	// Idle time refills up to the burst, not beyond it
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.allow(later) {
+			t.Fatalf("token %d missing after a long pause", i)
+		}
+	}
+	if b.allow(later) {
+		t.Error("idle time refilled beyond the burst")
+	}
+}
+
+func TestArgonLimitPerKey(t *testing.T) {
+	flooded := Key{ID: "flooded", Secret: "first passphrase"}
+	quiet := Key{ID: "quiet", Secret: "second passphrase"}
+	ring := NewKeyring(flooded, quiet)
+
+	// A sender that does not know the secret names a key the ring holds
+	forged, err := seal([]byte("hi"), flooded.ID, "guessed passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deriveMu.Lock()
+	argonLimits[flooded.ID+"\x00"+flooded.Secret] = &tokenBucket{max: argonBurst, refill: time.Hour}
+	deriveMu.Unlock()
+	if _, _, err := ring.Decrypt(forged); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Fatalf("Decrypt(forged) error = %v, want the key's Argon2id runs used up", err)
+	}
+
+	// ... which leaves the other keys alone
+	ct, err := quiet.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deriveMu.Lock()
+	derived = newKeyCache(maxDerivedKeys) // As if sent by another process
+	deriveMu.Unlock()
+	if plain, _, err := ring.Decrypt(ct); err != nil || string(plain) != "hello" {
+		t.Errorf("Decrypt() = %q, %v", plain, err)
+	}
+
+	// Unknown key IDs are refused without deriving anything
+	unknown, err := seal([]byte("hi"), "unknown", "guessed passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ring.Decrypt(unknown); err == nil || !strings.Contains(err.Error(), "unknown key id") {
+		t.Errorf("Decrypt(unknown) error = %v, want unknown key id", err)
+	}
+}
+
+func TestForgedSaltsAreNotCached(t *testing.T) {
+	key := Key{ID: "hex", Secret: strings.Repeat("ab", 16)}
+	forged, err := seal([]byte("hi"), key.ID, strings.Repeat("cd", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := parseSealed(forged)
+	if _, err := key.Decrypt(forged); err == nil {
+		t.Fatal("Decrypt() accepted a ciphertext of another secret")
+	}
+	deriveMu.Lock()
+	_, cached := derived.get(derivedName(s.kdf, s.salt, key.ID, key.Secret))
+	deriveMu.Unlock()
+	if cached {
+		t.Error("key derived for a forged salt was cached")
+	}
+}
@@ -0,0 +1,355 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// keyHeaderMagic starts every ciphertext with a header. Legacy ciphertexts
+// of keys without an ID have no header, as produced by Encrypt.
+var keyHeaderMagic = []byte("stap")
+
+// legacyHeaderVersion is the key ID header that predates the KDF fields.
+const legacyHeaderVersion = 1
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Key is a shared secret, optionally identified by an ID. Ciphertexts of a
+// key with an ID carry that ID so the receiver can pick the right key.
+type Key struct {
+	ID     string
+	Secret string
+
+	legacy bool // Set on keys that decrypted a legacy ciphertext; Encrypt then uses that format too
+}
+
+// keyIDPrefix marks a key written with its ID, "kid:<id>:<secret>". Without
+// it the whole string is the secret, so secrets that contain ":" keep their
+// meaning.
+const keyIDPrefix = "kid:"
+
+// ParseKey parses "kid:<id>:<secret>" or a bare secret without ID.
+func ParseKey(s string) Key {
+	if rest, ok := strings.CutPrefix(s, keyIDPrefix); ok {
+		if id, secret, ok := strings.Cut(rest, ":"); ok && keyIDPattern.MatchString(id) {
+			return Key{ID: id, Secret: secret}
+		}
+	}
+	return Key{Secret: s}
+}
+
+// String returns the key in the form accepted by ParseKey.
+func (k Key) String() string {
+	if k.ID == "" {
+		return k.Secret
+	}
+	return keyIDPrefix + k.ID + ":" + k.Secret
+}
+
+// Name returns the key ID for display.
+func (k Key) Name() string {
+	if k.ID == "" {
+		return "(default)"
+	}
+	return k.ID
+}
+
+// GenerateKey creates a random 32-byte hex key with the given ID.
+func GenerateKey(id string) (Key, error) {
+	if !keyIDPattern.MatchString(id) {
+		return Key{}, fmt.Errorf("invalid key id %q", id)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return Key{}, err
+	}
+	return Key{ID: id, Secret: hex.EncodeToString(buf)}, nil
+}
+
+// Legacy reports whether the key encrypts in the legacy format, as keys
+// returned for a legacy ciphertext do.
+func (k Key) Legacy() bool {
+	return k.legacy
+}
+
+// WithLegacy returns k encrypting and decrypting in the legacy format, for
+// peers that predate the versioned one.
+func (k Key) WithLegacy() Key {
+	k.legacy = true
+	return k
+}
+
+// Encrypt encrypts data with the key in the versioned format. Keys returned
+// for a legacy ciphertext encrypt in the legacy format so replies stay
+// readable by the sender.
+func (k Key) Encrypt(data []byte) ([]byte, error) {
+	if !k.legacy {
+		return seal(data, k.ID, k.Secret)
+	}
+
+	ct, err := Encrypt(data, k.Secret)
+	if err != nil || k.ID == "" {
+		return ct, err
+	}
+	out := make([]byte, 0, len(keyHeaderMagic)+2+len(k.ID)+len(ct))
+	out = append(out, keyHeaderMagic...)
+	out = append(out, legacyHeaderVersion, byte(len(k.ID)))
+	out = append(out, k.ID...)
+	return append(out, ct...), nil
+}
+
+// Decrypt decrypts data produced by Encrypt on the same key. Legacy
+// ciphertexts are refused unless the key is a legacy one, which accepts
+// nothing else.
+func (k Key) Decrypt(data []byte) ([]byte, error) {
+	if k.legacy {
+		if id, body, ok := splitLegacyHeader(data); ok {
+			if id != k.ID {
+				return nil, fmt.Errorf("message encrypted with key %q, have %q", id, k.Name())
+			}
+			return Decrypt(body, k.Secret)
+		}
+		if k.ID != "" {
+			return nil, fmt.Errorf("message names no key, have %q", k.Name())
+		}
+		return Decrypt(data, k.Secret)
+	}
+
+	s, ok := parseSealed(data)
+	if !ok {
+		return nil, errLegacyFormat
+	}
+	if s.id != k.ID {
+		return nil, fmt.Errorf("message encrypted with key %q, have %q", s.id, k.Name())
+	}
+	return s.open(k.Secret)
+}
+
+// errLegacyFormat is returned for ciphertexts without a version 2 header
+// when legacy formats are not accepted.
+var errLegacyFormat = fmt.Errorf("legacy ciphertext format is not accepted")
+
+// splitLegacyHeader returns the key ID and ciphertext of a message with a
+// legacy key header. ok is false for messages without one.
+func splitLegacyHeader(data []byte) (id string, body []byte, ok bool) {
+	n := len(keyHeaderMagic)
+	if len(data) < n+2 || !bytes.Equal(data[:n], keyHeaderMagic) || data[n] != legacyHeaderVersion {
+		return "", nil, false
+	}
+	idLen := int(data[n+1])
+	if idLen == 0 || len(data) < n+2+idLen {
+		return "", nil, false
+	}
+	id = string(data[n+2 : n+2+idLen])
+	if !keyIDPattern.MatchString(id) {
+		return "", nil, false
+	}
+	return id, data[n+2+idLen:], true
+}
+
+// Keyring holds the keys an agent accepts. The first key is the primary one,
+// used for messages that are not replies to a request.
+type Keyring struct {
+	mu          sync.RWMutex
+	keys        []Key
+	allowLegacy bool
+}
+
+// NewKeyring creates a keyring with the given keys, primary first.
+func NewKeyring(keys ...Key) *Keyring {
+	return &Keyring{keys: append([]Key(nil), keys...)}
+}
+
+// SetAllowLegacy makes Decrypt accept the legacy ciphertext formats (no
+// header or key ID header only, SHA-256 key derivation), for the migration
+// window while senders still use them.
+func (r *Keyring) SetAllowLegacy(allow bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.allowLegacy = allow
+}
+
+// Empty reports whether the keyring has no keys (encryption disabled).
+func (r *Keyring) Empty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys) == 0
+}
+
+// Primary returns the primary key.
+func (r *Keyring) Primary() (Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.keys) == 0 {
+		return Key{}, false
+	}
+	return r.keys[0], true
+}
+
+// IDs returns the IDs of all keys, primary first.
+func (r *Keyring) IDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, len(r.keys))
+	for i, k := range r.keys {
+		ids[i] = k.Name()
+	}
+	return ids
+}
+
+// Get returns the key with the given ID.
+func (r *Keyring) Get(id string) (Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range r.keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// Add appends a key. Adding a key whose ID is already present replaces it.
+func (r *Keyring) Add(k Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.keys {
+		if r.keys[i].ID == k.ID {
+			r.keys[i] = k
+			return
+		}
+	}
+	r.keys = append(r.keys, k)
+}
+
+// Remove drops the key with the given ID. It returns false if no such key exists.
+func (r *Keyring) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.keys {
+		if r.keys[i].ID == id {
+			r.keys = append(r.keys[:i], r.keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Decrypt decrypts data with the key named in its header. Keys without an
+// ID are tried in order for messages that name none. The returned key
+// encrypts replies in the format data was in.
+func (r *Keyring) Decrypt(data []byte) ([]byte, Key, error) {
+	r.mu.RLock()
+	keys := append([]Key(nil), r.keys...)
+	allowLegacy := r.allowLegacy
+	r.mu.RUnlock()
+
+	if s, ok := parseSealed(data); ok {
+		// Only the named key is tried, so headers naming a key ID the ring
+		// lacks cost no key derivation
+		for _, k := range keys {
+			if k.ID == s.id {
+				plain, err := s.open(k.Secret)
+				if err != nil {
+					return nil, Key{}, err
+				}
+				return plain, k, nil
+			}
+		}
+		if s.id == "" {
+			return nil, Key{}, fmt.Errorf("no key without id configured")
+		}
+		return nil, Key{}, fmt.Errorf("unknown key id %q", s.id)
+	}
+
+	if !allowLegacy {
+		return nil, Key{}, errLegacyFormat
+	}
+
+	if id, body, ok := splitLegacyHeader(data); ok {
+		for _, k := range keys {
+			if k.ID == id {
+				plain, err := Decrypt(body, k.Secret)
+				k.legacy = true
+				return plain, k, err
+			}
+		}
+		return nil, Key{}, fmt.Errorf("unknown key id %q", id)
+	}
+
+	err := fmt.Errorf("no key without id configured")
+	for _, k := range keys {
+		if k.ID != "" {
+			continue
+		}
+		var plain []byte
+		if plain, err = Decrypt(data, k.Secret); err == nil {
+			k.legacy = true
+			return plain, k, nil
+		}
+	}
+	return nil, Key{}, err
+}
+
+// LoadKeyring reads a keyring file with one key per line in the form
+// accepted by ParseKey, primary first. Blank lines and # comments are skipped.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := NewKeyring()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r.Add(ParseKey(line))
+	}
+	return r, scanner.Err()
+}
+
+// Save writes the keyring to path atomically with mode 0600.
+func (r *Keyring) Save(path string) error {
+	r.mu.RLock()
+	var buf bytes.Buffer
+	buf.WriteString("# stapply agent keyring: one key per line, primary first\n")
+	for _, k := range r.keys {
+		buf.WriteString(k.String() + "\n")
+	}
+	r.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keyring-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
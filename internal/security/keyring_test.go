@@ -0,0 +1,154 @@
+package security
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Key
+	}{
+		{input: "secret", want: Key{Secret: "secret"}},
+		{input: "kid:prod-2:abcd", want: Key{ID: "prod-2", Secret: "abcd"}},
+		{input: "kid:prod-2:ab:cd", want: Key{ID: "prod-2", Secret: "ab:cd"}},
+		// Secrets that merely contain ":" are bare secrets
+		{input: "prod-2:abcd", want: Key{Secret: "prod-2:abcd"}},
+		{input: ":abcd", want: Key{Secret: ":abcd"}},
+		{input: "kid:bad id:abcd", want: Key{Secret: "kid:bad id:abcd"}},
+		{input: "kid:abcd", want: Key{Secret: "kid:abcd"}},
+	}
+
+	for _, tt := range tests {
+		if got := ParseKey(tt.input); got != tt.want {
+			t.Errorf("ParseKey(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+		if got := ParseKey(tt.want.String()); got != tt.want {
+			t.Errorf("ParseKey(%q.String()) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestKeyringDecrypt(t *testing.T) {
+	legacy := Key{Secret: "old"}
+	prod1 := Key{ID: "prod-1", Secret: "one"}
+	prod2 := Key{ID: "prod-2", Secret: "two"}
+	ring := NewKeyring(legacy, prod1)
+
+	for _, k := range []Key{legacy, prod1} {
+		ct, err := k.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+		plain, used, err := ring.Decrypt(ct)
+		if err != nil {
+			t.Fatalf("Decrypt(%s) error = %v", k.Name(), err)
+		}
+		if string(plain) != "hello" || used != k {
+			t.Errorf("Decrypt(%s) = %q with %s", k.Name(), plain, used.Name())
+		}
+	}
+
+	ct, _ := prod2.Encrypt([]byte("hello"))
+	if _, _, err := ring.Decrypt(ct); err == nil {
+		t.Errorf("Decrypt() with unknown key id succeeded")
+	}
+
+	ring.Remove("")
+	ct, _ = legacy.Encrypt([]byte("hello"))
+	if _, _, err := ring.Decrypt(ct); err == nil {
+		t.Errorf("Decrypt() with retired legacy key succeeded")
+	}
+}
+
+func TestKeyringSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	ring := NewKeyring(Key{Secret: "old"}, Key{ID: "prod-2", Secret: "two"})
+	if err := ring.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("LoadKeyring() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded.keys, ring.keys) {
+		t.Errorf("LoadKeyring() = %+v, want %+v", loaded.keys, ring.keys)
+	}
+}
+
+func TestCiphertextFormat(t *testing.T) {
+	hexKey, _ := GenerateKey("prod-1")
+	passphrase := Key{ID: "lab", Secret: "correct horse battery staple"}
+
+	for _, tt := range []struct {
+		key Key
+		kdf byte
+	}{
+		{hexKey, KDFHKDF},
+		{passphrase, KDFArgon2id},
+	} {
+		ct, err := tt.key.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+		s, ok := parseSealed(ct)
+		if !ok || s.kdf != tt.kdf || s.id != tt.key.ID || len(s.salt) != saltSize {
+			t.Fatalf("Encrypt(%s) header = %+v, ok = %v", tt.key.Name(), s, ok)
+		}
+		if plain, err := tt.key.Decrypt(ct); err != nil || string(plain) != "hello" {
+			t.Errorf("Decrypt(%s) = %q, %v", tt.key.Name(), plain, err)
+		}
+
+		// A KDF other than the key's is refused before deriving anything, so
+		// a forged header cannot make a hex key holder run Argon2id
+		ct[len(keyHeaderMagic)+1] ^= 3
+		if _, err := tt.key.Decrypt(ct); err == nil || !strings.Contains(err.Error(), "KDF") {
+			t.Errorf("Decrypt(%s) with tampered KDF error = %v, want KDF mismatch", tt.key.Name(), err)
+		}
+	}
+}
+
+func TestKeyringLegacyFormat(t *testing.T) {
+	bare := Key{Secret: "old"}
+	named := Key{ID: "prod-1", Secret: "one"}
+	ring := NewKeyring(bare, named)
+
+	for _, k := range []Key{bare, named} {
+		legacyKey := k.WithLegacy()
+		ct, err := legacyKey.Encrypt([]byte("hello"))
+		if err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+		if _, ok := parseSealed(ct); ok {
+			t.Fatalf("legacy Encrypt(%s) produced a versioned ciphertext", k.Name())
+		}
+
+		ring.SetAllowLegacy(false)
+		if _, _, err := ring.Decrypt(ct); err == nil {
+			t.Errorf("Decrypt(%s) accepted legacy format while disallowed", k.Name())
+		}
+
+		ring.SetAllowLegacy(true)
+		plain, used, err := ring.Decrypt(ct)
+		if err != nil || string(plain) != "hello" {
+			t.Fatalf("Decrypt(%s) = %q, %v", k.Name(), plain, err)
+		}
+		// Replies to a legacy sender must stay legacy
+		reply, _ := used.Encrypt([]byte("hi"))
+		if _, ok := parseSealed(reply); ok {
+			t.Errorf("reply to legacy %s message uses the versioned format", k.Name())
+		}
+		// ... which a controller talking to an old agent reads with its key
+		if plain, err := legacyKey.Decrypt(reply); err != nil || string(plain) != "hi" {
+			t.Errorf("legacy Decrypt(%s) of the reply = %q, %v", k.Name(), plain, err)
+		}
+		current, _ := k.Encrypt([]byte("hi"))
+		if _, err := legacyKey.Decrypt(current); err == nil {
+			t.Errorf("legacy Decrypt(%s) accepted the versioned format", k.Name())
+		}
+	}
+}
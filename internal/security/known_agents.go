@@ -0,0 +1,135 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IdentityMismatchError reports an agent whose signing key differs from the
+// one pinned in known_agents.
+type IdentityMismatchError struct {
+	AgentID string
+	Pinned  string
+	Got     string
+	Path    string
+}
+
+func (e *IdentityMismatchError) Error() string {
+	return fmt.Sprintf("identity of agent %s has changed: pinned %s, got %s (remove its line from %s if the change is expected)",
+		e.AgentID, Fingerprint(e.Pinned), Fingerprint(e.Got), e.Path)
+}
+
+// KnownAgents pins the public key of every agent the controller has talked
+// to, trusting each agent's key on first use like SSH known_hosts. The file
+// has one "<agent_id> <public_key>" line per agent.
+type KnownAgents struct {
+	mu   sync.Mutex
+	path string
+	keys map[string]string
+}
+
+// LoadKnownAgents reads the known agents file. A missing file is empty.
+func LoadKnownAgents(path string) (*KnownAgents, error) {
+	k := &KnownAgents{path: path, keys: make(map[string]string)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<agent_id> <public_key>\"", path, lineNum)
+		}
+		k.keys[fields[0]] = fields[1]
+	}
+	return k, scanner.Err()
+}
+
+// Path returns the file the pins are stored in.
+func (k *KnownAgents) Path() string {
+	return k.path
+}
+
+// Pinned returns the public key pinned for agentID.
+func (k *KnownAgents) Pinned(agentID string) (string, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pub, ok := k.keys[agentID]
+	return pub, ok
+}
+
+// Verify checks pub against the key pinned for agentID. An unknown agent is
+// pinned to pub and saved; added reports that. A different key yields an
+// *IdentityMismatchError.
+func (k *KnownAgents) Verify(agentID, pub string) (added bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if pinned, ok := k.keys[agentID]; ok {
+		if pinned != pub {
+			return false, &IdentityMismatchError{AgentID: agentID, Pinned: pinned, Got: pub, Path: k.path}
+		}
+		return false, nil
+	}
+
+	k.keys[agentID] = pub
+	if err := k.save(); err != nil {
+		delete(k.keys, agentID)
+		return false, fmt.Errorf("save %s: %w", k.path, err)
+	}
+	return true, nil
+}
+
+// save writes the file atomically. The caller must hold k.mu.
+func (k *KnownAgents) save() error {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	buf.WriteString("# stapply known agents: <agent_id> <public_key>\n")
+	for _, id := range ids {
+		fmt.Fprintf(&buf, "%s %s\n", id, k.keys[id])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".known_agents-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
@@ -0,0 +1,42 @@
+package security
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownAgentsTrustOnFirstUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stapply", "known_agents")
+
+	known, err := LoadKnownAgents(path)
+	if err != nil {
+		t.Fatalf("LoadKnownAgents() error = %v", err)
+	}
+
+	added, err := known.Verify("web1", "NKEY1")
+	if err != nil || !added {
+		t.Fatalf("Verify(first use) = %v, %v; want true, nil", added, err)
+	}
+	if added, err := known.Verify("web1", "NKEY1"); err != nil || added {
+		t.Errorf("Verify(same key) = %v, %v; want false, nil", added, err)
+	}
+
+	// Pins survive a reload and a changed key is refused
+	known, err = LoadKnownAgents(path)
+	if err != nil {
+		t.Fatalf("LoadKnownAgents(reload) error = %v", err)
+	}
+	if pub, ok := known.Pinned("web1"); !ok || pub != "NKEY1" {
+		t.Errorf("Pinned(web1) = %q, %v; want NKEY1, true", pub, ok)
+	}
+
+	_, err = known.Verify("web1", "NKEY2")
+	var mismatch *IdentityMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Verify(changed key) error = %v, want IdentityMismatchError", err)
+	}
+	if mismatch.Pinned != "NKEY1" || mismatch.Got != "NKEY2" {
+		t.Errorf("mismatch = %+v", mismatch)
+	}
+}
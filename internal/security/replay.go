@@ -0,0 +1,74 @@
+package security
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReplayGuard rejects messages that are too old, from the future, or whose
+// ID was already seen. IDs are remembered for as long as their timestamp is
+// inside the window, so replaying a message later fails the timestamp check.
+type ReplayGuard struct {
+	skew time.Duration
+	now  func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time // message ID -> expiry
+	next time.Time            // next time expired IDs are pruned
+}
+
+// NewReplayGuard creates a guard accepting timestamps within ±skew.
+func NewReplayGuard(skew time.Duration) *ReplayGuard {
+	return &ReplayGuard{
+		skew: skew,
+		now:  time.Now,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Check validates a message ID and timestamp and records the ID.
+func (g *ReplayGuard) Check(id string, ts time.Time) error {
+	now := g.now()
+	if err := checkFresh(id, ts, now, g.skew); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !now.Before(g.next) {
+		for k, exp := range g.seen {
+			if now.After(exp) {
+				delete(g.seen, k)
+			}
+		}
+		g.next = now.Add(g.skew)
+	}
+
+	if _, dup := g.seen[id]; dup {
+		return fmt.Errorf("duplicate message id %s", id)
+	}
+	g.seen[id] = ts.Add(g.skew)
+	return nil
+}
+
+// CheckFresh is Check without remembering the ID, for messages that are
+// deduplicated elsewhere, e.g. by JetStream, and would otherwise have to be
+// remembered for a long window.
+func CheckFresh(id string, ts time.Time, skew time.Duration) error {
+	return checkFresh(id, ts, time.Now(), skew)
+}
+
+func checkFresh(id string, ts, now time.Time, skew time.Duration) error {
+	if id == "" {
+		return fmt.Errorf("missing message id")
+	}
+	if ts.IsZero() {
+		return fmt.Errorf("missing timestamp")
+	}
+	if d := now.Sub(ts); d > skew || d < -skew {
+		return fmt.Errorf("timestamp %s outside ±%s of local clock", ts.UTC().Format(time.RFC3339), skew)
+	}
+	return nil
+}
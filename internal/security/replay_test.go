@@ -0,0 +1,70 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := NewReplayGuard(time.Minute)
+	g.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		id      string
+		ts      time.Time
+		wantErr bool
+	}{
+		{name: "fresh", id: "a", ts: now},
+		{name: "duplicate", id: "a", ts: now, wantErr: true},
+		{name: "slightly behind", id: "b", ts: now.Add(-50 * time.Second)},
+		{name: "slightly ahead", id: "c", ts: now.Add(50 * time.Second)},
+		{name: "too old", id: "d", ts: now.Add(-2 * time.Minute), wantErr: true},
+		{name: "too far ahead", id: "e", ts: now.Add(2 * time.Minute), wantErr: true},
+		{name: "missing id", id: "", ts: now, wantErr: true},
+		{name: "missing timestamp", id: "f", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := g.Check(tt.id, tt.ts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check(%q) error = %v, wantErr %v", tt.id, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayGuardForgetsExpiredIDs(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := NewReplayGuard(time.Minute)
+	g.now = func() time.Time { return now }
+
+	if err := g.Check("a", now); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+
+	now = now.Add(3 * time.Minute)
+	if err := g.Check("b", now); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if _, ok := g.seen["a"]; ok {
+		t.Errorf("expired id still remembered")
+	}
+}
+
+func TestCheckFreshRemembersNothing(t *testing.T) {
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := CheckFresh("a", now.Add(-6*24*time.Hour), 7*24*time.Hour); err != nil {
+			t.Fatalf("CheckFresh() error = %v", err)
+		}
+	}
+	if err := CheckFresh("a", now.Add(-8*24*time.Hour), 7*24*time.Hour); err == nil {
+		t.Errorf("CheckFresh() accepted a timestamp outside the window")
+	}
+	if err := CheckFresh("", now, time.Minute); err == nil {
+		t.Errorf("CheckFresh() accepted a missing message id")
+	}
+}
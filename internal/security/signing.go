@@ -0,0 +1,98 @@
+package security
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/nats-io/nkeys"
+)
+
+// LoadSigningKey reads an nkey user seed ("SU...") from path.
+func LoadSigningKey(path string) (nkeys.KeyPair, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kp, err := nkeys.FromSeed(bytes.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if pub, _ := kp.PublicKey(); !nkeys.IsValidPublicUserKey(pub) {
+		return nil, fmt.Errorf("%s: not a user seed", path)
+	}
+	return kp, nil
+}
+
+// GenerateSigningKey creates a new nkey user key pair, writes its seed to
+// path with mode 0600 and returns the public key. An existing file is never
+// overwritten.
+func GenerateSigningKey(path string) (string, error) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return "", err
+	}
+	if err := writeSeed(path, kp); err != nil {
+		return "", err
+	}
+	return kp.PublicKey()
+}
+
+// LoadOrCreateIdentity reads an agent's nkey server seed ("SN...") from path,
+// generating and saving a new one if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (kp nkeys.KeyPair, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if kp, err = nkeys.CreateServer(); err != nil {
+			return nil, false, err
+		}
+		if err := writeSeed(path, kp); err != nil {
+			return nil, false, err
+		}
+		return kp, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	kp, err = nkeys.FromSeed(bytes.TrimSpace(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", path, err)
+	}
+	if pub, _ := kp.PublicKey(); !nkeys.IsValidPublicServerKey(pub) {
+		return nil, false, fmt.Errorf("%s: not a server seed", path)
+	}
+	return kp, false, nil
+}
+
+// Fingerprint returns a short SSH-style fingerprint of an nkey public key.
+func Fingerprint(pub string) string {
+	sum := sha256.Sum256([]byte(pub))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// writeSeed stores the seed of kp in a new file with mode 0600.
+func writeSeed(path string, kp nkeys.KeyPair) error {
+	seed, err := kp.Seed()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(seed, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}